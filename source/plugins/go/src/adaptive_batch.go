@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// AdaptiveBatchSizer adjusts the number of records a Sender flushes per batch to the observed endpoint latency:
+// the size grows by a quarter after every post answered within half of targetLatency and is halved after a failed
+// post or one slower than targetLatency, staying within [minSize, maxSize]
+type AdaptiveBatchSizer struct {
+	mutex         sync.Mutex
+	size          int
+	minSize       int
+	maxSize       int
+	targetLatency time.Duration
+	// clock used to measure the post latency, time.Now unless replaced (tests)
+	now func() time.Time
+}
+
+// NewAdaptiveBatchSizer creates a sizer starting at initialSize, clamped to [minSize, maxSize]
+func NewAdaptiveBatchSizer(initialSize, minSize, maxSize int, targetLatency time.Duration) *AdaptiveBatchSizer {
+	b := &AdaptiveBatchSizer{
+		minSize:       minSize,
+		maxSize:       maxSize,
+		targetLatency: targetLatency,
+		now:           time.Now,
+	}
+	b.size = b.clamp(initialSize)
+	return b
+}
+
+// Size returns the current batch size, 0 for a nil sizer
+func (b *AdaptiveBatchSizer) Size() int {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.size
+}
+
+// Observe adjusts the batch size to the outcome of a post that took latency
+func (b *AdaptiveBatchSizer) Observe(latency time.Duration, err error) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	previous := b.size
+	switch {
+	case err != nil || latency > b.targetLatency:
+		b.size = b.clamp(b.size / 2)
+	case latency <= b.targetLatency/2:
+		step := b.size / 4
+		if step < 1 {
+			step = 1
+		}
+		b.size = b.clamp(b.size + step)
+	}
+	size := b.size
+	b.mutex.Unlock()
+
+	if size < previous {
+		Log("AdaptiveBatchSizer::Info::Post took %s (error: %v), shrinking the batch size from %d to %d", latency, err, previous, size)
+	}
+}
+
+// start returns the time a post starts at, for observe
+func (b *AdaptiveBatchSizer) start() time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	return b.now()
+}
+
+// observe adjusts the batch size to the outcome of a post started at start
+func (b *AdaptiveBatchSizer) observe(start time.Time, err error) {
+	if b == nil {
+		return
+	}
+	b.Observe(b.now().Sub(start), err)
+}
+
+func (b *AdaptiveBatchSizer) clamp(size int) int {
+	if size < b.minSize {
+		return b.minSize
+	}
+	if size > b.maxSize {
+		return b.maxSize
+	}
+	return size
+}
+
+// getAdaptiveBatchSizer creates the sizer from adaptive_batching, adaptive_batch_min_count, adaptive_batch_max_count
+// and adaptive_batch_target_latency_ms in the plugin config, starting at initialSize (batch_max_count).
+// Returns nil unless adaptive_batching is enabled
+func getAdaptiveBatchSizer(config map[string]string, initialSize int) *AdaptiveBatchSizer {
+	if !GetBool(config, "adaptive_batching", false) {
+		return nil
+	}
+	minSize := getPositiveInt(config, "adaptive_batch_min_count", defaultAdaptiveBatchMinCount)
+	maxSize := getPositiveInt(config, "adaptive_batch_max_count", defaultAdaptiveBatchMaxCount)
+	if minSize > maxSize {
+		Log("adaptive_batch_min_count %d is above adaptive_batch_max_count %d. Using defaults of %d and %d", minSize, maxSize, defaultAdaptiveBatchMinCount, defaultAdaptiveBatchMaxCount)
+		minSize, maxSize = defaultAdaptiveBatchMinCount, defaultAdaptiveBatchMaxCount
+	}
+	targetLatencyMs := getPositiveInt(config, "adaptive_batch_target_latency_ms", defaultAdaptiveBatchTargetLatencyMs)
+	if initialSize <= 0 {
+		initialSize = minSize
+	}
+	b := NewAdaptiveBatchSizer(initialSize, minSize, maxSize, time.Duration(targetLatencyMs)*time.Millisecond)
+	Log("Adaptive batching enabled: %d to %d records, target latency %dms, starting at %d", minSize, maxSize, targetLatencyMs, b.Size())
+	return b
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Sender_AdaptiveBatchSize(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	now := time.Unix(0, 0)
+	s := newSender(ContainerLogDataType, 0, 0)
+	s.adaptive = NewAdaptiveBatchSizer(4, 2, 8, 100*time.Millisecond)
+	s.adaptive.now = func() time.Time { return now }
+
+	var latency time.Duration
+	var postErr error
+	var sizes []int
+	s.post = func(ctx context.Context, records [][]byte) error {
+		sizes = append(sizes, len(records))
+		now = now.Add(latency)
+		return postErr
+	}
+	// enqueues exactly one batch of the current size and returns the size after that post
+	postBatch := func(l time.Duration, err error) int {
+		latency, postErr = l, err
+		for i, size := 0, s.AdaptiveBatchSize(); i < size; i++ {
+			s.Enqueue([]byte(`{"LogEntry":"a"}`))
+		}
+		return s.AdaptiveBatchSize()
+	}
+
+	steps := []struct {
+		name    string
+		latency time.Duration
+		err     error
+		want    int
+	}{
+		{"fast post grows", 10 * time.Millisecond, nil, 5},
+		{"fast post grows again", 50 * time.Millisecond, nil, 6},
+		{"slow post shrinks", 200 * time.Millisecond, nil, 3},
+		{"failed post shrinks to min", 10 * time.Millisecond, errors.New("503"), 2},
+		{"latency within target keeps the size", 70 * time.Millisecond, nil, 2},
+		{"fast post grows from min", 10 * time.Millisecond, nil, 3},
+	}
+	for _, step := range steps {
+		if got := postBatch(step.latency, step.err); got != step.want {
+			t.Errorf("%s: AdaptiveBatchSize() = %d, want %d", step.name, got, step.want)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		postBatch(time.Millisecond, nil)
+	}
+	if got := s.AdaptiveBatchSize(); got != 8 {
+		t.Errorf("AdaptiveBatchSize() after fast posts = %d, want the max of 8", got)
+	}
+	if want := []int{4, 5, 6, 3, 2, 2}; !reflect.DeepEqual(sizes[:len(want)], want) {
+		t.Errorf("posted batches of %v, want %v", sizes[:len(want)], want)
+	}
+	if s.QueueDepth() != 0 {
+		t.Errorf("QueueDepth() = %d, want every batch flushed at the adaptive size", s.QueueDepth())
+	}
+}
+
+func Test_getAdaptiveBatchSizer(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	if b := getAdaptiveBatchSizer(map[string]string{}, 100); b != nil {
+		t.Errorf("getAdaptiveBatchSizer() without adaptive_batching = %+v, want nil", b)
+	}
+	disabled := newSender(ContainerLogDataType, 100, 0)
+	if got := disabled.AdaptiveBatchSize(); got != 0 {
+		t.Errorf("AdaptiveBatchSize() with adaptive batching disabled = %d, want 0", got)
+	}
+
+	tests := []struct {
+		name        string
+		config      map[string]string
+		initialSize int
+		want        [3]int
+	}{
+		{"defaults", map[string]string{"adaptive_batching": "on"}, 0, [3]int{defaultAdaptiveBatchMinCount, defaultAdaptiveBatchMaxCount, defaultAdaptiveBatchMinCount}},
+		{"starts at batch_max_count", map[string]string{"adaptive_batching": "true", "adaptive_batch_min_count": "5", "adaptive_batch_max_count": "50"}, 20, [3]int{5, 50, 20}},
+		{"clamps batch_max_count", map[string]string{"adaptive_batching": "true", "adaptive_batch_max_count": "50"}, 500, [3]int{defaultAdaptiveBatchMinCount, 50, 50}},
+		{"min above max", map[string]string{"adaptive_batching": "true", "adaptive_batch_min_count": "50", "adaptive_batch_max_count": "5"}, 0, [3]int{defaultAdaptiveBatchMinCount, defaultAdaptiveBatchMaxCount, defaultAdaptiveBatchMinCount}},
+		{"invalid bounds", map[string]string{"adaptive_batching": "true", "adaptive_batch_min_count": "-1", "adaptive_batch_max_count": "abc"}, 0, [3]int{defaultAdaptiveBatchMinCount, defaultAdaptiveBatchMaxCount, defaultAdaptiveBatchMinCount}},
+	}
+	for _, tt := range tests {
+		b := getAdaptiveBatchSizer(tt.config, tt.initialSize)
+		if b == nil {
+			t.Errorf("%s: getAdaptiveBatchSizer() = nil", tt.name)
+			continue
+		}
+		if got := [3]int{b.minSize, b.maxSize, b.Size()}; got != tt.want {
+			t.Errorf("%s: getAdaptiveBatchSizer() min, max, size = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	b := getAdaptiveBatchSizer(map[string]string{"adaptive_batching": "true", "adaptive_batch_target_latency_ms": "250"}, 0)
+	if b.targetLatency != 250*time.Millisecond {
+		t.Errorf("targetLatency = %s, want 250ms", b.targetLatency)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidBatchHeader is returned for a batch header with an invalid or reserved name, or an invalid value
+var ErrInvalidBatchHeader = errors.New("invalid batch header")
+
+// reservedBatchHeaders are set by the posting path itself and can't be supplied per batch
+var reservedBatchHeaders = []string{"Authorization", "Content-Encoding", "Content-Length", "Host", "Transfer-Encoding", "X-Request-ID"}
+
+// batchHeaderContextKey is the context key of the headers supplied for a batch
+type batchHeaderContextKey struct{}
+
+// WithBatchHeader returns a context making the posts made with it (PostRecordsToODS, PostFormattedRecordsToODS)
+// send header on top of the headers common to every post, e.g. a routing header for the data type of a record
+// source. A header set in both takes the value of header
+func WithBatchHeader(ctx context.Context, header http.Header) (context.Context, error) {
+	if err := validateBatchHeader(header); err != nil {
+		return ctx, err
+	}
+	return withBatchHeader(ctx, canonicalBatchHeader(header)), nil
+}
+
+// withBatchHeader attaches an already validated header to ctx. A nil header removes the one of a parent context
+func withBatchHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, batchHeaderContextKey{}, header)
+}
+
+// canonicalBatchHeader copies header with canonical names, so headers of differently cased names compare equal.
+// Returns nil for an empty header
+func canonicalBatchHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	canonical := make(http.Header, len(header))
+	for name, values := range header {
+		key := http.CanonicalHeaderKey(name)
+		canonical[key] = append(canonical[key], values...)
+	}
+	return canonical
+}
+
+// applyBatchHeader sets the batch header of ctx on header, replacing the common values of the same names
+func applyBatchHeader(ctx context.Context, header http.Header) {
+	batchHeader, _ := ctx.Value(batchHeaderContextKey{}).(http.Header)
+	for name, values := range batchHeader {
+		header[name] = values
+	}
+}
+
+// validateBatchHeader checks header names are tokens (RFC 7230) that aren't reserved, and values have no control
+// characters but tab, which would let a value inject headers or break the request
+func validateBatchHeader(header http.Header) error {
+	for name, values := range header {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return !isHeaderTokenRune(r) }) >= 0 {
+			return fmt.Errorf("%w: name %q isn't a token", ErrInvalidBatchHeader, name)
+		}
+		for _, reserved := range reservedBatchHeaders {
+			if strings.EqualFold(name, reserved) {
+				return fmt.Errorf("%w: %s is set by the posting path", ErrInvalidBatchHeader, name)
+			}
+		}
+		for _, value := range values {
+			if strings.IndexFunc(value, func(r rune) bool { return r != '\t' && (r < ' ' || r == 0x7f) }) >= 0 {
+				return fmt.Errorf("%w: value of %s has control characters", ErrInvalidBatchHeader, name)
+			}
+		}
+	}
+	return nil
+}
+
+// isHeaderTokenRune reports whether r is a tchar of RFC 7230
+func isHeaderTokenRune(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// sameBatchHeader reports whether two batch headers carry the same values, so their records can share a batch
+func sameBatchHeader(a http.Header, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, values := range a {
+		other, ok := b[name]
+		if !ok || len(other) != len(values) {
+			return false
+		}
+		for i := range values {
+			if values[i] != other[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
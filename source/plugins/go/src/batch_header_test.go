@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/internal/testutil"
+)
+
+func newBatchHeaderTestServer(t *testing.T) *testutil.MockOMSServer {
+	server := testutil.NewMockOMSServer(t, testutil.MockOMSOptions{})
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	t.Cleanup(func() { OMSEndpoint = originalEndpoint })
+	return server
+}
+
+func Test_PostRecordsToODS_BatchHeader(t *testing.T) {
+	server := newBatchHeaderTestServer(t)
+	ResourceCentric = true
+	ResourceID = "/subscriptions/global"
+	defer func() {
+		ResourceCentric = false
+		ResourceID = ""
+	}()
+
+	ctx, err := WithBatchHeader(context.Background(), http.Header{
+		"x-ms-azureresourceid": {"/subscriptions/batch"},
+		"X-Ms-Data-Type":       {"ContainerLogV2"},
+	})
+	if err != nil {
+		t.Fatalf("WithBatchHeader() error = %v", err)
+	}
+	records := [][]byte{[]byte(`{"LogMessage":"routed"}`)}
+	if err := PostRecordsToODS(ctx, ContainerLogV2DataType, records); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+	if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, records); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("server got %d requests, want 2", len(requests))
+	}
+	if got := requests[0].Header.Get("X-Ms-Data-Type"); got != "ContainerLogV2" {
+		t.Errorf("X-Ms-Data-Type = %q, want the batch header", got)
+	}
+	// the batch header overrides the global one, which is the fallback for posts without it
+	if got := requests[0].Header["X-Ms-Azureresourceid"]; len(got) != 1 || got[0] != "/subscriptions/batch" {
+		t.Errorf("x-ms-AzureResourceId with the batch header = %v, want [/subscriptions/batch]", got)
+	}
+	if got := requests[1].Header.Get("x-ms-AzureResourceId"); got != "/subscriptions/global" {
+		t.Errorf("x-ms-AzureResourceId without the batch header = %q, want /subscriptions/global", got)
+	}
+	if got := requests[1].Header.Get("X-Ms-Data-Type"); got != "" {
+		t.Errorf("X-Ms-Data-Type without the batch header = %q, want none", got)
+	}
+}
+
+func Test_Sender_EnqueueWithHeader(t *testing.T) {
+	server := newBatchHeaderTestServer(t)
+	s := newSender(ContainerLogV2DataType, 10, time.Minute)
+
+	v1 := http.Header{"X-Ms-Data-Type": {"ContainerLog"}}
+	v2 := http.Header{"x-ms-data-type": {"ContainerLogV2"}}
+	for _, header := range []http.Header{v1, v1, v2, {"X-MS-DATA-TYPE": {"ContainerLogV2"}}} {
+		if err := s.EnqueueWithHeader([]byte(`{"LogMessage":"record"}`), header); err != nil {
+			t.Fatalf("EnqueueWithHeader() error = %v", err)
+		}
+	}
+	s.Enqueue([]byte(`{"LogMessage":"plain"}`))
+	s.Flush(context.Background())
+
+	var got []string
+	for _, request := range server.Requests() {
+		got = append(got, fmt.Sprintf("%d:%s", len(request.DataItems()), request.Header.Get("X-Ms-Data-Type")))
+	}
+	if want := "[2:ContainerLog 2:ContainerLogV2 1:]"; fmt.Sprint(got) != want {
+		t.Errorf("posted batches = %v, want %s", got, want)
+	}
+
+	if err := s.EnqueueWithHeader([]byte(`{}`), http.Header{"X-Bad": {"a\r\nInjected: b"}}); !errors.Is(err, ErrInvalidBatchHeader) {
+		t.Errorf("EnqueueWithHeader() with a CRLF value error = %v, want ErrInvalidBatchHeader", err)
+	}
+	if s.QueueDepth() != 0 {
+		t.Errorf("QueueDepth() = %d, want the record with an invalid header rejected", s.QueueDepth())
+	}
+}
+
+func Test_validateBatchHeader(t *testing.T) {
+	tests := []struct {
+		header  http.Header
+		wantErr bool
+	}{
+		{nil, false},
+		{http.Header{"X-Ms-Data-Type": {"ContainerLogV2"}}, false},
+		{http.Header{"X-Tab": {"a\tb"}}, false},
+		{http.Header{"Content-Type": {"application/x-ndjson"}}, false},
+		{http.Header{"": {"value"}}, true},
+		{http.Header{"Bad Name": {"value"}}, true},
+		{http.Header{"Bad:Name": {"value"}}, true},
+		{http.Header{"X-Value": {"a\nb"}}, true},
+		{http.Header{"X-Value": {"a\x00b"}}, true},
+		{http.Header{"content-length": {"10"}}, true},
+		{http.Header{"X-Request-ID": {"mine"}}, true},
+		{http.Header{"Authorization": {"Bearer x"}}, true},
+	}
+	for _, tt := range tests {
+		err := validateBatchHeader(tt.header)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateBatchHeader(%v) error = %v, wantErr %v", tt.header, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidBatchHeader) {
+			t.Errorf("validateBatchHeader(%v) error = %v, want ErrInvalidBatchHeader", tt.header, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// fileStamp identifies a version of a watched file, the zero value for a missing file
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}
+}
+
+// fileStamps holds the last seen stamps of watched files
+type fileStamps map[string]fileStamp
+
+// changed records the current stamps of files, returning the files that changed since the previous check. A file
+// checked for the first time isn't reported
+func (stamps fileStamps) changed(files []string) []string {
+	var changed []string
+	for _, path := range files {
+		stamp := statFile(path)
+		previous, ok := stamps[path]
+		stamps[path] = stamp
+		if ok && stamp != previous {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// credentialFileWatcher notices the rotation of the cert/key files and changes of the proxy file by comparing their
+// size and modification time on every check. os.Stat follows symlinks, so the atomic swap of a mounted secret is
+// noticed too
+type credentialFileWatcher struct {
+	stamps fileStamps
+	// recreate rebuilds the HTTP client, RecreateHTTPClient unless replaced (tests)
+	recreate func() error
+}
+
+func newCredentialFileWatcher() *credentialFileWatcher {
+	w := &credentialFileWatcher{stamps: fileStamps{}, recreate: RecreateHTTPClient}
+	w.stamps.changed(w.watchedFiles())
+	return w
+}
+
+// watchedFiles returns the cert/key files, unless in AAD MSI auth mode, and the proxy and proxy credentials files of
+// the current config.
+// They are read on every check, so a reloaded config is followed
+func (w *credentialFileWatcher) watchedFiles() []string {
+	PluginConfigurationMutex.Lock()
+	config := PluginConfiguration
+	PluginConfigurationMutex.Unlock()
+	var files []string
+	if !IsAADMSIAuthMode {
+		certFilePath, keyFilePath := getCertKeyFilePaths()
+		files = append(files, certFilePath, keyFilePath)
+	}
+	proxySecretPath := strings.TrimSpace(config["omsproxy_secret_path"])
+	if proxySecretPath == "" {
+		proxySecretPath = strings.TrimSpace(config["omsproxy_conf_path"])
+	}
+	if proxySecretPath != "" {
+		files = append(files, proxySecretPath)
+	}
+	if credentialsPath := strings.TrimSpace(config["omsproxy_credentials_path"]); credentialsPath != "" {
+		files = append(files, credentialsPath)
+	}
+	return files
+}
+
+// check recreates the HTTP client if a watched file changed, re-reading the proxy endpoint first. A rotation caught
+// half written is rejected by RecreateHTTPClient, which keeps the current client and retries later
+func (w *credentialFileWatcher) check() {
+	changed := w.stamps.changed(w.watchedFiles())
+	if len(changed) == 0 {
+		return
+	}
+	Log("CertWatcher::Info::%s changed, recreating the HTTP Client", strings.Join(changed, ", "))
+	reloadProxyEndpoint()
+	w.recreate()
+}
+
+// reloadProxyEndpoint re-reads ProxyEndpoint from the current config, keeping the current one if the proxy file
+// can't be read
+func reloadProxyEndpoint() {
+	PluginConfigurationMutex.Lock()
+	config := PluginConfiguration
+	PluginConfigurationMutex.Unlock()
+	proxyEndpoint, source, err := getProxyEndpoint(config)
+	if err != nil {
+		message := "CertWatcher::Error::Unable to read the proxy configuration, keeping the current proxy: " + err.Error()
+		Log(message)
+		SendException(message)
+		return
+	}
+	HTTPClientUpdateMutex.Lock()
+	previous := ProxyEndpoint
+	ProxyEndpoint = proxyEndpoint
+	HTTPClientUpdateMutex.Unlock()
+	switch {
+	case proxyEndpoint == previous:
+	case proxyEndpoint == "":
+		Log("CertWatcher::Info::Proxy configuration removed, posting without a proxy")
+	default:
+		Log("CertWatcher::Info::Proxy configuration changed, now read from %s", source)
+	}
+}
+
+// StartCertWatcher checks the cert/key and proxy files every cert_watch_interval seconds (defaulting to
+// defaultCertWatchIntervalSeconds, 0 disables the watch), recreating the HTTP client when they change so rotated
+// credentials are used without a restart
+func StartCertWatcher(config map[string]string) {
+	interval := getTimeoutFromConfig(config, "cert_watch_interval", defaultCertWatchIntervalSeconds)
+	if interval == 0 {
+		Log("Cert watcher disabled")
+		return
+	}
+	watcher := newCredentialFileWatcher()
+	Log("Watching the cert/key and proxy files every %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			watcher.check()
+		}
+	}()
+}
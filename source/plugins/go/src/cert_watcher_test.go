@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeWatchedFile replaces a watched file, moving its modification time forward so the change is noticed even
+// within the timestamp granularity of the filesystem
+func writeWatchedFile(t *testing.T, path string, content []byte) {
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_credentialFileWatcher_RotatesCertAndProxy(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	dir := t.TempDir()
+	certFilePath, keyFilePath := filepath.Join(dir, "oms.crt"), filepath.Join(dir, "oms.key")
+	proxyFilePath := filepath.Join(dir, "proxy")
+	IsWindows = true
+	defer func() { IsWindows = false }()
+	PluginConfiguration = map[string]string{"cert_file_path": certFilePath, "key_file_path": keyFilePath, "omsproxy_secret_path": proxyFilePath}
+	defer func() { PluginConfiguration = nil }()
+	originalProxyEndpoint := ProxyEndpoint
+	defer func() { ProxyEndpoint = originalProxyEndpoint }()
+
+	certPEM, keyPEM := generateTestCertificate(t, "first")
+	writeWatchedFile(t, certFilePath, certPEM)
+	writeWatchedFile(t, keyFilePath, keyPEM)
+	writeWatchedFile(t, proxyFilePath, []byte("http://proxy-a:8080"))
+	ProxyEndpoint = "http://proxy-a:8080"
+	CreateHTTPClient()
+	watcher := newCredentialFileWatcher()
+	recreated := 0
+	watcher.recreate = func() error {
+		recreated++
+		return RecreateHTTPClient()
+	}
+
+	watcher.check()
+	if recreated != 0 {
+		t.Errorf("recreated the client %d times without a change, want 0", recreated)
+	}
+
+	// the onboarding renews the cert
+	certPEM, keyPEM = generateTestCertificate(t, "rotated")
+	writeWatchedFile(t, certFilePath, certPEM)
+	writeWatchedFile(t, keyFilePath, keyPEM)
+	watcher.check()
+	if name := currentClientCertCommonName(t); recreated != 1 || name != "rotated" {
+		t.Errorf("client cert = %s after %d recreations, want rotated after 1", name, recreated)
+	}
+
+	// the proxy file changes
+	writeWatchedFile(t, proxyFilePath, []byte("http://proxy-b:3128"))
+	watcher.check()
+	if ProxyEndpoint != "http://proxy-b:3128" || recreated != 2 {
+		t.Fatalf("ProxyEndpoint = %s after %d recreations, want http://proxy-b:3128 after 2", ProxyEndpoint, recreated)
+	}
+	req, _ := http.NewRequest("POST", "https://workspace.ods.opinsights.azure.com", nil)
+	proxyURL, err := GetClient().Transport.(*http.Transport).Proxy(req)
+	if err != nil || proxyURL == nil || proxyURL.Host != "proxy-b:3128" {
+		t.Errorf("client proxy = (%v, %v), want proxy-b:3128", proxyURL, err)
+	}
+}
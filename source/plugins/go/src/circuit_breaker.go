@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by the posting path without sending anything while ODSCircuitBreaker is open, so
+// callers can buffer or drop the records right away instead of waiting for a request that is expected to fail
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker tracks consecutive failed posts to OMSEndpoint. After failureThreshold of them the circuit opens
+// for cooldown, then lets a single trial post through (half-open): a success closes it again, a failure re-opens it.
+// A nil breaker is always closed
+type CircuitBreaker struct {
+	mutex               sync.Mutex
+	failureThreshold    int
+	cooldown            time.Duration
+	consecutiveFailures int
+	openedAt            time.Time
+	// trialStartedAt is set while the half-open trial post is in flight, a trial that never records its outcome
+	// lets the next one through after cooldown
+	trialStartedAt time.Time
+	now            func() time.Time
+}
+
+// NewCircuitBreaker creates a closed breaker
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		now:              time.Now,
+	}
+}
+
+// State returns CircuitClosed, CircuitOpen or CircuitHalfOpen
+func (b *CircuitBreaker) State() string {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.stateLocked()
+}
+
+func (b *CircuitBreaker) stateLocked() string {
+	if b.consecutiveFailures < b.failureThreshold {
+		return CircuitClosed
+	}
+	if b.now().Sub(b.openedAt) < b.cooldown {
+		return CircuitOpen
+	}
+	return CircuitHalfOpen
+}
+
+// ODSCircuitState returns the state of ODSCircuitBreaker, CircuitClosed if it is disabled
+func ODSCircuitState() string {
+	return ODSCircuitBreaker.State()
+}
+
+// IsOpen reports whether a post should fail fast. While half-open it claims the trial for the caller, which must
+// record its outcome, and is open for every other post until then
+func (b *CircuitBreaker) IsOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.stateLocked() {
+	case CircuitOpen:
+		return true
+	case CircuitHalfOpen:
+		if !b.trialStartedAt.IsZero() && b.now().Sub(b.trialStartedAt) < b.cooldown {
+			return true
+		}
+		b.trialStartedAt = b.now()
+	}
+	return false
+}
+
+// RecordSuccess closes the circuit
+func (b *CircuitBreaker) RecordSuccess() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.consecutiveFailures >= b.failureThreshold {
+		Log("CircuitBreaker::Info::Closing circuit after a successful post")
+	}
+	b.consecutiveFailures = 0
+	b.trialStartedAt = time.Time{}
+}
+
+// RecordFailure counts a failed post, opening (or re-opening) the circuit once failureThreshold is reached
+func (b *CircuitBreaker) RecordFailure() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.consecutiveFailures++
+	b.trialStartedAt = time.Time{}
+	if b.consecutiveFailures >= b.failureThreshold {
+		if b.consecutiveFailures == b.failureThreshold {
+			Log("CircuitBreaker::Warning::Opening circuit for %s after %d consecutive failed posts", b.cooldown, b.consecutiveFailures)
+		}
+		b.openedAt = b.now()
+	}
+}
+
+// getCircuitBreaker creates the breaker from circuit_breaker_failure_threshold and circuit_breaker_cooldown (seconds)
+// in the plugin config. A threshold of 0 disables it
+func getCircuitBreaker(config map[string]string) *CircuitBreaker {
+	threshold := defaultCircuitBreakerFailureThreshold
+	if value := config["circuit_breaker_failure_threshold"]; value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			Log("Invalid value %s for circuit_breaker_failure_threshold. Using default of %d", value, defaultCircuitBreakerFailureThreshold)
+		} else {
+			threshold = count
+		}
+	}
+	if threshold == 0 {
+		return nil
+	}
+	cooldownSeconds := defaultCircuitBreakerCooldownSeconds
+	if value := config["circuit_breaker_cooldown"]; value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			Log("Invalid value %s for circuit_breaker_cooldown. Using default of %d", value, defaultCircuitBreakerCooldownSeconds)
+		} else {
+			cooldownSeconds = seconds
+		}
+	}
+	return NewCircuitBreaker(threshold, time.Duration(cooldownSeconds)*time.Second)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+func Test_CircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		breaker.RecordFailure()
+	}
+	if got := breaker.State(); got != CircuitClosed {
+		t.Errorf("State() after 2 failures = %s, want %s", got, CircuitClosed)
+	}
+	breaker.RecordFailure()
+	if got := breaker.State(); got != CircuitOpen {
+		t.Errorf("State() after 3 failures = %s, want %s", got, CircuitOpen)
+	}
+
+	now = now.Add(time.Minute)
+	if got := breaker.State(); got != CircuitHalfOpen {
+		t.Errorf("State() after the cooldown = %s, want %s", got, CircuitHalfOpen)
+	}
+	// the trial post failed
+	breaker.RecordFailure()
+	if got := breaker.State(); got != CircuitOpen {
+		t.Errorf("State() after a failed trial = %s, want %s", got, CircuitOpen)
+	}
+
+	now = now.Add(time.Minute)
+	breaker.RecordSuccess()
+	if got := breaker.State(); got != CircuitClosed {
+		t.Errorf("State() after a successful trial = %s, want %s", got, CircuitClosed)
+	}
+
+	var disabled *CircuitBreaker
+	disabled.RecordFailure()
+	if disabled.IsOpen() {
+		t.Errorf("a nil breaker is open")
+	}
+}
+
+func Test_CircuitBreaker_HalfOpenSingleTrial(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	now := time.Now()
+	var nowMutex sync.Mutex
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.now = func() time.Time {
+		nowMutex.Lock()
+		defer nowMutex.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowMutex.Lock()
+		now = now.Add(d)
+		nowMutex.Unlock()
+	}
+	breaker.RecordFailure()
+	advance(time.Minute)
+
+	var trials int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !breaker.IsOpen() {
+				atomic.AddInt32(&trials, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if trials != 1 {
+		t.Fatalf("%d concurrent posts let through half-open, want a single trial", trials)
+	}
+	if got := breaker.State(); got != CircuitHalfOpen {
+		t.Errorf("State() with the trial in flight = %s, want %s", got, CircuitHalfOpen)
+	}
+
+	// a trial that never records its outcome doesn't keep the circuit open past the cooldown
+	advance(time.Minute)
+	if breaker.IsOpen() {
+		t.Fatalf("IsOpen() a cooldown after an unfinished trial = true, want a new trial")
+	}
+	breaker.RecordSuccess()
+	for i := 0; i < 2; i++ {
+		if breaker.IsOpen() {
+			t.Errorf("IsOpen() after a successful trial = true, want closed")
+		}
+	}
+}
+
+func Test_PostStreamToODS_CircuitOpen(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	defer func() { ODSCircuitBreaker = nil }()
+	now := time.Now()
+	ODSCircuitBreaker = NewCircuitBreaker(1, time.Minute)
+	ODSCircuitBreaker.now = func() time.Time { return now }
+	ODSCircuitBreaker.RecordFailure()
+	if got := ODSCircuitState(); got != CircuitOpen {
+		t.Fatalf("ODSCircuitState() = %s, want %s", got, CircuitOpen)
+	}
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	start := time.Now()
+	_, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("PostStreamToODS() error = %v, want ErrCircuitOpen", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("PostStreamToODS() took %s with the circuit open, want an immediate failure", elapsed)
+	}
+	if attempts != 0 {
+		t.Errorf("server got %d requests with the circuit open, want 0", attempts)
+	}
+
+	// after the cooldown the trial post goes through and closes the circuit
+	now = now.Add(time.Minute)
+	if _, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody); err != nil {
+		t.Errorf("half-open PostStreamToODS() error = %v, want the trial post to succeed", err)
+	}
+	if got := ODSCircuitState(); got != CircuitClosed || attempts != 1 {
+		t.Errorf("after the trial post state = %s with %d requests, want %s with 1", got, attempts, CircuitClosed)
+	}
+}
+
+func Test_PostDataHelper_CircuitOpen(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	var attempts int32
+	var encoding atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		encoding.Store(r.Header.Get("Content-Encoding"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	GzipMinBytes = 1
+	defer func() { OMSEndpoint, GzipMinBytes, ODSCircuitBreaker = originalEndpoint, 0, nil }()
+	now := time.Now()
+	ODSCircuitBreaker = NewCircuitBreaker(1, time.Minute)
+	ODSCircuitBreaker.now = func() time.Time { return now }
+	ODSCircuitBreaker.RecordFailure()
+
+	records := []map[interface{}]interface{}{{
+		"filepath": []byte("/var/log/containers/web-0_default_nginx-0123456789abcdef.log"),
+		"stream":   []byte("stdout"),
+		"log":      []byte("line"),
+		"time":     []byte(time.Now().UTC().Format(time.RFC3339)),
+	}}
+	start := time.Now()
+	if code := PostDataHelper(records); code != output.FLB_RETRY {
+		t.Errorf("PostDataHelper() with the circuit open = %d, want FLB_RETRY", code)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("PostDataHelper() took %s with the circuit open, want an immediate failure", elapsed)
+	}
+	if attempts != 0 {
+		t.Errorf("server got %d requests with the circuit open, want 0", attempts)
+	}
+
+	// the trial post is sent like a batch, gzipped from gzip_min_bytes, and closes the circuit
+	now = now.Add(time.Minute)
+	if code := PostDataHelper(records); code != output.FLB_OK {
+		t.Errorf("half-open PostDataHelper() = %d, want FLB_OK", code)
+	}
+	if got := ODSCircuitState(); got != CircuitClosed || attempts != 1 {
+		t.Errorf("after the trial post state = %s with %d requests, want %s with 1", got, attempts, CircuitClosed)
+	}
+	if got, _ := encoding.Load().(string); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrODSClockSkew is returned when OMSEndpoint rejects a post because the node's clock is off. It indicates an NTP
+// problem on the node rather than bad data, so the records are kept (spilled) instead of deadlettered
+var ErrODSClockSkew = errors.New("ODS rejected the request time, node clock is skewed")
+
+// maxErrorBodyBytes is how much of an error response is read to match it against the clock skew signature
+const maxErrorBodyBytes = 4096
+
+// ClockSkewDetector recognizes clock skew rejections by their status code and a signature in the response body.
+// The offset to the server's clock (from the Date header of the rejection) is cached and sent as x-ms-date with
+// later requests, so a post can be retried once with a corrected time. A nil detector matches nothing
+type ClockSkewDetector struct {
+	mutex      sync.Mutex
+	statusCode int
+	signature  []byte
+	retry      bool
+	offset     time.Duration
+	now        func() time.Time
+}
+
+// NewClockSkewDetector creates a detector matching responses with statusCode whose body contains signature (any
+// body if empty)
+func NewClockSkewDetector(statusCode int, signature string, retry bool) *ClockSkewDetector {
+	return &ClockSkewDetector{
+		statusCode: statusCode,
+		signature:  []byte(signature),
+		retry:      retry,
+		now:        time.Now,
+	}
+}
+
+// Matches reports whether a response is a clock skew rejection
+func (d *ClockSkewDetector) Matches(statusCode int, body []byte) bool {
+	if d == nil || statusCode != d.statusCode {
+		return false
+	}
+	return bytes.Contains(body, d.signature)
+}
+
+// ShouldRetry reports whether a rejected post is retried once with the corrected time
+func (d *ClockSkewDetector) ShouldRetry() bool {
+	return d != nil && d.retry
+}
+
+// Offset returns the cached offset of the server's clock to the node's
+func (d *ClockSkewDetector) Offset() time.Duration {
+	if d == nil {
+		return 0
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.offset
+}
+
+// Report warns about the skew, sends telemetry and caches the offset to the Date header of the rejection
+func (d *ClockSkewDetector) Report(reqID string, serverDate string) {
+	if d == nil {
+		return
+	}
+	offset := "unknown"
+	if date, err := http.ParseTime(serverDate); err == nil {
+		d.mutex.Lock()
+		d.offset = date.Sub(d.now())
+		offset = d.offset.Round(time.Second).String()
+		d.mutex.Unlock()
+	}
+	message := fmt.Sprintf("PostStreamToODS::Error::RequestId %s rejected for CLOCK SKEW, the node's clock is off by %s. Check NTP on the node", reqID, offset)
+	Log(message)
+	SendEvent(eventNameClockSkewDetected, map[string]string{"RequestId": reqID, "Offset": offset})
+}
+
+// apply sets x-ms-date to the node's time corrected by the cached offset, once a skew was reported
+func (d *ClockSkewDetector) apply(header http.Header) {
+	if offset := d.Offset(); offset != 0 {
+		header.Set("x-ms-date", d.now().Add(offset).UTC().Format(http.TimeFormat))
+	}
+}
+
+// getClockSkewDetector creates the detector from clock_skew_status_code, clock_skew_body_signature and
+// clock_skew_retry in the plugin config. A status code of 0 disables it
+func getClockSkewDetector(config map[string]string) *ClockSkewDetector {
+	statusCode := defaultClockSkewStatusCode
+	if value := config["clock_skew_status_code"]; value != "" {
+		code, err := strconv.Atoi(value)
+		if err != nil || code < 0 {
+			Log("Invalid value %s for clock_skew_status_code. Using default of %d", value, defaultClockSkewStatusCode)
+		} else {
+			statusCode = code
+		}
+	}
+	if statusCode == 0 {
+		return nil
+	}
+	signature := defaultClockSkewBodySignature
+	if value, ok := config["clock_skew_body_signature"]; ok {
+		signature = value
+	}
+	return NewClockSkewDetector(statusCode, signature, GetBool(config, "clock_skew_retry", true))
+}
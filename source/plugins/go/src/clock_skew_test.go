@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newClockSkewTestServer rejects requests without an x-ms-date within a minute of its clock, which runs an hour
+// ahead of the node's
+func newClockSkewTestServer(t *testing.T, attempts *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(attempts, 1)
+		serverTime := time.Now().Add(time.Hour)
+		if date, err := http.ParseTime(r.Header.Get("x-ms-date")); err == nil && serverTime.Sub(date) < time.Minute && date.Sub(serverTime) < time.Minute {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Date", serverTime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"Error":"RequestTimeTooSkewed","Message":"The difference between the request time and the server's time is too large."}`))
+	}))
+	t.Cleanup(server.Close)
+	HTTPClient = *server.Client()
+	return server
+}
+
+func Test_PostStreamToODS_ClockSkew(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+	defer func() { ODSClockSkewDetector = nil }()
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+
+	t.Run("retried with the corrected time", func(t *testing.T) {
+		var attempts int32
+		server := newClockSkewTestServer(t, &attempts)
+		ODSClockSkewDetector = getClockSkewDetector(map[string]string{})
+		statusCode, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("PostStreamToODS() = (%d, %v), want (200, nil)", statusCode, err)
+		}
+		if attempts != 2 {
+			t.Errorf("server got %d attempts, want 2", attempts)
+		}
+		if offset := ODSClockSkewDetector.Offset(); offset < 59*time.Minute || offset > 61*time.Minute {
+			t.Errorf("cached offset = %s, want about 1h", offset)
+		}
+		if !loggedContaining(logged(), "CLOCK SKEW") {
+			t.Errorf("clock skew rejection wasn't logged, got %v", logged())
+		}
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		var attempts int32
+		server := newClockSkewTestServer(t, &attempts)
+		ODSClockSkewDetector = getClockSkewDetector(map[string]string{"clock_skew_retry": "false"})
+		statusCode, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+		if !errors.Is(err, ErrODSClockSkew) || statusCode != http.StatusForbidden {
+			t.Errorf("PostStreamToODS() = (%d, %v), want (403, ErrODSClockSkew)", statusCode, err)
+		}
+		if errors.Is(err, ErrODSNonRetriable) {
+			t.Errorf("clock skew rejection reported as ErrODSNonRetriable, the records would be deadlettered")
+		}
+		if attempts != 1 {
+			t.Errorf("server got %d attempts, want 1", attempts)
+		}
+	})
+
+	t.Run("retried once without a retry budget token", func(t *testing.T) {
+		var attempts int32
+		skewServer := newClockSkewTestServer(t, &attempts)
+		// the first attempt fails with a retriable status, its retry takes the only token of the budget
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&attempts) == 0 {
+				atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			skewServer.Config.Handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+		HTTPClient = *server.Client()
+		ODSClockSkewDetector = getClockSkewDetector(map[string]string{})
+		ODSRetryBudget = NewRetryBudget(0.001)
+		defer func() { ODSRetryBudget = nil }()
+		statusCode, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+		if err != nil || statusCode != http.StatusOK {
+			t.Fatalf("PostStreamToODS() = (%d, %v), want (200, nil)", statusCode, err)
+		}
+		if attempts != 3 {
+			t.Errorf("server got %d attempts, want 3", attempts)
+		}
+	})
+
+	t.Run("other forbidden responses", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"Error":"InvalidAuthorization"}`))
+		}))
+		defer server.Close()
+		HTTPClient = *server.Client()
+		ODSClockSkewDetector = getClockSkewDetector(map[string]string{})
+		_, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+		if !errors.Is(err, ErrODSNonRetriable) {
+			t.Errorf("PostStreamToODS() error = %v, want ErrODSNonRetriable", err)
+		}
+	})
+}
+
+func Test_getClockSkewDetector(t *testing.T) {
+	if d := getClockSkewDetector(map[string]string{"clock_skew_status_code": "0"}); d != nil {
+		t.Errorf("getClockSkewDetector() with status code 0 = %+v, want disabled", d)
+	}
+	d := getClockSkewDetector(map[string]string{"clock_skew_status_code": "401", "clock_skew_body_signature": "skew"})
+	if !d.Matches(401, []byte("clock skew")) || d.Matches(403, []byte("clock skew")) || d.Matches(401, []byte("denied")) {
+		t.Errorf("getClockSkewDetector() doesn't use the configured status code and signature")
+	}
+	if d := getClockSkewDetector(map[string]string{"clock_skew_status_code": "abc"}); d.statusCode != defaultClockSkewStatusCode {
+		t.Errorf("getClockSkewDetector() with an invalid status code = %d, want the default", d.statusCode)
+	}
+}
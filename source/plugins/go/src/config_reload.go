@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PluginConfigurationMutex serializes replacing PluginConfiguration on reload. The installed map is never modified,
+// a reload installs a new one
+var PluginConfigurationMutex = &sync.Mutex{}
+
+// httpClientConfigKeys are the keys of the plugin config the HTTP client is built from, changing any of them on
+// reload recreates the client
+var httpClientConfigKeys = []string{
+	"cert_file_path",
+	"key_file_path",
+	"insecure_skip_verify",
+	"tls_server_name",
+	"tls_session_cache_size",
+	"proxy_url",
+	"omsproxy_secret_path",
+	"omsproxy_conf_path",
+	"proxy_rules_path",
+	"proxy_bypass",
+	"omsproxy_credentials_path",
+	"host_overrides",
+	"connect_timeout",
+	"response_header_timeout",
+	"overall_timeout",
+}
+
+// ConfigCheck rejects a config its subscriber couldn't apply, before anything of the config is installed
+type ConfigCheck func(config map[string]string) error
+
+// ConfigSubscriber applies a newly installed plugin config, previous being the config it replaces
+type ConfigSubscriber func(previous map[string]string, current map[string]string) error
+
+// configSubscription is a subscriber registered with SubscribeConfig
+type configSubscription struct {
+	name  string
+	keys  []string
+	check ConfigCheck
+	apply ConfigSubscriber
+}
+
+var (
+	// configSubscriptionsMutex guards configSubscriptions
+	configSubscriptionsMutex = &sync.Mutex{}
+	// configSubscriptions starts with the settings of the plugin itself applied on reload
+	configSubscriptions = []configSubscription{
+		{name: "sender batching", keys: []string{"batch_max_count", "flush_interval"}, apply: applySenderBatchSettings},
+		{name: "record filter", keys: []string{"record_filter"}, check: checkRecordFilter, apply: applyRecordFilter},
+		{name: "container inventory refresh", keys: []string{"container_inventory_refresh_interval"}, apply: applyContainerInventoryRefreshInterval},
+		{name: "HTTP client", keys: httpClientConfigKeys, apply: recreateHTTPClientOnReload},
+	}
+	// configInstallMutex serializes installing configs, so the subscribers see the configs in the order they were
+	// installed whether they were reloaded on SIGHUP, by the config watcher or set by the host
+	configInstallMutex = &sync.Mutex{}
+)
+
+// SubscribeConfig registers a subscriber applying the configs installed on reload that change any of keys (any key
+// if keys is empty). Before a config is installed the check of every subscriber concerned, if not nil, is run and a
+// single failing check rejects the whole config, so a config is applied by all its subscribers or by none. Subscribers
+// are then called in the order they were registered, a failing subscriber doesn't stop the others
+func SubscribeConfig(name string, keys []string, check ConfigCheck, apply ConfigSubscriber) {
+	configSubscriptionsMutex.Lock()
+	defer configSubscriptionsMutex.Unlock()
+	configSubscriptions = append(configSubscriptions, configSubscription{name: name, keys: keys, check: check, apply: apply})
+}
+
+// subscribedTo reports whether a subscription is concerned by the changed keys
+func (subscription configSubscription) subscribedTo(changed []string) bool {
+	if len(subscription.keys) == 0 {
+		return len(changed) > 0
+	}
+	for _, key := range subscription.keys {
+		for _, changedKey := range changed {
+			if key == changedKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readPluginConfiguration reads the plugin config, the CONFIG_PROFILE profile of it if that is set
+func readPluginConfiguration(path string) (map[string]string, error) {
+	if profile := os.Getenv(ConfigProfileEnv); profile != "" {
+		Log("Reading config profile %s", profile)
+		return ReadProfile(path, profile)
+	}
+	return ReadConfiguration(path)
+}
+
+// ReloadConfiguration re-reads the plugin config at path and installs it as PluginConfiguration, re-applying the log
+// level (LOG_LEVEL or log_level) and notifying the subscribers of the keys that changed (see SubscribeConfig): the
+// HTTP client is recreated if any of the keys it is built from changed, batch_max_count and flush_interval are
+// applied to ContainerLogSender without dropping its buffered records, as are its record_filter rules, and the
+// container inventory is refreshed every container_inventory_refresh_interval.
+// A config that can't be read, fails ValidateConfig or a subscriber check is rejected and the current one kept.
+// Settings read once at startup (enabling batching, spillover, ...) still need a restart
+func ReloadConfiguration(path string) error {
+	config, err := readPluginConfiguration(path)
+	if err != nil {
+		return fmt.Errorf("ReloadConfiguration: keeping the current config: %w", err)
+	}
+	if err := installPluginConfiguration(config, path); err != nil {
+		return fmt.Errorf("ReloadConfiguration: %w", err)
+	}
+	return nil
+}
+
+// SetPluginConfiguration installs config as PluginConfiguration for hosts managing the config themselves instead of
+// a file. It is validated and applied like a reloaded config (see ReloadConfiguration): a config failing
+// ValidateConfig is rejected and the current one kept. config is copied, changing it afterwards has no effect
+func SetPluginConfiguration(config map[string]string) error {
+	installed := make(map[string]string, len(config))
+	for key, value := range config {
+		installed[key] = value
+	}
+	if err := installPluginConfiguration(installed, "config set by the host"); err != nil {
+		return fmt.Errorf("SetPluginConfiguration: %w", err)
+	}
+	return nil
+}
+
+// installPluginConfiguration validates config and swaps it in as PluginConfiguration, then notifies the subscribers
+// of what changed. source names where config came from in logs and errors
+func installPluginConfiguration(config map[string]string, source string) error {
+	validation := ValidateConfig(config)
+	for _, warning := range validation.Warnings {
+		Log("Config::Warning::%s", warning)
+	}
+	if validation.HasErrors() {
+		return fmt.Errorf("keeping the current config, %s is invalid: %v", source, validation.Errors)
+	}
+	applyDeprecatedConfigKeys(config)
+
+	configInstallMutex.Lock()
+	defer configInstallMutex.Unlock()
+	PluginConfigurationMutex.Lock()
+	previous := PluginConfiguration
+	PluginConfigurationMutex.Unlock()
+	changed := changedConfigKeys(previous, config)
+	configSubscriptionsMutex.Lock()
+	var subscriptions []configSubscription
+	for _, subscription := range configSubscriptions {
+		if subscription.subscribedTo(changed) {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	configSubscriptionsMutex.Unlock()
+	for _, subscription := range subscriptions {
+		if subscription.check == nil {
+			continue
+		}
+		if err := subscription.check(config); err != nil {
+			return fmt.Errorf("keeping the current config, %s can't be applied to the %s: %w", source, subscription.name, err)
+		}
+	}
+
+	PluginConfigurationMutex.Lock()
+	PluginConfiguration = config
+	PluginConfigurationMutex.Unlock()
+	ApplyLogLevel(config)
+	Log("ReloadConfiguration::Info::Installed %s, changed keys: [%s]", source, strings.Join(changed, ", "))
+
+	var failed error
+	for _, subscription := range subscriptions {
+		if err := subscription.apply(previous, config); err != nil {
+			message := fmt.Sprintf("ReloadConfiguration::Error::The %s failed to apply %s: %s", subscription.name, source, err.Error())
+			Log(message)
+			SendException(message)
+			if failed == nil {
+				failed = fmt.Errorf("config installed but the %s failed to apply it: %w", subscription.name, err)
+			}
+		}
+	}
+	return failed
+}
+
+// applySenderBatchSettings applies the batch_max_count and flush_interval of a reloaded config to ContainerLogSender
+func applySenderBatchSettings(previous map[string]string, config map[string]string) error {
+	if ContainerLogSender == nil {
+		Log("ReloadConfiguration::Warning::Batching wasn't enabled at startup, batch_max_count and flush_interval take effect after a restart")
+		return nil
+	}
+	maxCount, maxAge, _ := getSenderBatchSettings(config)
+	ContainerLogSender.SetBatchSettings(maxCount, maxAge)
+	Log("ReloadConfiguration::Info::Sender batching set to batch_max_count %d, flush_interval %s", maxCount, maxAge)
+	return nil
+}
+
+// checkRecordFilter rejects a config whose record_filter doesn't parse
+func checkRecordFilter(config map[string]string) error {
+	if recordFilter := strings.TrimSpace(config["record_filter"]); recordFilter != "" {
+		if _, err := ParseRecordFilter(recordFilter); err != nil {
+			return fmt.Errorf("record_filter: %w", err)
+		}
+	}
+	return nil
+}
+
+// recreateHTTPClientOnReload recreates the HTTP client from a reloaded config
+func recreateHTTPClientOnReload(previous map[string]string, config map[string]string) error {
+	// ProxyEndpoint isn't read from the config by the client, re-read it for a changed proxy_url or proxy file path
+	reloadProxyEndpoint()
+	return RecreateHTTPClient()
+}
+
+// applyRecordFilter applies the record_filter of a reloaded config to ContainerLogSender
+func applyRecordFilter(previous map[string]string, config map[string]string) error {
+	if ContainerLogSender == nil {
+		Log("ReloadConfiguration::Warning::Batching wasn't enabled at startup, record_filter takes effect after a restart")
+		return nil
+	}
+	return ContainerLogSender.SetRecordFilter(config["record_filter"])
+}
+
+// applyContainerInventoryRefreshInterval hands the container_inventory_refresh_interval of a reloaded config over to
+// updateContainerImageNameMaps, replacing an interval it didn't pick up yet
+func applyContainerInventoryRefreshInterval(previous map[string]string, config map[string]string) error {
+	interval := getContainerInventoryRefreshInterval(config)
+	select {
+	case <-containerInventoryRefreshIntervalUpdates:
+	default:
+	}
+	containerInventoryRefreshIntervalUpdates <- interval
+	Log("ReloadConfiguration::Info::Container inventory refreshed every %s", interval)
+	return nil
+}
+
+// changedConfigKeys returns the keys added, removed or changed between two configs, sorted
+func changedConfigKeys(previous map[string]string, current map[string]string) []string {
+	changed := []string{}
+	for key, value := range current {
+		if old, ok := previous[key]; !ok || old != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// StartConfigReloadOnSignal reloads the plugin config at path every time the process gets SIGHUP. Failed reloads
+// are logged and reported, the plugin keeps running with its last good config
+func StartConfigReloadOnSignal(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			Log("ReloadConfiguration::Info::Got SIGHUP, reloading %s", path)
+			reloadConfigurationAndReport(path)
+		}
+	}()
+}
+
+// reloadConfigurationAndReport reloads the plugin config at path, logging and reporting a failed reload
+func reloadConfigurationAndReport(path string) {
+	if err := ReloadConfiguration(path); err != nil {
+		message := fmt.Sprintf("ReloadConfiguration::Error::%s", err.Error())
+		Log(message)
+		SendException(message)
+	}
+}
+
+// configFileWatcher notices changes of the plugin config file and of the mounted ConfigMaps it is generated from
+// (config_watch_paths), by comparing their size and modification time on every check. Kubelet updates a mounted
+// ConfigMap by swapping the ..data symlink of its directory, which changes the modification time of the directory
+type configFileWatcher struct {
+	path   string
+	files  []string
+	stamps fileStamps
+	// reload installs the config at path, reloadConfigurationAndReport unless replaced (tests)
+	reload func(path string)
+}
+
+// newConfigFileWatcher watches the plugin config at path and the comma separated config_watch_paths of config
+func newConfigFileWatcher(path string, config map[string]string) *configFileWatcher {
+	w := &configFileWatcher{path: path, files: []string{path}, stamps: fileStamps{}, reload: reloadConfigurationAndReport}
+	for _, watchPath := range strings.Split(config["config_watch_paths"], ",") {
+		if watchPath = strings.TrimSpace(watchPath); watchPath != "" {
+			w.files = append(w.files, watchPath)
+		}
+	}
+	w.stamps.changed(w.files)
+	return w
+}
+
+// check reloads the plugin config if a watched file changed. A config caught half written is rejected and the last
+// good one kept, the reload is retried once the file changes again
+func (w *configFileWatcher) check() {
+	changed := w.stamps.changed(w.files)
+	if len(changed) == 0 {
+		return
+	}
+	Log("ReloadConfiguration::Info::%s changed, reloading %s", strings.Join(changed, ", "), w.path)
+	w.reload(w.path)
+}
+
+// StartConfigWatcher checks the plugin config at path and the config_watch_paths every config_watch_interval seconds
+// (defaulting to defaultConfigWatchIntervalSeconds, 0 disables the watch), reloading the config when they change so
+// edits are applied without restarting the agent. The watched paths are those of the config at startup
+func StartConfigWatcher(path string, config map[string]string) {
+	interval := getTimeoutFromConfig(config, "config_watch_interval", defaultConfigWatchIntervalSeconds)
+	if interval == 0 {
+		Log("Config watcher disabled")
+		return
+	}
+	watcher := newConfigFileWatcher(path, config)
+	Log("Watching %s for config changes every %s", strings.Join(watcher.files, ", "), interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			watcher.check()
+		}
+	}()
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ReloadConfiguration(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	dir := t.TempDir()
+	IsWindows = true
+	defer func() { IsWindows = false }()
+	defer func() { PluginConfiguration = nil }()
+
+	writeFile := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	originalCert, originalKey := generateTestCertificate(t, "original")
+	rotatedCert, rotatedKey := generateTestCertificate(t, "rotated")
+	writeFile("original.crt", originalCert)
+	writeFile("original.key", originalKey)
+	writeFile("rotated.crt", rotatedCert)
+	writeFile("rotated.key", rotatedKey)
+
+	PluginConfiguration = map[string]string{
+		"cert_file_path": filepath.Join(dir, "original.crt"),
+		"key_file_path":  filepath.Join(dir, "original.key"),
+		"flush_interval": "5",
+	}
+	CreateHTTPClient()
+	sender, _ := newTestSender(0, 5*time.Second)
+	ContainerLogSender = sender
+	defer func() { ContainerLogSender = nil }()
+
+	// a valid config is installed and the client recreated with the new cert
+	configPath := writeFile("out_oms.conf", []byte("cert_file_path="+filepath.Join(dir, "rotated.crt")+"\n"+
+		"key_file_path="+filepath.Join(dir, "rotated.key")+"\n"+
+		"flush_interval=10\n"))
+	if err := ReloadConfiguration(configPath); err != nil {
+		t.Fatalf("ReloadConfiguration() error = %v", err)
+	}
+	want := map[string]string{
+		"cert_file_path": filepath.Join(dir, "rotated.crt"),
+		"key_file_path":  filepath.Join(dir, "rotated.key"),
+		"flush_interval": "10",
+	}
+	if !reflect.DeepEqual(PluginConfiguration, want) {
+		t.Errorf("PluginConfiguration after reload = %v, want %v", PluginConfiguration, want)
+	}
+	if name := currentClientCertCommonName(t); name != "rotated" {
+		t.Errorf("client cert after reload = %s, want rotated", name)
+	}
+	if sender.maxAge != 10*time.Second {
+		t.Errorf("sender flush interval after reload = %s, want 10s", sender.maxAge)
+	}
+
+	// an invalid config is rejected and the last good one kept
+	writeFile("out_oms.conf", []byte("flush_interval=1\n"))
+	if err := ReloadConfiguration(configPath); err == nil {
+		t.Errorf("ReloadConfiguration() of a config without cert_file_path succeeded, want error")
+	}
+	if !reflect.DeepEqual(PluginConfiguration, want) {
+		t.Errorf("PluginConfiguration after rejected reload = %v, want %v", PluginConfiguration, want)
+	}
+
+	// as is the current one when the file can't be read
+	if err := ReloadConfiguration(filepath.Join(dir, "missing.conf")); err == nil {
+		t.Errorf("ReloadConfiguration() of a missing file succeeded, want error")
+	}
+	if !reflect.DeepEqual(PluginConfiguration, want) {
+		t.Errorf("PluginConfiguration after failed read = %v, want %v", PluginConfiguration, want)
+	}
+	if name := currentClientCertCommonName(t); name != "rotated" {
+		t.Errorf("client cert after rejected reloads = %s, want rotated", name)
+	}
+}
+
+func Test_changedConfigKeys(t *testing.T) {
+	previous := map[string]string{"a": "1", "b": "2", "c": "3"}
+	current := map[string]string{"a": "1", "b": "20", "d": "4"}
+	if got, want := changedConfigKeys(previous, current), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changedConfigKeys() = %v, want %v", got, want)
+	}
+}
+
+func Test_SetPluginConfiguration(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	dir := t.TempDir()
+	IsWindows = true
+	defer func() { IsWindows = false }()
+	defer func() {
+		PluginConfiguration = nil
+		logLevel = logLevelInfo
+	}()
+	for _, name := range []string{"original", "pushed"} {
+		certPEM, keyPEM := generateTestCertificate(t, name)
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	PluginConfiguration = map[string]string{
+		"cert_file_path": filepath.Join(dir, "original.crt"),
+		"key_file_path":  filepath.Join(dir, "original.key"),
+	}
+	CreateHTTPClient()
+	sender, _ := newTestSender(0, 5*time.Second)
+	ContainerLogSender = sender
+	defer func() { ContainerLogSender = nil }()
+
+	config := map[string]string{
+		"cert_file_path":  filepath.Join(dir, "pushed.crt"),
+		"key_file_path":   filepath.Join(dir, "pushed.key"),
+		"batch_max_count": "50",
+		"flush_interval":  "2",
+		"log_level":       "error",
+	}
+	if err := SetPluginConfiguration(config); err != nil {
+		t.Fatalf("SetPluginConfiguration() error = %v", err)
+	}
+	// the host keeps its map, later changes to it aren't installed
+	config["flush_interval"] = "60"
+	if PluginConfiguration["flush_interval"] != "2" || PluginConfiguration["batch_max_count"] != "50" {
+		t.Errorf("PluginConfiguration = %v, want the config as it was set", PluginConfiguration)
+	}
+	if name := currentClientCertCommonName(t); name != "pushed" {
+		t.Errorf("client cert = %s, want pushed", name)
+	}
+	if sender.maxCount != 50 || sender.maxAge != 2*time.Second {
+		t.Errorf("sender batching = %d records / %s, want 50 / 2s", sender.maxCount, sender.maxAge)
+	}
+	if certFilePath, _ := getCertKeyFilePaths(); certFilePath != filepath.Join(dir, "pushed.crt") {
+		t.Errorf("getCertKeyFilePaths() = %s, want the pushed cert", certFilePath)
+	}
+	if logLevel != logLevelError {
+		t.Errorf("log level = %d, want error", logLevel)
+	}
+
+	// an invalid config is rejected and the installed one kept
+	if err := SetPluginConfiguration(map[string]string{"flush_interval": "1"}); err == nil {
+		t.Errorf("SetPluginConfiguration() of a config without cert_file_path succeeded, want error")
+	}
+	if PluginConfiguration["cert_file_path"] != filepath.Join(dir, "pushed.crt") {
+		t.Errorf("PluginConfiguration after the rejected config = %v, want the last good one", PluginConfiguration)
+	}
+}
+
+func Test_SubscribeConfig(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	telemetry := injectTelemetryClient(t)
+	originalSubscriptions := configSubscriptions
+	configSubscriptions = nil
+	defer func() { configSubscriptions = originalSubscriptions }()
+	base := map[string]string{"cert_file_path": "/etc/oms.crt", "key_file_path": "/etc/oms.key"}
+	PluginConfiguration = base
+	defer func() { PluginConfiguration = nil }()
+
+	var calls []string
+	SubscribeConfig("interval", []string{"interval"}, func(config map[string]string) error {
+		if config["interval"] == "bad" {
+			return errors.New("not an interval")
+		}
+		return nil
+	}, func(previous map[string]string, current map[string]string) error {
+		calls = append(calls, "interval "+previous["interval"]+"->"+current["interval"])
+		return nil
+	})
+	SubscribeConfig("endpoint", []string{"endpoint"}, nil, func(previous map[string]string, current map[string]string) error {
+		calls = append(calls, "endpoint")
+		return errors.New("unreachable")
+	})
+	SubscribeConfig("everything", nil, nil, func(previous map[string]string, current map[string]string) error {
+		calls = append(calls, "everything")
+		return nil
+	})
+	withKeys := func(keys map[string]string) map[string]string {
+		config := map[string]string{}
+		for key, value := range base {
+			config[key] = value
+		}
+		for key, value := range keys {
+			config[key] = value
+		}
+		return config
+	}
+
+	if err := SetPluginConfiguration(withKeys(map[string]string{"interval": "10"})); err != nil {
+		t.Fatalf("SetPluginConfiguration() error = %v", err)
+	}
+	if got := fmt.Sprint(calls); got != "[interval ->10 everything]" {
+		t.Errorf("subscribers called = %s, want the interval and catch-all subscribers", got)
+	}
+
+	// a failing check rejects the whole config, none of the subscribers sees it
+	calls = nil
+	if err := SetPluginConfiguration(withKeys(map[string]string{"interval": "bad", "endpoint": "b"})); err == nil {
+		t.Errorf("SetPluginConfiguration() of a config failing a check succeeded, want error")
+	}
+	if len(calls) != 0 || PluginConfiguration["interval"] != "10" || PluginConfiguration["endpoint"] != "" {
+		t.Errorf("after a rejected config subscribers called = %v and PluginConfiguration = %v, want the last good config", calls, PluginConfiguration)
+	}
+
+	// a failing subscriber is reported, the others still apply the installed config
+	calls = nil
+	err := SetPluginConfiguration(withKeys(map[string]string{"interval": "20", "endpoint": "b"}))
+	if err == nil || !strings.Contains(err.Error(), "endpoint failed to apply it") {
+		t.Errorf("SetPluginConfiguration() error = %v, want the failure of the endpoint subscriber", err)
+	}
+	if got := fmt.Sprint(calls); got != "[interval 10->20 endpoint everything]" {
+		t.Errorf("subscribers called = %s, want all of them", got)
+	}
+	if PluginConfiguration["endpoint"] != "b" || len(telemetry.exceptions) != 1 {
+		t.Errorf("PluginConfiguration = %v with %d exceptions, want the config installed and the failure reported", PluginConfiguration, len(telemetry.exceptions))
+	}
+
+	// an unchanged config notifies nobody
+	calls = nil
+	if err := SetPluginConfiguration(withKeys(map[string]string{"interval": "20", "endpoint": "b"})); err != nil || len(calls) != 0 {
+		t.Errorf("SetPluginConfiguration() of the same config = %v calling %v, want no subscriber called", err, calls)
+	}
+}
+
+func Test_ReloadConfiguration_ProxyURL(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	dir := t.TempDir()
+	IsWindows = true
+	defer func() { IsWindows = false }()
+	defer func() { PluginConfiguration = nil }()
+	defer func() { ProxyEndpoint = "" }()
+	cert, key := generateTestCertificate(t, "proxied")
+	certFilePath, keyFilePath := filepath.Join(dir, "oms.crt"), filepath.Join(dir, "oms.key")
+	if err := ioutil.WriteFile(certFilePath, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFilePath, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	install := func(proxyURL string) {
+		config := map[string]string{"cert_file_path": certFilePath, "key_file_path": keyFilePath, "proxy_url": proxyURL}
+		if err := SetPluginConfiguration(config); err != nil {
+			t.Fatalf("SetPluginConfiguration() error = %v", err)
+		}
+	}
+	proxyHost := func() string {
+		transport := GetClient().Transport.(*http.Transport)
+		if transport.Proxy == nil {
+			return ""
+		}
+		req, _ := http.NewRequest("POST", "https://workspace.ods.opinsights.azure.com/OperationalData.svc/PostJsonDataItems", nil)
+		proxyURL, err := transport.Proxy(req)
+		if err != nil || proxyURL == nil {
+			return ""
+		}
+		return proxyURL.Host
+	}
+
+	install("http://old-proxy:8080")
+	if got := proxyHost(); got != "old-proxy:8080" {
+		t.Fatalf("proxy = %q, want old-proxy:8080", got)
+	}
+	// changing the inline proxy on reload rebuilds the client with it
+	install("http://new-proxy:3128")
+	if got := proxyHost(); got != "new-proxy:3128" {
+		t.Errorf("proxy after reload = %q, want new-proxy:3128", got)
+	}
+}
+
+func Test_ReloadConfiguration_RecordFilter(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	IsWindows = true
+	defer func() { IsWindows = false }()
+	base := map[string]string{"cert_file_path": "/etc/oms.crt", "key_file_path": "/etc/oms.key", "batch_max_count": "1"}
+	PluginConfiguration = base
+	defer func() { PluginConfiguration = nil }()
+	sender, recorder := newTestSender(1, 0)
+	sender.AddTransform(sender.filterRecord)
+	ContainerLogSender = sender
+	defer func() { ContainerLogSender = nil }()
+
+	install := func(recordFilter string) error {
+		config := map[string]string{"record_filter": recordFilter}
+		for key, value := range base {
+			config[key] = value
+		}
+		return SetPluginConfiguration(config)
+	}
+	enqueueBoth := func() {
+		sender.Enqueue([]byte(`{"PodNamespace":"default"}`))
+		sender.Enqueue([]byte(`{"PodNamespace":"kube-system"}`))
+	}
+
+	if err := install("deny PodNamespace=kube-system"); err != nil {
+		t.Fatalf("SetPluginConfiguration() error = %v", err)
+	}
+	enqueueBoth()
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[1]" {
+		t.Errorf("batches with the kube-system records denied = %s, want [1]", got)
+	}
+
+	// a malformed filter is rejected, the current rules keep applying
+	if err := install("deny PodNamespace"); err == nil {
+		t.Errorf("SetPluginConfiguration() of a malformed record_filter succeeded, want error")
+	}
+	if PluginConfiguration["record_filter"] != "deny PodNamespace=kube-system" {
+		t.Errorf("record_filter after a rejected reload = %q, want the last good one", PluginConfiguration["record_filter"])
+	}
+	enqueueBoth()
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[1 1]" {
+		t.Errorf("batches after the rejected reload = %s, want [1 1]", got)
+	}
+
+	// removing the filter lets every record through
+	if err := install(""); err != nil {
+		t.Fatalf("SetPluginConfiguration() error = %v", err)
+	}
+	enqueueBoth()
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[1 1 1 1]" {
+		t.Errorf("batches without a filter = %s, want [1 1 1 1]", got)
+	}
+}
+
+func Test_configFileWatcher(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "out_oms.conf")
+	configMapDir := filepath.Join(dir, "settings")
+	if err := os.Mkdir(configMapDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configPath, []byte("flush_interval=5\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// in the past, so the changes below are noticed within the timestamp granularity of the filesystem
+	past := time.Now().Add(-time.Hour)
+	for _, path := range []string{configPath, configMapDir} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	watcher := newConfigFileWatcher(configPath, map[string]string{"config_watch_paths": " " + configMapDir + " ,"})
+	var reloads []string
+	watcher.reload = func(path string) { reloads = append(reloads, path) }
+	watcher.check()
+	if len(reloads) != 0 {
+		t.Errorf("reloaded %v without a change, want no reload", reloads)
+	}
+
+	writeWatchedFile(t, configPath, []byte("flush_interval=10\n"))
+	watcher.check()
+	watcher.check()
+	if got := fmt.Sprint(reloads); got != "["+configPath+"]" {
+		t.Errorf("reloads after editing the config = %s, want one of %s", got, configPath)
+	}
+
+	// kubelet swaps the ..data symlink of the ConfigMap directory on update
+	if err := os.Symlink(dir, filepath.Join(configMapDir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	watcher.check()
+	if len(reloads) != 2 || reloads[1] != configPath {
+		t.Errorf("reloads after updating the ConfigMap = %v, want the config reloaded again", reloads)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ConfigIssue is a problem with one key of the plugin config
+type ConfigIssue struct {
+	Key     string
+	Message string
+}
+
+func (i ConfigIssue) String() string {
+	return fmt.Sprintf("%s: %s", i.Key, i.Message)
+}
+
+// ConfigValidationResult lists what ValidateConfig found. Errors prevent the plugin from starting, Warnings are
+// logged for the operator
+type ConfigValidationResult struct {
+	Errors   []ConfigIssue
+	Warnings []ConfigIssue
+}
+
+// HasErrors reports whether the config can't be used
+func (r ConfigValidationResult) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// deprecatedConfigKeys maps deprecated keys of the plugin config to the key replacing them
+var deprecatedConfigKeys = map[string]string{
+	"omsproxy_conf_path": "omsproxy_secret_path",
+}
+
+// configKeyRange is the recommended range of an integer key of the plugin config
+type configKeyRange struct {
+	key      string
+	min, max int
+	// zero is allowed outside of the range, when it disables the feature
+	zeroDisables bool
+}
+
+var recommendedConfigRanges = []configKeyRange{
+	{key: "container_inventory_refresh_interval", min: 10, max: 3600},
+	{key: "connect_timeout", min: 5, max: 120},
+	{key: "response_header_timeout", min: 5, max: 120},
+	{key: "overall_timeout", min: 5, max: 300},
+	{key: "connectivity_heartbeat_interval", min: 60, max: 86400, zeroDisables: true},
+	{key: "circuit_breaker_failure_threshold", min: 3, max: 100, zeroDisables: true},
+	{key: "gzip_min_bytes", min: 256, max: 1024 * 1024, zeroDisables: true},
+	{key: "gzip_level", min: 1, max: 9},
+	{key: "config_watch_interval", min: 5, max: 3600, zeroDisables: true},
+}
+
+// ValidateConfig checks the plugin config for missing required keys, invalid values, deprecated keys and values
+// outside of their recommended range
+func ValidateConfig(config map[string]string) ConfigValidationResult {
+	result := ConfigValidationResult{}
+
+	// the cert is only used for mutual TLS, AAD MSI auth mode uses an ingestion token instead
+	if !isAADMSIAuthModeConfigured(config) {
+		for _, key := range []string{"cert_file_path", "key_file_path"} {
+			if strings.TrimSpace(config[key]) == "" {
+				result.Errors = append(result.Errors, ConfigIssue{Key: key, Message: "required key is missing"})
+			}
+		}
+	}
+
+	RangeConfigSorted(deprecatedConfigKeys, func(key string, replacement string) bool {
+		if _, ok := config[key]; !ok {
+			return true
+		}
+		message := fmt.Sprintf("deprecated, use %s instead", replacement)
+		if _, ok := config[replacement]; ok {
+			message = fmt.Sprintf("deprecated and ignored as %s is also set", replacement)
+		}
+		result.Warnings = append(result.Warnings, ConfigIssue{Key: key, Message: message})
+		return true
+	})
+
+	for _, r := range recommendedConfigRanges {
+		value, ok := config[r.key]
+		if !ok {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			result.Warnings = append(result.Warnings, ConfigIssue{Key: r.key, Message: fmt.Sprintf("%q is not an integer, the default is used", value)})
+			continue
+		}
+		if (number < r.min || number > r.max) && !(number == 0 && r.zeroDisables) {
+			result.Warnings = append(result.Warnings, ConfigIssue{Key: r.key, Message: fmt.Sprintf("%d is outside of the recommended range %d-%d", number, r.min, r.max)})
+		}
+	}
+
+	if value := strings.TrimSpace(config["proxy_url"]); value != "" {
+		if _, err := parseProxyEndpoint(value); err != nil {
+			result.Errors = append(result.Errors, ConfigIssue{Key: "proxy_url", Message: fmt.Sprintf("invalid proxy url: %s", err.Error())})
+		}
+	}
+
+	if value := strings.TrimSpace(config["host_overrides"]); value != "" {
+		if _, err := parseHostOverrides(value); err != nil {
+			result.Errors = append(result.Errors, ConfigIssue{Key: "host_overrides", Message: err.Error()})
+		}
+	}
+
+	if value := config["insecure_skip_verify"]; value != "" {
+		if enabled, ok := parseBool(value); !ok {
+			result.Warnings = append(result.Warnings, ConfigIssue{Key: "insecure_skip_verify", Message: fmt.Sprintf("%q is not a boolean, the default is used", value)})
+		} else if enabled {
+			result.Warnings = append(result.Warnings, ConfigIssue{Key: "insecure_skip_verify", Message: "TLS certificate verification is disabled"})
+		}
+	}
+	return result
+}
+
+// applyDeprecatedConfigKeys copies the values of deprecated keys to the keys replacing them, unless those are set
+func applyDeprecatedConfigKeys(config map[string]string) {
+	RangeConfigSorted(deprecatedConfigKeys, func(key string, replacement string) bool {
+		if value, ok := config[key]; ok {
+			if _, ok := config[replacement]; !ok {
+				config[replacement] = value
+			}
+		}
+		return true
+	})
+}
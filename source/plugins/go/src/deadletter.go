@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default location of the deadletter file, can be overridden with deadletter_file_path in the plugin config
+const defaultLinuxDeadletterFilePath = "/var/opt/microsoft/docker-cimprov/state/fluent-bit-out-oms-deadletter.jsonl"
+const defaultWindowsDeadletterFilePath = "/etc/omsagentwindows/fluent-bit-out-oms-deadletter.jsonl"
+
+// default size of the deadletter file, the oldest entries are dropped beyond it (deadletter_max_bytes in the plugin config)
+const defaultDeadletterMaxBytes = 100 * 1024 * 1024
+
+// ErrDeadletterEntryTooLarge is returned when an entry is larger than deadletter_max_bytes by itself
+var ErrDeadletterEntryTooLarge = errors.New("deadletter entry exceeds deadletter_max_bytes")
+
+// DeadletterEntry is one line of the deadletter file
+type DeadletterEntry struct {
+	Time     string `json:"Time"`
+	DataType string `json:"DataType"`
+	Reason   string `json:"Reason"`
+	Record   string `json:"Record"`
+}
+
+// Deadletter appends records that can't be delivered to OMSEndpoint to a json lines file, so they are kept for
+// inspection instead of being dropped silently. When maxBytes is set the oldest entries are dropped to keep the file
+// under it
+type Deadletter struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+}
+
+var (
+	// deadlettersMutex guards deadletters
+	deadlettersMutex = &sync.Mutex{}
+	// deadletters are the deadletters created by NewDeadletter, by path
+	deadletters = map[string]*Deadletter{}
+)
+
+// NewDeadletter returns the deadletter writing to the given file. Every call for the same path returns the same
+// deadletter, so the senders writing to it and ReplayDeadletter keeping undelivered entries don't interleave writes
+func NewDeadletter(path string) *Deadletter {
+	deadlettersMutex.Lock()
+	defer deadlettersMutex.Unlock()
+	if d, ok := deadletters[path]; ok {
+		return d
+	}
+	d := &Deadletter{path: path}
+	deadletters[path] = d
+	return d
+}
+
+// getDeadletter returns the deadletter of deadletter_file_path in the plugin config, capped to deadletter_max_bytes
+func getDeadletter(config map[string]string) *Deadletter {
+	d := NewDeadletter(getDeadletterFilePath(config))
+	maxBytes := getDeadletterMaxBytes(config)
+	d.mutex.Lock()
+	d.maxBytes = maxBytes
+	d.mutex.Unlock()
+	return d
+}
+
+// getDeadletterMaxBytes reads deadletter_max_bytes from the plugin config, 0 for no limit
+func getDeadletterMaxBytes(config map[string]string) int64 {
+	value := config["deadletter_max_bytes"]
+	if value == "" {
+		return defaultDeadletterMaxBytes
+	}
+	maxBytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || maxBytes < 0 {
+		Log("Invalid value %s for deadletter_max_bytes. Using default of %d", value, defaultDeadletterMaxBytes)
+		return defaultDeadletterMaxBytes
+	}
+	return maxBytes
+}
+
+// getDeadletterFilePath returns deadletter_file_path from the plugin config or the default for the OS
+func getDeadletterFilePath(config map[string]string) string {
+	if path := strings.TrimSpace(config["deadletter_file_path"]); path != "" {
+		return path
+	}
+	if strings.Compare(strings.ToLower(os.Getenv("OS_TYPE")), "windows") == 0 {
+		return defaultWindowsDeadletterFilePath
+	}
+	return defaultLinuxDeadletterFilePath
+}
+
+// Write appends the record with the reason it couldn't be delivered
+func (d *Deadletter) Write(dataType string, record []byte, reason string) error {
+	if d == nil {
+		Log("Deadletter::Error::No deadletter configured, dropping %s record: %s", dataType, reason)
+		return nil
+	}
+	line, err := json.Marshal(DeadletterEntry{
+		Time:     time.Now().Format(time.RFC3339),
+		DataType: dataType,
+		Reason:   reason,
+		Record:   string(record),
+	})
+	if err != nil {
+		return fmt.Errorf("Deadletter: %w", err)
+	}
+
+	if err := d.appendLine(line); err != nil {
+		message := fmt.Sprintf("Deadletter::Error::Unable to write to deadletter file %s, dropping %s record: %s", d.path, dataType, err.Error())
+		Log(message)
+		SendException(message)
+		return fmt.Errorf("Deadletter: %w", err)
+	}
+	return nil
+}
+
+// DeadletterReplayResult summarizes a ReplayDeadletter run
+type DeadletterReplayResult struct {
+	// Replayed entries confirmed delivered and removed from the deadletter
+	Replayed int
+	// Failed entries that couldn't be delivered and were kept in the deadletter
+	Failed int
+	// Malformed entries that couldn't be parsed and were kept in the deadletter
+	Malformed int
+}
+
+// DeadletterPost delivers records of dataType replayed from a deadletter
+type DeadletterPost func(ctx context.Context, dataType string, records [][]byte) error
+
+// ReplayDeadletter replays the deadletter file at path to OMSEndpoint, see Deadletter.Replay
+func ReplayDeadletter(ctx context.Context, path string) (DeadletterReplayResult, error) {
+	return NewDeadletter(path).Replay(ctx, PostRecordsToODS)
+}
+
+// Replay posts every entry of the deadletter file back with post, the normal posting path (with retries) of the
+// sender the deadletter belongs to, removing entries only once their delivery is confirmed. Entries that fail again or can't be parsed are
+// appended back to the deadletter (malformed ones are logged).
+// The file is moved aside to path.replaying while replaying, so records deadlettered meanwhile aren't lost, and the
+// progress is checkpointed to path.replaying.offset: if the replay is interrupted (context cancelled, process exit,
+// an entry that can't be kept) the next call resumes from the checkpoint. An entry delivered right before an
+// interruption may be posted twice
+func (d *Deadletter) Replay(ctx context.Context, post DeadletterPost) (DeadletterReplayResult, error) {
+	result := DeadletterReplayResult{}
+	path := d.path
+	replayingPath := path + ".replaying"
+	offsetPath := replayingPath + ".offset"
+
+	if _, err := os.Stat(replayingPath); os.IsNotExist(err) {
+		if err := os.Rename(path, replayingPath); err != nil {
+			if os.IsNotExist(err) {
+				return result, nil
+			}
+			return result, fmt.Errorf("ReplayDeadletter: %w", err)
+		}
+		os.Remove(offsetPath)
+	} else {
+		Log("ReplayDeadletter::Info::Resuming interrupted replay of %s", replayingPath)
+	}
+
+	var offset int64
+	if content, err := ioutil.ReadFile(offsetPath); err == nil {
+		offset, _ = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	}
+
+	file, err := os.Open(replayingPath)
+	if err != nil {
+		return result, fmt.Errorf("ReplayDeadletter: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return result, fmt.Errorf("ReplayDeadletter: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, fmt.Errorf("ReplayDeadletter: interrupted at offset %d: %w", offset, err)
+		}
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var entry DeadletterEntry
+			if trimmed := bytes.TrimSpace(line); len(trimmed) == 0 {
+				// blank line, nothing to replay
+			} else if err := json.Unmarshal(trimmed, &entry); err != nil || entry.DataType == "" || entry.Record == "" {
+				Log("ReplayDeadletter::Warning::Skipping malformed deadletter entry at offset %d", offset)
+				if err := d.keep(trimmed, offset); err != nil {
+					return result, err
+				}
+				result.Malformed++
+			} else if err := post(ctx, entry.DataType, [][]byte{[]byte(entry.Record)}); err != nil {
+				if ctx.Err() != nil {
+					// not processed, so the checkpoint isn't moved past this entry
+					return result, fmt.Errorf("ReplayDeadletter: interrupted at offset %d: %w", offset, ctx.Err())
+				}
+				Log("ReplayDeadletter::Error::Failed to replay %s record, keeping it: %s", entry.DataType, err.Error())
+				if err := d.keep(trimmed, offset); err != nil {
+					return result, err
+				}
+				result.Failed++
+			} else {
+				result.Replayed++
+			}
+			offset += int64(len(line))
+			if err := ioutil.WriteFile(offsetPath, []byte(strconv.FormatInt(offset, 10)), 0600); err != nil {
+				Log("ReplayDeadletter::Error::Unable to checkpoint replay progress: %s", err.Error())
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return result, fmt.Errorf("ReplayDeadletter: %w", readErr)
+		}
+	}
+
+	file.Close()
+	os.Remove(replayingPath)
+	os.Remove(offsetPath)
+	Log("ReplayDeadletter::Info::Replayed %d records from %s, kept %d failed and %d malformed entries", result.Replayed, path, result.Failed, result.Malformed)
+	return result, nil
+}
+
+// keep appends an entry that wasn't delivered back to the deadletter. If that fails the replay stops with the
+// checkpoint before the entry, so it is processed again by the next replay. An entry over deadletter_max_bytes is
+// dropped instead
+func (d *Deadletter) keep(line []byte, offset int64) error {
+	err := d.appendLine(line)
+	if errors.Is(err, ErrDeadletterEntryTooLarge) {
+		Log("ReplayDeadletter::Warning::Dropping the entry at offset %d: %s", offset, err.Error())
+		return nil
+	}
+	if err != nil {
+		message := fmt.Sprintf("ReplayDeadletter::Error::Unable to keep the entry at offset %d in %s, stopping the replay: %s", offset, d.path, err.Error())
+		Log(message)
+		SendException(message)
+		return fmt.Errorf("ReplayDeadletter: keeping the entry at offset %d: %w", offset, err)
+	}
+	return nil
+}
+
+// appendLine appends an already encoded entry to the deadletter file, dropping the oldest entries first if it would
+// grow over maxBytes
+func (d *Deadletter) appendLine(line []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.maxBytes > 0 {
+		if err := d.makeRoomLocked(int64(len(line)) + 1); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// makeRoomLocked drops the oldest entries of the deadletter file, counting them as dropped, if writing size more
+// bytes would take it over maxBytes. A tenth of maxBytes is freed on top, so a full deadletter isn't rewritten on
+// every write. d.mutex must be held
+func (d *Deadletter) makeRoomLocked(size int64) error {
+	if size > d.maxBytes {
+		d.countDropped(1)
+		return fmt.Errorf("%w: entry of %d bytes, deadletter_max_bytes %d", ErrDeadletterEntryTooLarge, size, d.maxBytes)
+	}
+	info, err := os.Stat(d.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size()+size <= d.maxBytes {
+		return nil
+	}
+	content, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	keep := d.maxBytes - d.maxBytes/10 - size
+	dropped := 0
+	for len(content) > 0 && int64(len(content)) > keep {
+		end := bytes.IndexByte(content, '\n')
+		if end < 0 {
+			end = len(content) - 1
+		}
+		if len(bytes.TrimSpace(content[:end+1])) > 0 {
+			dropped++
+		}
+		content = content[end+1:]
+	}
+	tmpPath := d.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	Log("Deadletter::Warning::deadletter_max_bytes %d reached, dropped the %d oldest entries of %s", d.maxBytes, dropped, d.path)
+	d.countDropped(dropped)
+	return nil
+}
+
+// countDropped accounts deadlettered records dropped for deadletter_max_bytes in telemetry
+func (d *Deadletter) countDropped(records int) {
+	ContainerLogTelemetryMutex.Lock()
+	ContainerLogsDeadletterDroppedRecordCount += float64(records)
+	ContainerLogTelemetryMutex.Unlock()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newReplayTestServer accepts posted records, rejecting those containing "reject" with a non-retriable status
+func newReplayTestServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mutex sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			DataItems []json.RawMessage
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("server got malformed payload %s", body)
+		}
+		for _, item := range payload.DataItems {
+			if strings.Contains(string(item), "reject") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		mutex.Lock()
+		for _, item := range payload.DataItems {
+			received = append(received, string(item))
+		}
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	t.Cleanup(func() {
+		OMSEndpoint = originalEndpoint
+		server.Close()
+	})
+	return server, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), received...)
+	}
+}
+
+func deadletterLine(t *testing.T, record string) string {
+	line, err := json.Marshal(DeadletterEntry{DataType: ContainerLogV2DataType, Reason: "test", Record: record})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line) + "\n"
+}
+
+func Test_ReplayDeadletter(t *testing.T) {
+	_, received := newReplayTestServer(t)
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	malformed := `{"DataType":"CONTAINERINVENTORY_BLOB","Record":`
+	content := deadletterLine(t, `{"LogMessage":"first"}`) +
+		malformed + "\n" +
+		deadletterLine(t, `{"LogMessage":"reject me"}`) +
+		"\n" +
+		deadletterLine(t, `{"LogMessage":"second"}`)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReplayDeadletter(context.Background(), path)
+	if err != nil {
+		t.Fatalf("ReplayDeadletter() error = %v", err)
+	}
+	want := DeadletterReplayResult{Replayed: 2, Failed: 1, Malformed: 1}
+	if result != want {
+		t.Errorf("ReplayDeadletter() = %+v, want %+v", result, want)
+	}
+	if got, want := received(), []string{`{"LogMessage":"first"}`, `{"LogMessage":"second"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+
+	// only the entries that weren't delivered are left
+	remaining, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := malformed + "\n" + deadletterLine(t, `{"LogMessage":"reject me"}`); string(remaining) != want {
+		t.Errorf("deadletter file after replay = %q, want %q", remaining, want)
+	}
+	for _, leftover := range []string{path + ".replaying", path + ".replaying.offset"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after the replay completed", leftover)
+		}
+	}
+
+	// nothing left to deliver, the malformed and failed entries are kept as they are
+	if result, err = ReplayDeadletter(context.Background(), path); err != nil || result.Replayed != 0 {
+		t.Errorf("second ReplayDeadletter() = (%+v, %v), want nothing replayed", result, err)
+	}
+}
+
+func Test_ReplayDeadletter_Resume(t *testing.T) {
+	_, received := newReplayTestServer(t)
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+
+	// a replay interrupted after delivering the first entry, while another record got deadlettered
+	first := deadletterLine(t, `{"LogMessage":"first"}`)
+	if err := ioutil.WriteFile(path+".replaying", []byte(first+deadletterLine(t, `{"LogMessage":"second"}`)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".replaying.offset", []byte(strconv.Itoa(len(first))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(deadletterLine(t, `{"LogMessage":"new"}`)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReplayDeadletter(context.Background(), path)
+	if err != nil || result.Replayed != 1 {
+		t.Fatalf("ReplayDeadletter() = (%+v, %v), want 1 replayed", result, err)
+	}
+	if got, want := received(), []string{`{"LogMessage":"second"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+
+	// the next run picks up what was deadlettered during the interrupted one
+	result, err = ReplayDeadletter(context.Background(), path)
+	if err != nil || result.Replayed != 1 {
+		t.Fatalf("ReplayDeadletter() = (%+v, %v), want 1 replayed", result, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("deadletter file still exists after everything was replayed")
+	}
+}
+
+func Test_ReplayDeadletter_Cancelled(t *testing.T) {
+	newReplayTestServer(t)
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	if err := ioutil.WriteFile(path, []byte(deadletterLine(t, `{"LogMessage":"first"}`)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ReplayDeadletter(ctx, path); err == nil {
+		t.Fatalf("ReplayDeadletter() with a cancelled context succeeded")
+	}
+	// the entry is still pending in the interrupted replay and is delivered by the next run
+	result, err := ReplayDeadletter(context.Background(), path)
+	if err != nil || result.Replayed != 1 {
+		t.Errorf("resumed ReplayDeadletter() = (%+v, %v), want 1 replayed", result, err)
+	}
+}
+
+func Test_ReplayDeadletter_KeepFails(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	_, received := newReplayTestServer(t)
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	content := deadletterLine(t, `{"LogMessage":"first"}`) + deadletterLine(t, `{"LogMessage":"reject me"}`) + deadletterLine(t, `{"LogMessage":"second"}`)
+	if err := ioutil.WriteFile(path+".replaying", []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the rejected entry can't be appended back to a deadletter that is a directory
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ReplayDeadletter(context.Background(), path)
+	if err == nil || result.Replayed != 1 || result.Failed != 0 {
+		t.Fatalf("ReplayDeadletter() = (%+v, %v), want an error after 1 replayed", result, err)
+	}
+	if got, want := received(), []string{`{"LogMessage":"first"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+	// the replay resumes at the entry it couldn't keep
+	if _, err := os.Stat(path + ".replaying"); err != nil {
+		t.Errorf("%s.replaying removed after a failed replay: %v", path, err)
+	}
+	offset, err := ioutil.ReadFile(path + ".replaying.offset")
+	if err != nil || string(offset) != strconv.Itoa(len(deadletterLine(t, `{"LogMessage":"first"}`))) {
+		t.Errorf("replay checkpoint = (%q, %v), want the offset of the rejected entry", offset, err)
+	}
+
+	os.Remove(path)
+	result, err = ReplayDeadletter(context.Background(), path)
+	if err != nil || result.Replayed != 1 || result.Failed != 1 {
+		t.Errorf("resumed ReplayDeadletter() = (%+v, %v), want 1 replayed and 1 failed", result, err)
+	}
+	if remaining, _ := ioutil.ReadFile(path); string(remaining) != deadletterLine(t, `{"LogMessage":"reject me"}`) {
+		t.Errorf("deadletter file after the resumed replay = %q, want the rejected entry", remaining)
+	}
+}
+
+func Test_NewDeadletter_SharedPerPath(t *testing.T) {
+	dir := t.TempDir()
+	if NewDeadletter(filepath.Join(dir, "a.jsonl")) != NewDeadletter(filepath.Join(dir, "a.jsonl")) {
+		t.Errorf("NewDeadletter() returned two deadletters for the same path")
+	}
+	if NewDeadletter(filepath.Join(dir, "a.jsonl")) == NewDeadletter(filepath.Join(dir, "b.jsonl")) {
+		t.Errorf("NewDeadletter() returned the same deadletter for two paths")
+	}
+}
+
+func Test_Deadletter_MaxBytes(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	resetDropped := func() {
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsDeadletterDroppedRecordCount = 0
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	resetDropped()
+	defer resetDropped()
+	path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	line, err := json.Marshal(DeadletterEntry{Time: time.Now().Format(time.RFC3339), DataType: ContainerLogV2DataType, Reason: "test", Record: "record-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineBytes := int64(len(line) + 1)
+	d := getDeadletter(map[string]string{
+		"deadletter_file_path": path,
+		"deadletter_max_bytes": strconv.FormatInt(5*lineBytes, 10),
+	})
+
+	for i := 0; i < 10; i++ {
+		if err := d.Write(ContainerLogV2DataType, []byte("record-"+strconv.Itoa(i)), "test"); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() > 5*lineBytes {
+			t.Fatalf("deadletter file after %d writes = %v (error %v), want at most %d bytes", i+1, info.Size(), err, 5*lineBytes)
+		}
+	}
+	var kept []string
+	for _, entry := range readDeadletterEntries(t, path) {
+		kept = append(kept, entry.Record)
+	}
+	// the first write over the cap drops the oldest entries down to a tenth of it free, the next one once again
+	want := []string{"record-6", "record-7", "record-8", "record-9"}
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("deadletter kept %v, want the newest %v", kept, want)
+	}
+	ContainerLogTelemetryMutex.Lock()
+	dropped := ContainerLogsDeadletterDroppedRecordCount
+	ContainerLogTelemetryMutex.Unlock()
+	if dropped != 6 {
+		t.Errorf("ContainerLogsDeadletterDroppedRecordCount = %v, want the 6 dropped entries", dropped)
+	}
+
+	// an entry larger than the cap by itself isn't written
+	err = d.Write(ContainerLogV2DataType, []byte(strings.Repeat("r", int(5*lineBytes))), "test")
+	if !errors.Is(err, ErrDeadletterEntryTooLarge) {
+		t.Errorf("Write() of an oversized entry error = %v, want ErrDeadletterEntryTooLarge", err)
+	}
+	if got := len(readDeadletterEntries(t, path)); got != 4 {
+		t.Errorf("%d entries after the oversized one, want 4", got)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// diagnosticsPath is where the diagnostics server serves the DiagnosticsReport
+const diagnosticsPath = "/diagnostics"
+
+// redactedValue replaces the values of sensitive config keys in the DiagnosticsReport
+const redactedValue = "REDACTED"
+
+// sensitiveConfigKeyParts mark the config keys whose values are redacted, matched case-insensitively. Keys ending
+// in _path hold the location of a secret and are kept
+var sensitiveConfigKeyParts = []string{"secret", "password", "token", "credential"}
+
+// DiagnosticsReport is the agent state served by the diagnostics server, for support engineers
+type DiagnosticsReport struct {
+	// Config is PluginConfiguration with secrets and proxy credentials redacted
+	Config map[string]string `json:"config"`
+	// ClientCertExpiry is when the cert presented to OMSEndpoint expires (RFC3339), empty if none is presented
+	ClientCertExpiry string `json:"clientCertExpiry"`
+	// LastSuccessfulPost is when ContainerLogSender last delivered a batch (RFC3339), empty if none was yet
+	LastSuccessfulPost string `json:"lastSuccessfulPost"`
+	// QueueDepth is the number of records buffered by ContainerLogSender
+	QueueDepth int `json:"queueDepth"`
+	// OldestRecordAgeMs is how long the oldest buffered record has been waiting
+	OldestRecordAgeMs int64 `json:"oldestRecordAgeMs"`
+	// CircuitState is the state of ODSCircuitBreaker
+	CircuitState string `json:"circuitState"`
+	// LastError is the error of the last failed post of ContainerLogSender, empty if none failed yet
+	LastError string `json:"lastError"`
+}
+
+// StartDiagnosticsServer serves the DiagnosticsReport as JSON on diag_addr (off unless set). A bare port (8080 or
+// :8080) is bound to localhost, a host has to be given explicitly to expose it further
+func StartDiagnosticsServer(config map[string]string) *http.Server {
+	addr := getDiagnosticsAddr(config)
+	if addr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		message := fmt.Sprintf("StartDiagnosticsServer::Error::Unable to listen on %s, diagnostics disabled: %s", addr, err.Error())
+		Log(message)
+		SendException(message)
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(diagnosticsPath, diagnosticsHandler)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	Log("Serving diagnostics on http://%s%s", listener.Addr(), diagnosticsPath)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			Log("StartDiagnosticsServer::Error::Diagnostics server stopped: %s", err.Error())
+		}
+	}()
+	return server
+}
+
+// getDiagnosticsAddr returns the listen address for diag_addr, prefixing localhost to a bare port
+func getDiagnosticsAddr(config map[string]string) string {
+	addr := strings.TrimSpace(config["diag_addr"])
+	if addr == "" {
+		return ""
+	}
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return addr
+}
+
+// diagnosticsHandler serves the current DiagnosticsReport
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(getDiagnosticsReport()); err != nil {
+		Log("diagnosticsHandler::Error::Unable to write the diagnostics report: %s", err.Error())
+	}
+}
+
+// getDiagnosticsReport collects the current agent state
+func getDiagnosticsReport() DiagnosticsReport {
+	PluginConfigurationMutex.Lock()
+	config := PluginConfiguration
+	PluginConfigurationMutex.Unlock()
+
+	report := DiagnosticsReport{
+		Config:       redactConfiguration(config),
+		CircuitState: ODSCircuitState(),
+	}
+	if expiry := clientCertExpiry(GetClient()); !expiry.IsZero() {
+		report.ClientCertExpiry = expiry.UTC().Format(time.RFC3339)
+	}
+	if ContainerLogSender != nil {
+		report.QueueDepth = ContainerLogSender.QueueDepth()
+		report.OldestRecordAgeMs = int64(ContainerLogSender.OldestRecordAge() / time.Millisecond)
+		if lastSuccess := ContainerLogSender.LastSuccessfulPost(); !lastSuccess.IsZero() {
+			report.LastSuccessfulPost = lastSuccess.UTC().Format(time.RFC3339)
+		}
+		if err := ContainerLogSender.LastError(); err != nil {
+			report.LastError = err.Error()
+		}
+	}
+	return report
+}
+
+// clientCertExpiry returns the NotAfter of the cert client presents, the zero time if it presents none
+func clientCertExpiry(client *http.Client) time.Time {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil || len(transport.TLSClientConfig.Certificates) == 0 {
+		return time.Time{}
+	}
+	leaf := transport.TLSClientConfig.Certificates[0].Leaf
+	if leaf == nil {
+		return time.Time{}
+	}
+	return leaf.NotAfter
+}
+
+// redactConfiguration copies config, replacing the values of sensitive keys and the password of proxy_url
+func redactConfiguration(config map[string]string) map[string]string {
+	redacted := make(map[string]string, len(config))
+	for key, value := range config {
+		redacted[key] = value
+		lowerKey := strings.ToLower(key)
+		if strings.HasSuffix(lowerKey, "_path") {
+			// the location of a secret, not the secret itself
+			continue
+		}
+		for _, part := range sensitiveConfigKeyParts {
+			if strings.Contains(lowerKey, part) {
+				redacted[key] = redactedValue
+				break
+			}
+		}
+	}
+	if proxyURL, ok := redacted["proxy_url"]; ok {
+		if parsed, err := url.Parse(proxyURL); err != nil {
+			redacted["proxy_url"] = redactedValue
+		} else if _, hasPassword := parsed.User.Password(); hasPassword {
+			parsed.User = url.UserPassword(parsed.User.Username(), redactedValue)
+			redacted["proxy_url"] = parsed.String()
+		}
+	}
+	return redacted
+}
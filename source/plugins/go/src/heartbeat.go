@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// connectivityHeartbeatPingTimeout bounds a single heartbeat Ping
+const connectivityHeartbeatPingTimeout = 30 * time.Second
+
+// connectivityHeartbeat periodically pings the endpoint and reports the outcome, starting after a random jitter so
+// heartbeats of agents started together don't align
+type connectivityHeartbeat struct {
+	interval time.Duration
+	jitter   time.Duration
+	ping     func(ctx context.Context) error
+	// no heartbeat while the breaker is open, posts are already known to fail
+	breaker *CircuitBreaker
+	report  func(err error, latency time.Duration)
+}
+
+// StartConnectivityHeartbeat starts pinging OMSEndpoint every connectivity_heartbeat_interval seconds (0 disables),
+// sending a telemetry event for every heartbeat
+func StartConnectivityHeartbeat(config map[string]string) {
+	intervalSeconds := defaultConnectivityHeartbeatIntervalSeconds
+	if value := config["connectivity_heartbeat_interval"]; value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			Log("Invalid value %s for connectivity_heartbeat_interval. Using default of %d", value, defaultConnectivityHeartbeatIntervalSeconds)
+		} else {
+			intervalSeconds = seconds
+		}
+	}
+	if intervalSeconds == 0 {
+		Log("Connectivity heartbeat disabled")
+		return
+	}
+	interval := time.Duration(intervalSeconds) * time.Second
+	heartbeat := &connectivityHeartbeat{
+		interval: interval,
+		jitter:   time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(interval))),
+		ping:     Ping,
+		breaker:  ODSCircuitBreaker,
+		report:   reportConnectivityHeartbeat,
+	}
+	Log("Starting connectivity heartbeat every %s after %s", heartbeat.interval, heartbeat.jitter)
+	go heartbeat.run(nil)
+}
+
+// run sends heartbeats until stop is closed
+func (h *connectivityHeartbeat) run(stop <-chan struct{}) {
+	select {
+	case <-stop:
+		return
+	case <-time.After(h.jitter):
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.beat()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *connectivityHeartbeat) beat() {
+	// State doesn't claim the half-open trial, which is left to the posts
+	if h.breaker.State() == CircuitOpen {
+		Log("Skipping connectivity heartbeat while the circuit breaker is open")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectivityHeartbeatPingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := h.ping(ctx)
+	h.report(err, time.Since(start))
+}
+
+func reportConnectivityHeartbeat(err error, latency time.Duration) {
+	dimensions := map[string]string{
+		"Success":   "true",
+		"LatencyMs": strconv.FormatInt(int64(latency/time.Millisecond), 10),
+	}
+	if err != nil {
+		Log("Connectivity heartbeat failed: %s", err.Error())
+		dimensions["Success"] = "false"
+		dimensions["Error"] = err.Error()
+	}
+	SendEvent(eventNameConnectivityHeartbeat, dimensions)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// heartbeatRecorder captures when heartbeats pinged and what they reported
+type heartbeatRecorder struct {
+	mutex   sync.Mutex
+	pings   []time.Time
+	reports []error
+}
+
+func (r *heartbeatRecorder) ping(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pings = append(r.pings, time.Now())
+	if len(r.pings)%2 == 0 {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func (r *heartbeatRecorder) report(err error, latency time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reports = append(r.reports, err)
+}
+
+func (r *heartbeatRecorder) snapshot() ([]time.Time, []error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]time.Time(nil), r.pings...), append([]error(nil), r.reports...)
+}
+
+func Test_connectivityHeartbeat(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	const jitter = 30 * time.Millisecond
+	recorder := &heartbeatRecorder{}
+	heartbeat := &connectivityHeartbeat{
+		interval: interval,
+		jitter:   jitter,
+		ping:     recorder.ping,
+		report:   recorder.report,
+	}
+	stop := make(chan struct{})
+	start := time.Now()
+	go heartbeat.run(stop)
+	time.Sleep(jitter + 4*interval + interval/2)
+	close(stop)
+
+	pings, reports := recorder.snapshot()
+	if len(pings) < 4 || len(pings) > 6 {
+		t.Fatalf("%d heartbeats in %s, want about 5", len(pings), jitter+4*interval)
+	}
+	if first := pings[0].Sub(start); first < jitter {
+		t.Errorf("first heartbeat after %s, want it delayed by the %s jitter", first, jitter)
+	}
+	for i := 1; i < len(pings); i++ {
+		if gap := pings[i].Sub(pings[i-1]); gap < interval*8/10 {
+			t.Errorf("heartbeats %d and %d %s apart, want about %s", i-1, i, gap, interval)
+		}
+	}
+	if len(reports) != len(pings) || reports[0] != nil || reports[1] == nil {
+		t.Errorf("reports = %v, want the outcome of every ping", reports)
+	}
+}
+
+func Test_connectivityHeartbeat_SkippedWhileCircuitOpen(t *testing.T) {
+	recorder := &heartbeatRecorder{}
+	breaker := NewCircuitBreaker(1, time.Hour)
+	breaker.RecordFailure()
+	heartbeat := &connectivityHeartbeat{
+		interval: 10 * time.Millisecond,
+		ping:     recorder.ping,
+		breaker:  breaker,
+		report:   recorder.report,
+	}
+	heartbeat.beat()
+	if pings, reports := recorder.snapshot(); len(pings) != 0 || len(reports) != 0 {
+		t.Errorf("heartbeat pinged %d times with the circuit open, want none", len(pings))
+	}
+
+	breaker.RecordSuccess()
+	heartbeat.beat()
+	if pings, _ := recorder.snapshot(); len(pings) != 1 {
+		t.Errorf("heartbeat pinged %d times with the circuit closed, want 1", len(pings))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// dialContextFunc is the signature of net.Dialer.DialContext
+type dialContextFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// parseHostOverrides parses host_overrides, a comma separated list of host=ip pairs pinning the address hosts are
+// dialed at without going through DNS, e.g. 00000000-0000-0000-0000-000000000000.ods.opinsights.azure.com=10.0.0.4
+func parseHostOverrides(value string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		equalIndex := strings.Index(pair, "=")
+		if equalIndex < 0 {
+			return nil, fmt.Errorf("host override %q: want host=ip", pair)
+		}
+		host := strings.ToLower(strings.TrimSpace(pair[:equalIndex]))
+		ip := strings.TrimSpace(pair[equalIndex+1:])
+		if host == "" {
+			return nil, fmt.Errorf("host override %q: missing host", pair)
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("host override %q: %q is not an IP address", pair, ip)
+		}
+		overrides[host] = ip
+	}
+	return overrides, nil
+}
+
+// dialWithHostOverrides wraps dial so hosts listed in overrides are dialed at their IP instead of being resolved.
+// Only the dialed address changes: TLS still uses and verifies the host name of the request
+func dialWithHostOverrides(dial dialContextFunc, overrides map[string]string) dialContextFunc {
+	if len(overrides) == 0 {
+		return dial
+	}
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err == nil {
+			if ip, ok := overrides[strings.ToLower(host)]; ok {
+				address = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// getHostOverrides reads host_overrides from the plugin config, nil if it isn't set or invalid
+func getHostOverrides(config map[string]string) map[string]string {
+	value := strings.TrimSpace(config["host_overrides"])
+	if value == "" {
+		return nil
+	}
+	overrides, err := parseHostOverrides(value)
+	if err != nil {
+		message := fmt.Sprintf("Error parsing host_overrides, resolving every host with DNS: %s", err.Error())
+		Log(message)
+		SendException(message)
+		return nil
+	}
+	for _, host := range SortedConfigKeys(overrides) {
+		Log("Dialing %s at %s (host_overrides)", host, overrides[host])
+	}
+	return overrides
+}
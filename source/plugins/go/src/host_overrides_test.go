@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_dialWithHostOverrides(t *testing.T) {
+	var dialed []string
+	dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, nil
+	}
+	overrides, err := parseHostOverrides("OMS.example.test=10.0.0.4, v6.example.test = fd00::1")
+	if err != nil {
+		t.Fatalf("parseHostOverrides() error = %v", err)
+	}
+	dialWithOverrides := dialWithHostOverrides(dial, overrides)
+	for _, address := range []string{"oms.example.test:443", "v6.example.test:443", "other.example.test:443"} {
+		dialWithOverrides(context.Background(), "tcp", address)
+	}
+	if want := []string{"10.0.0.4:443", "[fd00::1]:443", "other.example.test:443"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+
+	for _, value := range []string{"oms.example.test", "=10.0.0.4", "oms.example.test=not-an-ip"} {
+		if _, err := parseHostOverrides(value); err == nil {
+			t.Errorf("parseHostOverrides(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func Test_buildHTTPClient_HostOverrides(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	certPEM, keyPEM := generateTestCertificate(t, "oms", "oms.example.test")
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	server.StartTLS()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	get := func(host string, overrides string) error {
+		client := buildHTTPClient(map[string]string{"host_overrides": overrides}, "", nil)
+		client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+		resp, err := client.Get("https://" + net.JoinHostPort(host, port) + "/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// the endpoint name resolves to the override IP and the cert is verified against that name
+	if err := get("oms.example.test", "oms.example.test=127.0.0.1"); err != nil {
+		t.Errorf("GET through the host override failed: %v", err)
+	}
+	// a name the cert isn't valid for still fails verification although it is dialed at the right IP
+	err = get("other.example.test", "other.example.test=127.0.0.1")
+	var hostnameErr x509.HostnameError
+	if !errors.As(err, &hostnameErr) {
+		t.Errorf("GET of a name the cert doesn't cover error = %v, want a hostname verification error", err)
+	}
+}
+
+func Test_ReloadConfiguration_HostOverrides(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	dir := t.TempDir()
+	IsWindows = true
+	defer func() { IsWindows = false }()
+	defer func() { PluginConfiguration = nil }()
+	certPEM, keyPEM := generateTestCertificate(t, "client")
+	certFile, keyFile := filepath.Join(dir, "oms.crt"), filepath.Join(dir, "oms.key")
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	PluginConfiguration = map[string]string{"cert_file_path": certFile, "key_file_path": keyFile}
+	CreateHTTPClient()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	configPath := filepath.Join(dir, "out_oms.conf")
+	content := "cert_file_path=" + certFile + "\nkey_file_path=" + keyFile + "\nhost_overrides=oms.example.test=127.0.0.1\n"
+	if err := ioutil.WriteFile(configPath, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadConfiguration(configPath); err != nil {
+		t.Fatalf("ReloadConfiguration() error = %v", err)
+	}
+	resp, err := GetClient().Get("http://" + net.JoinHostPort("oms.example.test", port) + "/")
+	if err != nil {
+		t.Fatalf("GET after reloading host_overrides failed: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// header the idempotency key is sent in unless idempotency_key_header is set
+const defaultIdempotencyKeyHeader = "x-ms-idempotency-key"
+
+// default number of delivered idempotency keys remembered (idempotency_key_cache_size in the plugin config)
+const defaultIdempotencyKeyCacheSize = 1024
+
+// bytes a remembered key takes from the memory budget besides the key itself, for its list element and map entry
+const idempotencyKeyEntryOverhead = 64
+
+// idempotencyKeyContextKey is the context key of a caller-provided idempotency key
+type idempotencyKeyContextKey struct{}
+
+// IdempotencyKey adds a key identifying the logical post to every request, so the endpoint can deduplicate a batch
+// it stored although the response got lost. The key is the caller-provided id (WithIdempotencyKey) or the sha256 of
+// the uncompressed payload, so it stays the same on every retry of a batch, including the post of a spilled batch
+// after a restart. The keys of the last delivered posts are remembered so a batch posted again once delivered, e.g.
+// a spilled batch whose removal failed, isn't sent twice. They draw from ProcessMemoryBudget, which evicts the oldest
+// when memory is tight. A nil IdempotencyKey adds nothing
+type IdempotencyKey struct {
+	header string
+	mutex  sync.Mutex
+	// capacity is the number of delivered keys remembered, 0 remembers none
+	capacity int
+	// most recently delivered first
+	order     *list.List
+	delivered map[string]*list.Element
+	budget    *MemoryBudget
+}
+
+// newIdempotencyKey creates a key sent in header remembering up to capacity delivered keys drawn from budget
+func newIdempotencyKey(header string, capacity int, budget *MemoryBudget) *IdempotencyKey {
+	k := &IdempotencyKey{
+		header:    header,
+		capacity:  capacity,
+		order:     list.New(),
+		delivered: map[string]*list.Element{},
+		budget:    budget,
+	}
+	if capacity > 0 {
+		budget.RegisterReclaimer(k.reclaim)
+	}
+	return k
+}
+
+// WithIdempotencyKey returns a context making the posts made with it send id as their idempotency key
+func WithIdempotencyKey(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, id)
+}
+
+// apply sets the idempotency key header of a post of body and returns the key, "" for a nil IdempotencyKey
+func (k *IdempotencyKey) apply(ctx context.Context, header http.Header, body []byte) string {
+	if k == nil {
+		return ""
+	}
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	if key == "" {
+		sum := sha256.Sum256(body)
+		key = hex.EncodeToString(sum[:])
+	}
+	header.Set(k.header, key)
+	return key
+}
+
+// Delivered reports whether the post of key was delivered, as far as the remembered keys go
+func (k *IdempotencyKey) Delivered(key string) bool {
+	if k == nil || key == "" {
+		return false
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	element, ok := k.delivered[key]
+	if ok {
+		k.order.MoveToFront(element)
+	}
+	return ok
+}
+
+// remember records the post of key as delivered if it fits the memory budget, forgetting the oldest key when full
+func (k *IdempotencyKey) remember(key string) {
+	if k == nil || key == "" || k.capacity == 0 {
+		return
+	}
+	size := idempotencyKeyEntrySize(key)
+	// reserved unlocked, it may call reclaim
+	if !k.budget.TryReserve(size) {
+		return
+	}
+	k.mutex.Lock()
+	var released int64
+	if element, ok := k.delivered[key]; ok {
+		k.order.MoveToFront(element)
+		released = size
+	} else {
+		k.delivered[key] = k.order.PushFront(key)
+		for k.order.Len() > k.capacity {
+			released += k.evictOldestLocked()
+		}
+	}
+	k.mutex.Unlock()
+	k.budget.Release(released)
+}
+
+// Len returns the number of delivered keys remembered
+func (k *IdempotencyKey) Len() int {
+	if k == nil {
+		return 0
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.order.Len()
+}
+
+// reclaim is the MemoryReclaimer of the delivered keys, forgetting the oldest until need bytes are released
+func (k *IdempotencyKey) reclaim(need int64) int64 {
+	k.mutex.Lock()
+	var released int64
+	for k.order.Len() > 0 && released < need {
+		released += k.evictOldestLocked()
+	}
+	k.mutex.Unlock()
+	k.budget.Release(released)
+	return released
+}
+
+// evictOldestLocked forgets the oldest delivered key, returning the bytes to release
+func (k *IdempotencyKey) evictOldestLocked() int64 {
+	oldest := k.order.Back()
+	k.order.Remove(oldest)
+	key := oldest.Value.(string)
+	delete(k.delivered, key)
+	return idempotencyKeyEntrySize(key)
+}
+
+func idempotencyKeyEntrySize(key string) int64 {
+	return int64(len(key)) + idempotencyKeyEntryOverhead
+}
+
+// getIdempotencyKey creates the idempotency key from idempotency_key (disabled by default), idempotency_key_header
+// and idempotency_key_cache_size (0 to not remember delivered keys) in the plugin config
+func getIdempotencyKey(config map[string]string) *IdempotencyKey {
+	if !GetBool(config, "idempotency_key", false) {
+		return nil
+	}
+	header := strings.TrimSpace(config["idempotency_key_header"])
+	if header == "" {
+		header = defaultIdempotencyKeyHeader
+	}
+	capacity := defaultIdempotencyKeyCacheSize
+	if value := config["idempotency_key_cache_size"]; value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			Log("Invalid value %s for idempotency_key_cache_size. Using default of %d", value, defaultIdempotencyKeyCacheSize)
+		} else {
+			capacity = size
+		}
+	}
+	Log("Adding an idempotency key to every post in the %s header", header)
+	return newIdempotencyKey(header, capacity, ProcessMemoryBudget)
+}
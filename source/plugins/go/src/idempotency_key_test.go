@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"Docker-Provider/source/plugins/go/src/internal/testutil"
+)
+
+func Test_PostRecordsToODS_IdempotencyKey(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	server := testutil.NewMockOMSServer(t, testutil.MockOMSOptions{
+		Statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+	})
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	defer func() {
+		OMSEndpoint = originalEndpoint
+		ODSIdempotencyKey = nil
+	}()
+	ODSIdempotencyKey = getIdempotencyKey(map[string]string{"idempotency_key": "true"})
+
+	records := [][]byte{[]byte(`{"LogMessage":"first"}`), []byte(`{"LogMessage":"second"}`)}
+	if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, records); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+	sum := sha256.Sum256(buildODSPayload(ContainerLogV2DataType, records))
+	want := hex.EncodeToString(sum[:])
+	requests := server.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("server got %d requests, want 3", len(requests))
+	}
+	for i, request := range requests {
+		if got := request.Header.Get(defaultIdempotencyKeyHeader); got != want {
+			t.Errorf("attempt %d sent idempotency key %q, want %q", i, got, want)
+		}
+	}
+
+	// a caller-provided id replaces the content hash, in the configured header
+	ODSIdempotencyKey = getIdempotencyKey(map[string]string{"idempotency_key": "on", "idempotency_key_header": "Idempotency-Key"})
+	ctx := WithIdempotencyKey(context.Background(), "batch-42")
+	if err := PostRecordsToODS(ctx, ContainerLogV2DataType, records); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+	requests = server.Requests()
+	if got := requests[len(requests)-1].Header.Get("Idempotency-Key"); got != "batch-42" {
+		t.Errorf("post sent idempotency key %q, want the caller-provided batch-42", got)
+	}
+}
+
+func Test_PostRecordsToODS_SkipsDeliveredIdempotencyKey(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+	server := testutil.NewMockOMSServer(t, testutil.MockOMSOptions{})
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	defer func() {
+		OMSEndpoint = originalEndpoint
+		ODSIdempotencyKey = nil
+	}()
+	ODSIdempotencyKey = getIdempotencyKey(map[string]string{"idempotency_key": "true", "idempotency_key_cache_size": "1"})
+
+	first := [][]byte{[]byte(`{"LogMessage":"first"}`)}
+	second := [][]byte{[]byte(`{"LogMessage":"second"}`)}
+	for _, records := range [][][]byte{first, first, second, first} {
+		if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, records); err != nil {
+			t.Fatalf("PostRecordsToODS() error = %v", err)
+		}
+	}
+	// the repost of first is skipped while its key is remembered, not once second took its place
+	if got := len(server.Requests()); got != 3 {
+		t.Errorf("server got %d requests, want 3", got)
+	}
+	if ODSIdempotencyKey.Len() != 1 {
+		t.Errorf("%d delivered keys remembered, want idempotency_key_cache_size of 1", ODSIdempotencyKey.Len())
+	}
+	if !loggedContaining(logged(), "already delivered") {
+		t.Errorf("skipped post wasn't logged, got %v", logged())
+	}
+}
+
+func Test_getIdempotencyKey(t *testing.T) {
+	if k := getIdempotencyKey(map[string]string{}); k != nil {
+		t.Errorf("getIdempotencyKey() without idempotency_key = %+v, want nil", k)
+	}
+	header := http.Header{}
+	var disabled *IdempotencyKey
+	disabled.apply(context.Background(), header, []byte("{}"))
+	if len(header) != 0 {
+		t.Errorf("nil IdempotencyKey set headers %v", header)
+	}
+}
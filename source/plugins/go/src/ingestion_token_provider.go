@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default number of seconds before its expiry the ingestion token is refetched (aad_token_refresh_margin in the plugin config)
+const defaultIngestionTokenRefreshMarginSeconds = 300
+
+// default number of seconds a failed ingestion token fetch isn't retried (aad_token_retry_interval in the plugin config)
+const defaultIngestionTokenRetryIntervalSeconds = 30
+
+// ingestionTokenCheckInterval is how often refreshIngestionAuthToken checks that the token is still fresh
+const ingestionTokenCheckInterval = time.Minute
+
+// IngestionTokenProvider caches the AAD ingestion token of AAD MSI auth mode, refetching it margin before it expires.
+// While a refetch fails the cached token is used until it expires, and fetches are retried at most every
+// retryInterval so a failing identity endpoint isn't hammered by every post. A nil provider has no token
+type IngestionTokenProvider struct {
+	mutex   sync.Mutex
+	token   string
+	expiry  time.Time
+	retryAt time.Time
+	// error of the last failed fetch, returned until retryAt
+	fetchErr error
+	// closed once the fetch in flight completes, nil if none is. The fetch runs without the mutex held
+	fetched       chan struct{}
+	margin        time.Duration
+	retryInterval time.Duration
+	// fetch obtains a new token and its expiry, fetchIngestionAuthToken unless replaced (tests)
+	fetch func() (string, time.Time, error)
+}
+
+// NewIngestionTokenProvider creates a provider fetching its tokens with fetch
+func NewIngestionTokenProvider(fetch func() (string, time.Time, error), margin time.Duration, retryInterval time.Duration) *IngestionTokenProvider {
+	return &IngestionTokenProvider{fetch: fetch, margin: margin, retryInterval: retryInterval}
+}
+
+// Token returns the cached token, refetching it first if it expires within the margin. While another post refetches
+// it the still valid cached token is returned, or that fetch is waited for. ODSIngestionAuthToken is updated with
+// every fetched token. Errors wrap ErrIngestionAuthTokenEmpty and the cause when no unexpired token could be obtained
+func (p *IngestionTokenProvider) Token() (string, error) {
+	if p == nil {
+		return "", ErrIngestionAuthTokenEmpty
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for p.fetched != nil {
+		if p.token != "" && time.Now().Before(p.expiry) {
+			return p.token, nil
+		}
+		fetched := p.fetched
+		p.mutex.Unlock()
+		<-fetched
+		p.mutex.Lock()
+	}
+	now := time.Now()
+	if p.token != "" && p.expiry.Sub(now) > p.margin {
+		return p.token, nil
+	}
+	var err error
+	if now.Before(p.retryAt) {
+		err = fmt.Errorf("the last fetch failed, not retrying yet: %w", p.fetchErr)
+	} else if err = p.refetchLocked(); err == nil {
+		return p.token, nil
+	}
+	if p.token != "" && time.Now().Before(p.expiry) {
+		// still valid, the refresh is retried with the next post
+		return p.token, nil
+	}
+	return "", &ingestionTokenError{err: err}
+}
+
+// refetchLocked fetches a new token, releasing p.mutex during the fetch so posts aren't blocked behind a slow
+// identity endpoint. p.mutex must be held
+func (p *IngestionTokenProvider) refetchLocked() error {
+	fetched := make(chan struct{})
+	p.fetched = fetched
+	p.mutex.Unlock()
+	token, expiry, err := p.fetch()
+	p.mutex.Lock()
+	p.fetched = nil
+	close(fetched)
+
+	if err == nil && token == "" {
+		err = errors.New("fetched an empty token")
+	}
+	if err != nil {
+		p.fetchErr = err
+		p.retryAt = time.Now().Add(p.retryInterval)
+		message := fmt.Sprintf("IngestionTokenProvider::Error::Failed to fetch the ingestion token, retrying in %s: %s", p.retryInterval, err.Error())
+		Log(message)
+		SendException(message)
+		return err
+	}
+	p.token, p.expiry, p.retryAt, p.fetchErr = token, expiry, time.Time{}, nil
+	IngestionAuthTokenUpdateMutex.Lock()
+	ODSIngestionAuthToken = token
+	IngestionAuthTokenUpdateMutex.Unlock()
+	Log("IngestionTokenProvider::Info::Fetched an ingestion token valid until %s", expiry.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// ingestionTokenError is returned by IngestionTokenProvider.Token when no unexpired token could be obtained. It
+// matches ErrIngestionAuthTokenEmpty with errors.Is and unwraps to the cause of the failed fetch
+type ingestionTokenError struct {
+	err error
+}
+
+func (e *ingestionTokenError) Error() string {
+	return ErrIngestionAuthTokenEmpty.Error() + ": " + e.err.Error()
+}
+
+func (e *ingestionTokenError) Is(target error) bool {
+	return target == ErrIngestionAuthTokenEmpty
+}
+
+func (e *ingestionTokenError) Unwrap() error {
+	return e.err
+}
+
+// fetchIngestionAuthToken obtains an ingestion token from AMCS with the managed identity token of IMDS, which is
+// cached until an hour before it expires. The token expires after the refresh interval AMCS answers with
+func fetchIngestionAuthToken() (string, time.Time, error) {
+	if IMDSToken == "" || IMDSTokenExpiration <= (time.Now().Unix()+60*60) { // token valid 24 hrs and refresh token 1 hr before expiry
+		imdsToken, imdsTokenExpiry, err := getAccessTokenFromIMDS()
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("getAccessTokenFromIMDS: %w", err)
+		}
+		IMDSToken = imdsToken
+		IMDSTokenExpiration = imdsTokenExpiry
+	}
+	if IMDSToken == "" {
+		return "", time.Time{}, errors.New("IMDSToken is empty")
+	}
+	// ignore agent configuration expiring, the configuration and channel IDs will never change (without creating an agent restart)
+	if ConfigurationId == "" || ChannelId == "" {
+		configurationID, channelID, err := getAgentConfiguration(IMDSToken)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("getAgentConfiguration: %w", err)
+		}
+		if configurationID == "" || channelID == "" {
+			return "", time.Time{}, errors.New("ConfigurationId or ChannelId empty")
+		}
+		ConfigurationId, ChannelId = configurationID, channelID
+	}
+	ingestionAuthToken, refreshIntervalInSeconds, err := getIngestionAuthToken(IMDSToken, ConfigurationId, ChannelId)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("getIngestionAuthToken: %w", err)
+	}
+	if refreshIntervalInSeconds <= 0 {
+		refreshIntervalInSeconds = defaultIngestionAuthTokenRefreshIntervalSeconds
+	}
+	return ingestionAuthToken, time.Now().Add(time.Duration(refreshIntervalInSeconds) * time.Second), nil
+}
+
+// getIngestionTokenProvider creates the provider of AAD MSI auth mode from aad_token_refresh_margin and
+// aad_token_retry_interval (seconds) in the plugin config
+func getIngestionTokenProvider(config map[string]string) *IngestionTokenProvider {
+	margin := getTimeoutFromConfig(config, "aad_token_refresh_margin", defaultIngestionTokenRefreshMarginSeconds)
+	retryInterval := getTimeoutFromConfig(config, "aad_token_retry_interval", defaultIngestionTokenRetryIntervalSeconds)
+	return NewIngestionTokenProvider(fetchIngestionAuthToken, margin, retryInterval)
+}
+
+// isAADMSIAuthModeConfigured reports whether AAD MSI auth mode is enabled, by the AAD_MSI_AUTH_MODE env variable or
+// by AAD_MSI_AUTH in the plugin config
+func isAADMSIAuthModeConfigured(config map[string]string) bool {
+	if strings.Compare(strings.ToLower(os.Getenv(AADMSIAuthMode)), "true") == 0 {
+		return true
+	}
+	return GetBool(config, "AAD_MSI_AUTH", false)
+}
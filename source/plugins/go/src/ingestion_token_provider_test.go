@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"Docker-Provider/source/plugins/go/src/internal/testutil"
+)
+
+func Test_IngestionTokenProvider_CachesAndRefreshesBeforeExpiry(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	defer func() { ODSIngestionAuthToken = "" }()
+	fetches := 0
+	validFor := time.Hour
+	provider := NewIngestionTokenProvider(func() (string, time.Time, error) {
+		fetches++
+		return fmt.Sprintf("token-%d", fetches), time.Now().Add(validFor), nil
+	}, time.Minute, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if token, err := provider.Token(); token != "token-1" || err != nil {
+			t.Fatalf("Token() = (%s, %v), want the cached token-1", token, err)
+		}
+	}
+	if fetches != 1 || ODSIngestionAuthToken != "token-1" {
+		t.Errorf("%d fetches with ODSIngestionAuthToken %q, want 1 fetch of token-1", fetches, ODSIngestionAuthToken)
+	}
+
+	// a token expiring within the margin is refetched
+	provider.expiry = time.Now().Add(30 * time.Second)
+	if token, _ := provider.Token(); token != "token-2" || ODSIngestionAuthToken != "token-2" {
+		t.Errorf("Token() = %s with ODSIngestionAuthToken %q, want token-2 refetched before expiry", token, ODSIngestionAuthToken)
+	}
+}
+
+func Test_IngestionTokenProvider_FetchFailure(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	defer func() { ODSIngestionAuthToken = "" }()
+	client := injectTelemetryClient(t)
+	fetches := 0
+	failing := false
+	errIMDSUnavailable := errors.New("IMDS unavailable")
+	provider := NewIngestionTokenProvider(func() (string, time.Time, error) {
+		fetches++
+		if failing {
+			return "", time.Time{}, errIMDSUnavailable
+		}
+		return "cached", time.Now().Add(30 * time.Second), nil
+	}, time.Minute, time.Hour)
+	provider.Token()
+
+	// the refresh fails, the token is still valid
+	failing = true
+	if token, err := provider.Token(); token != "cached" || err != nil {
+		t.Errorf("Token() = (%s, %v), want the still valid cached token", token, err)
+	}
+	if len(client.exceptions) != 1 {
+		t.Errorf("exceptions = %v, want the failed fetch reported", client.exceptions)
+	}
+	// not retried before the retry interval
+	provider.Token()
+	if fetches != 2 {
+		t.Errorf("%d fetches, want 2", fetches)
+	}
+
+	// once expired there is no token, the error keeps the cause of the failed fetch
+	provider.expiry = time.Now().Add(-time.Second)
+	if _, err := provider.Token(); !errors.Is(err, ErrIngestionAuthTokenEmpty) || !errors.Is(err, errIMDSUnavailable) {
+		t.Errorf("Token() error = %v, want ErrIngestionAuthTokenEmpty wrapping the fetch error", err)
+	}
+}
+
+func Test_IngestionTokenProvider_FetchDoesNotBlock(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	defer func() { ODSIngestionAuthToken = "" }()
+	var fetches int32
+	release := make(chan struct{})
+	provider := NewIngestionTokenProvider(func() (string, time.Time, error) {
+		fetch := atomic.AddInt32(&fetches, 1)
+		if fetch > 1 {
+			// a slow identity endpoint
+			<-release
+		}
+		return fmt.Sprintf("token-%d", fetch), time.Now().Add(time.Hour), nil
+	}, time.Minute, time.Minute)
+	provider.Token()
+
+	// the token expires within the margin, the post refreshing it runs until release
+	provider.mutex.Lock()
+	provider.expiry = time.Now().Add(30 * time.Second)
+	provider.mutex.Unlock()
+	refreshed := make(chan string)
+	go func() {
+		token, _ := provider.Token()
+		refreshed <- token
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&fetches) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the other posts get the still valid token meanwhile
+	done := make(chan string)
+	go func() {
+		token, _ := provider.Token()
+		done <- token
+	}()
+	select {
+	case token := <-done:
+		if token != "token-1" {
+			t.Errorf("Token() during the refresh = %s, want the cached token-1", token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Token() blocked behind the refresh in flight")
+	}
+
+	close(release)
+	if token, got := <-refreshed, atomic.LoadInt32(&fetches); token != "token-2" || got != 2 {
+		t.Errorf("refreshed Token() = %s after %d fetches, want token-2 after 2", token, got)
+	}
+}
+
+func Test_IngestionTokenProvider_WaitsForFetchWithoutToken(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	defer func() { ODSIngestionAuthToken = "" }()
+	var fetches int32
+	release := make(chan struct{})
+	provider := NewIngestionTokenProvider(func() (string, time.Time, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return "token", time.Now().Add(time.Hour), nil
+	}, time.Minute, time.Minute)
+
+	const posters = 5
+	tokens := make(chan string, posters)
+	for i := 0; i < posters; i++ {
+		go func() {
+			token, _ := provider.Token()
+			tokens <- token
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < posters; i++ {
+		if token := <-tokens; token != "token" {
+			t.Errorf("Token() = %q, want the token fetched by the first post", token)
+		}
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("%d fetches, want the posters to wait for the one in flight", got)
+	}
+}
+
+func Test_PostRecordsToODS_IngestionTokenProvider(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	server := testutil.NewMockOMSServer(t, testutil.MockOMSOptions{})
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	IsAADMSIAuthMode = true
+	ODSIngestionTokenProvider = NewIngestionTokenProvider(func() (string, time.Time, error) {
+		return "aad-token", time.Now().Add(time.Hour), nil
+	}, time.Minute, time.Minute)
+	defer func() {
+		OMSEndpoint = originalEndpoint
+		IsAADMSIAuthMode = false
+		ODSIngestionTokenProvider = nil
+		ODSIngestionAuthToken = ""
+	}()
+
+	if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, [][]byte{[]byte("{}")}); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+	requests := server.Requests()
+	if len(requests) != 1 || requests[0].Header.Get("Authorization") != "Bearer aad-token" {
+		t.Errorf("server got %d requests, want 1 with the bearer token", len(requests))
+	}
+}
+
+func Test_isAADMSIAuthModeConfigured(t *testing.T) {
+	tests := []struct {
+		config map[string]string
+		want   bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"AAD_MSI_AUTH": "true"}, true},
+		{map[string]string{"AAD_MSI_AUTH": "false"}, false},
+	}
+	for _, tt := range tests {
+		if got := isAADMSIAuthModeConfigured(tt.config); got != tt.want {
+			t.Errorf("isAADMSIAuthModeConfigured(%v) = %t, want %t", tt.config, got, tt.want)
+		}
+	}
+	// the cert/key aren't required in AAD MSI auth mode
+	if result := ValidateConfig(map[string]string{"AAD_MSI_AUTH": "true"}); len(result.Errors) != 0 {
+		t.Errorf("ValidateConfig() errors = %v, want none in AAD MSI auth mode", result.Errors)
+	}
+}
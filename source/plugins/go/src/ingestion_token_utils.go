@@ -241,7 +241,7 @@ func getAccessTokenFromIMDS() (string, int64, error) {
 				crd_request_endpoint := fmt.Sprintf("/apis/%s/namespaces/%s/azureclusteridentityrequests/%s", ArcK8sClusterConfigCRDAPIVersion, ArcK8sClusterIdentityResourceNameSpace, ArcK8sClusterIdentityResourceName)
 				crdResponseBytes, err = ClientSet.RESTClient().Get().AbsPath(crd_request_endpoint).DoRaw(context.TODO())
 				if err != nil {
-					Log("getAccessTokenFromIMDS: Failed to get the CRD: %s in namespace: %s, retryCount: %d", ArcK8sClusterIdentityResourceName, ArcK8sClusterIdentityResourceNameSpace, err.Error(), retryCount)
+					Log("getAccessTokenFromIMDS: Failed to get the CRD: %s in namespace: %s, error: %s, retryCount: %d", ArcK8sClusterIdentityResourceName, ArcK8sClusterIdentityResourceNameSpace, err.Error(), retryCount)
 					time.Sleep(time.Duration((retryCount+1)*100) * time.Millisecond)
 					continue
 				}
@@ -351,7 +351,7 @@ func getAgentConfiguration(imdsAccessToken string) (configurationId string, chan
 	var resp *http.Response = nil
 	IsSuccess := false
 	for retryCount := 0; retryCount < MaxRetries; retryCount++ {
-		resp, err = HTTPClient.Do(req)
+		resp, err = GetClient().Do(req)
 		if err != nil {
 			message := fmt.Sprintf("getAgentConfiguration: Error calling AMCS endpoint: %s", err.Error())
 			Log(message)
@@ -487,7 +487,7 @@ func getIngestionAuthToken(imdsAccessToken string, configurationId string, chann
 	IsSuccess := false
 	for retryCount := 0; retryCount < MaxRetries; retryCount++ {
 		// Call managed services for Azure resources token endpoint
-		resp, err = HTTPClient.Do(req)
+		resp, err = GetClient().Do(req)
 		if err != nil {
 			message := fmt.Sprintf("getIngestionAuthToken: Error calling AMCS endpoint for ingestion auth token: %s", err.Error())
 			Log(message)
@@ -604,58 +604,11 @@ func getTokenRefreshIntervalFromAmcsResponse(header http.Header) (refreshInterva
 	return 0, errors.New("getTokenRefreshIntervalFromAmcsResponse: didn't find max-age in response header")
 }
 
+// refreshIngestionAuthToken keeps ODSIngestionAuthToken fresh between posts, ODSIngestionTokenProvider refetching it
+// before it expires
 func refreshIngestionAuthToken() {
 	for ; true; <-IngestionAuthTokenRefreshTicker.C {
-		if IMDSToken == "" || IMDSTokenExpiration <= (time.Now().Unix()+60*60) { // token valid 24 hrs and refresh token 1 hr before expiry
-			imdsToken, imdsTokenExpiry, err := getAccessTokenFromIMDS()
-			if err != nil {
-				message := fmt.Sprintf("refreshIngestionAuthToken: Error on getAccessTokenFromIMDS  %s \n", err.Error())
-				Log(message)
-				SendException(message)
-			} else {
-				IMDSToken = imdsToken
-				IMDSTokenExpiration = imdsTokenExpiry
-			}
-		}
-		if IMDSToken == "" {
-			message := "refreshIngestionAuthToken: IMDSToken is empty"
-			Log(message)
-			SendException(message)
-			continue
-		}
-		var err error
-		// ignore agent configuration expiring, the configuration and channel IDs will never change (without creating an agent restart)
-		if ConfigurationId == "" || ChannelId == "" {
-			ConfigurationId, ChannelId, err = getAgentConfiguration(IMDSToken)
-			if err != nil {
-				message := fmt.Sprintf("refreshIngestionAuthToken: Error getAgentConfiguration %s \n", err.Error())
-				Log(message)
-				SendException(message)
-				continue
-			}
-		}
-		if IMDSToken == "" || ConfigurationId == "" || ChannelId == "" {
-			message := "refreshIngestionAuthToken: IMDSToken or ConfigurationId or ChannelId empty"
-			Log(message)
-			SendException(message)
-			continue
-		}
-		ingestionAuthToken, refreshIntervalInSeconds, err := getIngestionAuthToken(IMDSToken, ConfigurationId, ChannelId)
-		if err != nil {
-			message := fmt.Sprintf("refreshIngestionAuthToken: Error getIngestionAuthToken %s \n", err.Error())
-			Log(message)
-			SendException(message)
-			continue
-		}
-		IngestionAuthTokenUpdateMutex.Lock()
-		ODSIngestionAuthToken = ingestionAuthToken
-		IngestionAuthTokenUpdateMutex.Unlock()
-		if refreshIntervalInSeconds > 0 && refreshIntervalInSeconds != defaultIngestionAuthTokenRefreshIntervalSeconds {
-			//TODO - use Reset which is better when go version upgraded to 1.15 or up rather Stop() and NewTicker
-			//IngestionAuthTokenRefreshTicker.Reset(time.Second * time.Duration(refreshIntervalInSeconds))
-			IngestionAuthTokenRefreshTicker.Stop()
-			IngestionAuthTokenRefreshTicker = time.NewTicker(time.Second * time.Duration(refreshIntervalInSeconds))
-		}
+		ODSIngestionTokenProvider.Token()
 	}
 }
 
@@ -0,0 +1,148 @@
+// Package testutil has helpers shared by the out_oms plugin tests
+package testutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MockOMSOptions configures how a MockOMSServer answers
+type MockOMSOptions struct {
+	// Statuses are the status codes answered to the requests in order, the last one is repeated once they run
+	// out. Defaults to 200 for every request
+	Statuses []int
+	// Latency is waited before answering each request, cut short if the client gives up
+	Latency time.Duration
+	// RequiredHeaders are the headers every request must have, requests missing one are rejected with 400
+	RequiredHeaders []string
+	// RejectGzip answers 415 to requests sent with Content-Encoding gzip
+	RejectGzip bool
+	// TLS serves https instead of http
+	TLS bool
+}
+
+// MockOMSRequest is a request received by a MockOMSServer
+type MockOMSRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	// Body is the request body, decompressed if it was sent gzipped
+	Body    []byte
+	Gzipped bool
+	// StatusCode is the status answered to the request
+	StatusCode int
+}
+
+// DataItems returns the records of an ODS json payload, nil if the body isn't one
+func (r MockOMSRequest) DataItems() []json.RawMessage {
+	var payload struct {
+		DataItems []json.RawMessage
+	}
+	if err := json.Unmarshal(r.Body, &payload); err != nil {
+		return nil
+	}
+	return payload.DataItems
+}
+
+// MockOMSServer is an httptest server standing in for the OMS ingestion endpoint, capturing every request it gets
+type MockOMSServer struct {
+	*httptest.Server
+	options  MockOMSOptions
+	mutex    sync.Mutex
+	served   int
+	requests []MockOMSRequest
+}
+
+// NewMockOMSServer starts a MockOMSServer that is closed when the test finishes
+func NewMockOMSServer(t testing.TB, options MockOMSOptions) *MockOMSServer {
+	s := &MockOMSServer{options: options}
+	if options.TLS {
+		s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	} else {
+		s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Requests returns the requests received so far, in order
+func (s *MockOMSServer) Requests() []MockOMSRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]MockOMSRequest(nil), s.requests...)
+}
+
+// DeliveredDataItems returns the records of the requests answered with 200, in order
+func (s *MockOMSServer) DeliveredDataItems() []string {
+	var items []string
+	for _, request := range s.Requests() {
+		if request.StatusCode != http.StatusOK {
+			continue
+		}
+		for _, item := range request.DataItems() {
+			items = append(items, string(item))
+		}
+	}
+	return items
+}
+
+func (s *MockOMSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	request := MockOMSRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone()}
+	body, err := ioutil.ReadAll(r.Body)
+	statusCode := s.nextStatus()
+	if err != nil {
+		statusCode = http.StatusBadRequest
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		request.Gzipped = true
+		if s.options.RejectGzip {
+			statusCode = http.StatusUnsupportedMediaType
+		} else if reader, err := gzip.NewReader(bytes.NewReader(body)); err != nil {
+			statusCode = http.StatusBadRequest
+		} else if body, err = ioutil.ReadAll(reader); err != nil {
+			statusCode = http.StatusBadRequest
+		}
+	}
+	for _, header := range s.options.RequiredHeaders {
+		if r.Header.Get(header) == "" {
+			statusCode = http.StatusBadRequest
+		}
+	}
+	request.Body = body
+	request.StatusCode = statusCode
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, request)
+	s.mutex.Unlock()
+
+	if s.options.Latency > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(s.options.Latency):
+		}
+	}
+	w.WriteHeader(statusCode)
+}
+
+// nextStatus returns the configured status for the next request
+func (s *MockOMSServer) nextStatus() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	served := s.served
+	s.served++
+	if len(s.options.Statuses) == 0 {
+		return http.StatusOK
+	}
+	if served < len(s.options.Statuses) {
+		return s.options.Statuses[served]
+	}
+	return s.options.Statuses[len(s.options.Statuses)-1]
+}
@@ -0,0 +1,77 @@
+package testutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func post(t *testing.T, server *MockOMSServer, header http.Header, body []byte) int {
+	req, err := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func Test_MockOMSServer(t *testing.T) {
+	server := NewMockOMSServer(t, MockOMSOptions{
+		Statuses:        []int{http.StatusServiceUnavailable, http.StatusOK},
+		RequiredHeaders: []string{"x-ms-AzureResourceId"},
+		TLS:             true,
+	})
+	header := http.Header{"X-Ms-Azureresourceid": {"resource"}}
+	payload := []byte(`{"DataType":"CONTAINER_LOG_BLOB","DataItems":[{"LogEntry":"a"}]}`)
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(payload)
+	writer.Close()
+	gzipHeader := http.Header{"X-Ms-Azureresourceid": {"resource"}, "Content-Encoding": {"gzip"}}
+
+	if got := post(t, server, header, payload); got != http.StatusServiceUnavailable {
+		t.Errorf("first post answered %d, want 503", got)
+	}
+	if got := post(t, server, gzipHeader, compressed.Bytes()); got != http.StatusOK {
+		t.Errorf("second post answered %d, want 200", got)
+	}
+	// the last status is repeated, unless a required header is missing
+	if got := post(t, server, http.Header{}, payload); got != http.StatusBadRequest {
+		t.Errorf("post without the required header answered %d, want 400", got)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("Requests() returned %d requests, want 3", len(requests))
+	}
+	if !requests[1].Gzipped || string(requests[1].Body) != string(payload) {
+		t.Errorf("gzipped request captured as (%t, %q), want the decompressed payload", requests[1].Gzipped, requests[1].Body)
+	}
+	if got := server.DeliveredDataItems(); len(got) != 1 || got[0] != `{"LogEntry":"a"}` {
+		t.Errorf("DeliveredDataItems() = %v, want the records of the 200 request", got)
+	}
+}
+
+func Test_MockOMSServer_LatencyAndRejectGzip(t *testing.T) {
+	server := NewMockOMSServer(t, MockOMSOptions{Latency: time.Second, RejectGzip: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", server.URL, bytes.NewReader([]byte("{}")))
+	req.Header.Set("Content-Encoding", "gzip")
+	if _, err := server.Client().Do(req); err == nil {
+		t.Errorf("post answered before the latency elapsed, want the client to time out")
+	}
+	if requests := server.Requests(); len(requests) != 1 || requests[0].StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Requests() = %+v, want one gzipped request rejected with 415", requests)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// log_output sinks
+const (
+	logOutputFile   = "file"
+	logOutputStdout = "stdout"
+	logOutputStderr = "stderr"
+)
+
+// log_sink_<sink>_format values
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// log levels, in increasing severity
+const (
+	logLevelDebug int32 = iota
+	logLevelInfo
+	logLevelWarning
+	logLevelError
+)
+
+var logLevelNames = map[string]int32{
+	"debug":   logLevelDebug,
+	"info":    logLevelInfo,
+	"warning": logLevelWarning,
+	"warn":    logLevelWarning,
+	"error":   logLevelError,
+}
+
+// logLevelFollow is the level of a log sink without log_sink_<sink>_level, following logLevel
+const logLevelFollow int32 = -1
+
+// logLevel is the minimum level of the messages logged, read atomically by every Log call
+var logLevel = logLevelInfo
+
+// activeLogSinks holds the []*logSink set up from log_sinks, Log writes to FLBLogger while it holds none
+var activeLogSinks atomic.Value
+
+// logSink is a destination of the log lines with its own minimum level and format
+type logSink struct {
+	name string
+	// level is the minimum level of the lines written, logLevelFollow to follow logLevel
+	level  int32
+	format string
+	// logger serializes the lines, so each is a single write
+	logger *log.Logger
+}
+
+// accepts reports whether the sink writes lines of the given level
+func (s *logSink) accepts(level int32) bool {
+	if s.level == logLevelFollow {
+		return level >= atomic.LoadInt32(&logLevel)
+	}
+	return level >= s.level
+}
+
+// write writes a line in the format of the sink
+func (s *logSink) write(level int32, message string) {
+	if s.format != logFormatJSON {
+		s.logger.Print(message)
+		return
+	}
+	line, _ := json.Marshal(struct {
+		Time    string `json:"time"`
+		Level   string `json:"level"`
+		Message string `json:"message"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), logLevelName(level), message})
+	s.logger.Print(string(line))
+}
+
+// logLevelName returns the name of a level as accepted by log_level
+func logLevelName(level int32) string {
+	switch level {
+	case logLevelDebug:
+		return "debug"
+	case logLevelWarning:
+		return "warning"
+	case logLevelError:
+		return "error"
+	}
+	return "info"
+}
+
+// ApplyLogLevel sets the minimum level of the logged messages (debug, info, warning or error) from the LOG_LEVEL env
+// variable, or log_level in the plugin config if that isn't set, so verbosity can be raised without editing the
+// ConfigMap. An invalid value is logged and the current level kept. Called at init and on every config reload
+func ApplyLogLevel(config map[string]string) {
+	value, source := strings.TrimSpace(os.Getenv(LogLevelEnv)), LogLevelEnv
+	if value == "" {
+		value, source = strings.TrimSpace(config["log_level"]), "log_level"
+	}
+	if value == "" {
+		return
+	}
+	level, ok := logLevelNames[strings.ToLower(value)]
+	if !ok {
+		Log("Logging::Warning::Invalid value %s for %s, want debug, info, warning or error. Keeping the current log level", value, source)
+		return
+	}
+	if atomic.SwapInt32(&logLevel, level) != level {
+		Log("Logging::Info::Log level set to %s from %s", strings.ToLower(value), source)
+	}
+}
+
+// leveledLog wraps printf, dropping the messages below logLevel. The level of a message is given by its marker:
+// "::Debug::", "::Info::", "::Warning::" or "::Error:" (or a message starting with Warning or Error), messages without
+// one are info. Once log_sinks is applied the messages fan out to the sinks accepting their level instead
+func leveledLog(printf func(format string, v ...interface{})) func(format string, v ...interface{}) {
+	return func(format string, v ...interface{}) {
+		level := messageLogLevel(format)
+		if sinks, _ := activeLogSinks.Load().([]*logSink); len(sinks) > 0 {
+			message := ""
+			for _, sink := range sinks {
+				if !sink.accepts(level) {
+					continue
+				}
+				if message == "" {
+					message = fmt.Sprintf(format, v...)
+				}
+				sink.write(level, message)
+			}
+			return
+		}
+		if level >= atomic.LoadInt32(&logLevel) {
+			printf(format, v...)
+		}
+	}
+}
+
+// messageLogLevel returns the level of a log message from its marker
+func messageLogLevel(format string) int32 {
+	switch {
+	case strings.Contains(format, "::Error:") || strings.HasPrefix(format, "Error"):
+		return logLevelError
+	case strings.Contains(format, "::Warning:") || strings.HasPrefix(format, "Warning"):
+		return logLevelWarning
+	case strings.Contains(format, "::Debug::") || strings.HasPrefix(format, "Debug"):
+		return logLevelDebug
+	}
+	return logLevelInfo
+}
+
+// reliableLogWriter writes every log line in full to the log file: short writes are continued until the whole line is
+// written, and a failed write reopens the file once and carries on with the rest of the line, so disk hiccups don't
+// leave truncated or garbled lines behind
+type reliableLogWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	// reopen closes the file so the next write reopens it
+	reopen func() error
+}
+
+// newReliableLogWriter wraps the log file writer, reopen is called once per line before giving up on a failed write
+func newReliableLogWriter(writer io.Writer, reopen func() error) *reliableLogWriter {
+	return &reliableLogWriter{writer: writer, reopen: reopen}
+}
+
+// Write writes all of p, returning the number of bytes written and the error that stopped it before the end
+func (w *reliableLogWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	written := 0
+	reopened := false
+	for written < len(p) {
+		n, err := w.writer.Write(p[written:])
+		written += n
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err == nil {
+			continue
+		}
+		if !reopened && w.reopen != nil {
+			reopened = true
+			if reopenErr := w.reopen(); reopenErr == nil {
+				w.reportFailure(err, true)
+				continue
+			}
+		}
+		w.reportFailure(err, false)
+		return written, err
+	}
+	return written, nil
+}
+
+// reportFailure sends the failed write as a telemetry event. It can't go through SendEvent, which logs
+func (w *reliableLogWriter) reportFailure(err error, recovered bool) {
+	if client := getTelemetryClient(); client != nil {
+		client.TrackEvent(eventNameLogFileWriteFailed, map[string]string{"Error": err.Error(), "Recovered": fmt.Sprintf("%t", recovered)})
+	}
+}
+
+// logOutputOnce applies log_output only once, at plugin init
+var logOutputOnce sync.Once
+
+// ApplyLogOutput points FLBLogger at the sinks selected with log_output in the plugin config, a comma separated list
+// of file, stdout and stderr. The rotating log file stays the only sink if log_output isn't set or is invalid.
+// log_sinks takes precedence over log_output, see newLogSinks
+func ApplyLogOutput(config map[string]string) {
+	logOutputOnce.Do(func() {
+		if value := strings.TrimSpace(config["log_sinks"]); value != "" {
+			sinks, err := newLogSinks(config, logFileWriter)
+			if err == nil {
+				activeLogSinks.Store(sinks)
+				Log("Logging to %s", value)
+				return
+			}
+			Log("Logging::Warning::Invalid log_sinks %s, ignoring it: %s", value, err.Error())
+		}
+		value := strings.TrimSpace(config["log_output"])
+		if value == "" {
+			return
+		}
+		writer, err := newLogOutput(value, logFileWriter)
+		if err != nil {
+			Log("Invalid value %s for log_output. Logging to file: %s", value, err.Error())
+			return
+		}
+		FLBLogger.SetOutput(writer)
+		Log("Logging to %s", value)
+	})
+}
+
+// newLogOutput returns a writer duplicating every log line to the given sinks. FLBLogger issues a single Write per
+// line while holding its own lock, so the sinks never see interleaved lines and the file (lumberjack) rotates on
+// line boundaries
+func newLogOutput(logOutput string, file io.Writer) (io.Writer, error) {
+	var writers []io.Writer
+	seen := map[string]bool{}
+	for _, sink := range strings.Split(logOutput, ",") {
+		sink = strings.ToLower(strings.TrimSpace(sink))
+		if seen[sink] {
+			continue
+		}
+		seen[sink] = true
+		switch sink {
+		case logOutputFile:
+			if file == nil {
+				return nil, fmt.Errorf("log file isn't available")
+			}
+			writers = append(writers, file)
+		case logOutputStdout:
+			writers = append(writers, os.Stdout)
+		case logOutputStderr:
+			writers = append(writers, os.Stderr)
+		default:
+			return nil, fmt.Errorf("unknown sink %q, want %s, %s or %s", sink, logOutputFile, logOutputStdout, logOutputStderr)
+		}
+	}
+	if len(writers) == 1 {
+		return writers[0], nil
+	}
+	return io.MultiWriter(writers...), nil
+}
+
+// newLogSinks creates the sinks listed in log_sinks, a comma separated list of file, stdout and stderr, each logging
+// the lines of at least log_sink_<sink>_level (debug, info, warning or error, logLevel if not set) in
+// log_sink_<sink>_format (text, the default, or json lines with time, level and message). For instance full verbosity
+// to the file and only warnings and errors to stdout:
+// log_sinks=file,stdout log_sink_file_level=debug log_sink_stdout_level=warning log_sink_stdout_format=json
+func newLogSinks(config map[string]string, file io.Writer) ([]*logSink, error) {
+	var sinks []*logSink
+	seen := map[string]bool{}
+	for _, name := range strings.Split(config["log_sinks"], ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		var writer io.Writer
+		switch name {
+		case logOutputFile:
+			if file == nil {
+				return nil, fmt.Errorf("log file isn't available")
+			}
+			writer = file
+		case logOutputStdout:
+			writer = os.Stdout
+		case logOutputStderr:
+			writer = os.Stderr
+		default:
+			return nil, fmt.Errorf("unknown sink %q, want %s, %s or %s", name, logOutputFile, logOutputStdout, logOutputStderr)
+		}
+
+		sink := &logSink{name: name, level: logLevelFollow, format: logFormatText}
+		if value := strings.TrimSpace(config["log_sink_"+name+"_level"]); value != "" {
+			level, ok := logLevelNames[strings.ToLower(value)]
+			if !ok {
+				return nil, fmt.Errorf("invalid log_sink_%s_level %q, want debug, info, warning or error", name, value)
+			}
+			sink.level = level
+		}
+		flags := log.LstdFlags
+		switch format := strings.ToLower(strings.TrimSpace(config["log_sink_"+name+"_format"])); format {
+		case "", logFormatText:
+		case logFormatJSON:
+			sink.format = logFormatJSON
+			flags = 0
+		default:
+			return nil, fmt.Errorf("invalid log_sink_%s_format %q, want %s or %s", name, format, logFormatText, logFormatJSON)
+		}
+		sink.logger = log.New(writer, "", flags)
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no sink listed")
+	}
+	return sinks, nil
+}
+
+// warnLoudly logs a warning operators must not miss to the plugin log and to stdout, where it shows in the container
+// log, and reports it to telemetry: as eventName with dimensions, or as an exception if eventName is ""
+func warnLoudly(message string, eventName string, dimensions map[string]string) {
+	Log(message)
+	fmt.Fprintf(os.Stdout, "%s\n", message)
+	if eventName == "" {
+		SendException(message)
+		return
+	}
+	SendEvent(eventName, dimensions)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_newLogOutput_Stdout(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalStdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = originalStdout }()
+
+	var file bytes.Buffer
+	output, err := newLogOutput("stdout, FILE", &file)
+	if err != nil {
+		t.Fatalf("newLogOutput() error = %v", err)
+	}
+	logger := log.New(output, "", 0)
+	logger.Printf("Posted %d records", 3)
+	writer.Close()
+
+	stdout, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != "Posted 3 records\n" {
+		t.Errorf("stdout = %q, want the log line", stdout)
+	}
+	if file.String() != "Posted 3 records\n" {
+		t.Errorf("file = %q, want the log line", file.String())
+	}
+}
+
+func Test_newLogOutput_Invalid(t *testing.T) {
+	var file bytes.Buffer
+	if _, err := newLogOutput("file,syslog", &file); err == nil || !strings.Contains(err.Error(), "syslog") {
+		t.Errorf("newLogOutput() error = %v, want an unknown sink error", err)
+	}
+	if _, err := newLogOutput("file", nil); err == nil {
+		t.Errorf("newLogOutput() without a log file succeeded")
+	}
+}
+
+func Test_ApplyLogLevel_EnvOverridesConfig(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+	originalEnv, envSet := os.LookupEnv(LogLevelEnv)
+	defer func() {
+		if envSet {
+			os.Setenv(LogLevelEnv, originalEnv)
+		} else {
+			os.Unsetenv(LogLevelEnv)
+		}
+		logLevel = logLevelInfo
+	}()
+	var printed []string
+	log := leveledLog(func(format string, v ...interface{}) { printed = append(printed, format) })
+	messages := []string{"Sender::Debug::payload", "Sender::Info::flushed", "plain message", "Config::Warning::deprecated", "PostStreamToODS::Error:(retriable) failed"}
+
+	os.Setenv(LogLevelEnv, "error")
+	ApplyLogLevel(map[string]string{"log_level": "debug"})
+	for _, message := range messages {
+		log(message)
+	}
+	if len(printed) != 1 || printed[0] != messages[4] {
+		t.Errorf("LOG_LEVEL=error with log_level debug logged %v, want only the error", printed)
+	}
+
+	os.Setenv(LogLevelEnv, "DEBUG")
+	ApplyLogLevel(map[string]string{"log_level": "error"})
+	printed = nil
+	for _, message := range messages {
+		log(message)
+	}
+	if len(printed) != len(messages) {
+		t.Errorf("LOG_LEVEL=DEBUG logged %v, want every message", printed)
+	}
+
+	// an invalid value keeps the current level
+	os.Setenv(LogLevelEnv, "verbose")
+	ApplyLogLevel(map[string]string{"log_level": "error"})
+	if logLevel != logLevelDebug || !loggedContaining(logged(), "Invalid value verbose for LOG_LEVEL") {
+		t.Errorf("invalid LOG_LEVEL changed the level to %d or wasn't logged", logLevel)
+	}
+
+	// without the env variable log_level applies
+	os.Unsetenv(LogLevelEnv)
+	ApplyLogLevel(map[string]string{"log_level": "warning"})
+	printed = nil
+	for _, message := range messages {
+		log(message)
+	}
+	if len(printed) != 2 {
+		t.Errorf("log_level warning logged %v, want the warning and the error", printed)
+	}
+}
+
+func Test_newLogSinks_IndependentLevels(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalStdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = originalStdout }()
+
+	var file bytes.Buffer
+	sinks, err := newLogSinks(map[string]string{
+		"log_sinks":              "file, stdout",
+		"log_sink_file_level":    "debug",
+		"log_sink_stdout_level":  "warning",
+		"log_sink_stdout_format": "json",
+	}, &file)
+	if err != nil {
+		t.Fatalf("newLogSinks() error = %v", err)
+	}
+	activeLogSinks.Store(sinks)
+	defer activeLogSinks.Store([]*logSink(nil))
+
+	printed := 0
+	log := leveledLog(func(format string, v ...interface{}) { printed++ })
+	log("Sender::Debug::payload of %d bytes", 10)
+	log("Sender::Info::flushed")
+	log("Config::Warning::deprecated key %s", "omsproxy_conf_path")
+	log("PostStreamToODS::Error:(retriable) failed")
+	writer.Close()
+
+	// the file sink logs at debug although the log level is info
+	lines := strings.Split(strings.TrimSpace(file.String()), "\n")
+	wantFile := []string{"Sender::Debug::payload of 10 bytes", "Sender::Info::flushed", "Config::Warning::deprecated key omsproxy_conf_path", "PostStreamToODS::Error:(retriable) failed"}
+	if len(lines) != len(wantFile) {
+		t.Fatalf("file sink got %q, want %d lines", file.String(), len(wantFile))
+	}
+	for i, want := range wantFile {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("file sink line %d = %q, want it ending with %q", i, lines[i], want)
+		}
+	}
+
+	stdout, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(stdout)), "\n") {
+		var entry struct{ Time, Level, Message string }
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Time == "" {
+			t.Fatalf("stdout sink line %q isn't a json entry: %v", line, err)
+		}
+		got = append(got, entry.Level+" "+entry.Message)
+	}
+	want := []string{"warning Config::Warning::deprecated key omsproxy_conf_path", "error PostStreamToODS::Error:(retriable) failed"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("stdout sink got %v, want %v", got, want)
+	}
+	if printed != 0 {
+		t.Errorf("%d messages went to FLBLogger, want all of them to the sinks", printed)
+	}
+}
+
+func Test_newLogSinks_Invalid(t *testing.T) {
+	tests := []map[string]string{
+		{"log_sinks": "syslog"},
+		{"log_sinks": " , "},
+		{"log_sinks": "stdout", "log_sink_stdout_level": "verbose"},
+		{"log_sinks": "stdout", "log_sink_stdout_format": "xml"},
+	}
+	for _, config := range tests {
+		if _, err := newLogSinks(config, nil); err == nil {
+			t.Errorf("newLogSinks(%v) succeeded, want error", config)
+		}
+	}
+	if _, err := newLogSinks(map[string]string{"log_sinks": "file"}, nil); err == nil {
+		t.Errorf("newLogSinks() of a file sink without a log file succeeded, want error")
+	}
+}
+
+// flakyWriter writes at most maxWrite bytes per call and fails the calls listed in failures
+type flakyWriter struct {
+	bytes.Buffer
+	maxWrite int
+	calls    int
+	failures map[int]error
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.calls++
+	if err := w.failures[w.calls]; err != nil {
+		// a failed write may still have written part of the buffer
+		n := len(p) / 2
+		w.Buffer.Write(p[:n])
+		return n, err
+	}
+	if len(p) > w.maxWrite {
+		p = p[:w.maxWrite]
+	}
+	return w.Buffer.Write(p)
+}
+
+func Test_reliableLogWriter(t *testing.T) {
+	client := injectTelemetryClient(t)
+	line := []byte("2026/10/14 10:00:00 Sender::Info::Successfully flushed 10 records\n")
+
+	// short writes are continued until the whole line is written
+	file := &flakyWriter{maxWrite: 7}
+	writer := newReliableLogWriter(file, nil)
+	if n, err := writer.Write(line); err != nil || n != len(line) || file.String() != string(line) {
+		t.Errorf("Write() with short writes = (%d, %v) writing %q, want the full line", n, err, file.String())
+	}
+
+	// a failed write reopens the file and writes the rest of the line
+	reopened := 0
+	file = &flakyWriter{maxWrite: 1024, failures: map[int]error{1: errors.New("no space left on device")}}
+	writer = newReliableLogWriter(file, func() error { reopened++; return nil })
+	if n, err := writer.Write(line); err != nil || n != len(line) || file.String() != string(line) {
+		t.Errorf("Write() after a failed write = (%d, %v) writing %q, want the full line", n, err, file.String())
+	}
+	if reopened != 1 || len(client.events) != 1 || client.events[0] != eventNameLogFileWriteFailed {
+		t.Errorf("reopened %d times with events %v, want 1 reopen and a %s event", reopened, client.events, eventNameLogFileWriteFailed)
+	}
+
+	// the file is reopened only once per line
+	reopened = 0
+	failure := errors.New("input/output error")
+	file = &flakyWriter{maxWrite: 1024, failures: map[int]error{1: failure, 2: failure}}
+	writer = newReliableLogWriter(file, func() error { reopened++; return nil })
+	if n, err := writer.Write(line); err != failure || n >= len(line) {
+		t.Errorf("Write() failing after the reopen = (%d, %v), want (<%d, %v)", n, err, len(line), failure)
+	}
+	if reopened != 1 {
+		t.Errorf("reopened %d times, want 1", reopened)
+	}
+
+	// a writer making no progress doesn't loop forever
+	file = &flakyWriter{maxWrite: 0}
+	writer = newReliableLogWriter(file, func() error { return errors.New("can't reopen") })
+	if _, err := writer.Write(line); err != io.ErrShortWrite {
+		t.Errorf("Write() without progress error = %v, want io.ErrShortWrite", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryReclaimer is registered by a cache holding memory of the budget it can give back, e.g. a dedup cache. It is
+// called when a reservation doesn't fit and should evict entries worth at least need bytes if it can, releasing them
+// from the budget. Returns the number of bytes it released
+type MemoryReclaimer func(need int64) int64
+
+// MemoryBudget caps the memory held by the buffers of the process (memory_budget_bytes): the records buffered by the
+// senders, the batches staged in memory for spillover and their replay, and the caches registering a reclaimer all
+// draw from it. When a reservation doesn't fit, the caches are trimmed first and the senders then apply backpressure,
+// see Sender.Enqueue. A nil MemoryBudget is unlimited
+type MemoryBudget struct {
+	mutex    sync.Mutex
+	used     int64
+	capacity int64
+	// wait is how long Reserve waits for memory to be released before reserving over the budget
+	wait time.Duration
+	// closed and replaced on every Release, waking up the reservations waiting for memory
+	released   chan struct{}
+	reclaimers []MemoryReclaimer
+}
+
+// NewMemoryBudget creates a budget of capacity bytes, reservations waiting at most wait for memory to be released
+func NewMemoryBudget(capacity int64, wait time.Duration) *MemoryBudget {
+	return &MemoryBudget{capacity: capacity, wait: wait, released: make(chan struct{})}
+}
+
+// RegisterReclaimer adds a cache trimmed when a reservation doesn't fit. Reclaimers are called in the order they were
+// registered, without the budget locked so they can Release what they evict
+func (b *MemoryBudget) RegisterReclaimer(reclaim MemoryReclaimer) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reclaimers = append(b.reclaimers, reclaim)
+}
+
+// TryReserve reserves n bytes if they fit, trimming the registered caches to make room. Returns false, reserving
+// nothing, if they still don't fit
+func (b *MemoryBudget) TryReserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	if b.reserveIfFits(n) {
+		return true
+	}
+	b.mutex.Lock()
+	need := b.used + n - b.capacity
+	reclaimers := b.reclaimers
+	b.mutex.Unlock()
+	for _, reclaim := range reclaimers {
+		if need <= 0 {
+			break
+		}
+		need -= reclaim(need)
+	}
+	return b.reserveIfFits(n)
+}
+
+// Reserve reserves n bytes, waiting up to the wait of the budget for other consumers to release memory if they don't
+// fit. Once the wait is over the bytes are reserved anyway, so the caller isn't blocked for good by memory that is
+// only released by its own progress. Returns false if the reservation is over the budget
+func (b *MemoryBudget) Reserve(n int64) bool {
+	if b == nil || b.TryReserve(n) {
+		return true
+	}
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+	for {
+		b.mutex.Lock()
+		released := b.released
+		b.mutex.Unlock()
+		select {
+		case <-released:
+			if b.TryReserve(n) {
+				return true
+			}
+		case <-timer.C:
+			b.ForceReserve(n)
+			return false
+		}
+	}
+}
+
+// ForceReserve reserves n bytes even over the budget, for memory that is held anyway
+func (b *MemoryBudget) ForceReserve(n int64) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used += n
+}
+
+// Release gives back n reserved bytes
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// Used returns the number of reserved bytes, 0 for a nil budget
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.used
+}
+
+// Capacity returns the size of the budget, 0 for a nil (unlimited) budget
+func (b *MemoryBudget) Capacity() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.capacity
+}
+
+func (b *MemoryBudget) reserveIfFits(n int64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.used+n > b.capacity {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// getMemoryBudget creates the process memory budget from memory_budget_bytes (no budget unless set) and
+// memory_budget_wait (seconds, defaulting to defaultMemoryBudgetWaitSeconds) in the plugin config
+func getMemoryBudget(config map[string]string) *MemoryBudget {
+	value := config["memory_budget_bytes"]
+	if value == "" {
+		return nil
+	}
+	capacity, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || capacity <= 0 {
+		Log("Invalid value %s for memory_budget_bytes. Not limiting the memory of the buffers", value)
+		return nil
+	}
+	wait := getTimeoutFromConfig(config, "memory_budget_wait", defaultMemoryBudgetWaitSeconds)
+	Log("Limiting the memory of the buffers to %d bytes", capacity)
+	return NewMemoryBudget(capacity, wait)
+}
+
+// batchBytes returns the total size of the records of a batch
+func batchBytes(batch [][]byte) int64 {
+	var size int64
+	for _, record := range batch {
+		size += int64(len(record))
+	}
+	return size
+}
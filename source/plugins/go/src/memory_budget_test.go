@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCache stands in for a cache drawing from the memory budget, holding entries of entrySize bytes
+type testCache struct {
+	mutex     sync.Mutex
+	budget    *MemoryBudget
+	entries   int
+	entrySize int64
+}
+
+// add caches an entry if it fits the budget
+func (c *testCache) add() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.budget.TryReserve(c.entrySize) {
+		c.entries++
+	}
+}
+
+// reclaim evicts entries until need bytes are released or the cache is empty
+func (c *testCache) reclaim(need int64) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var released int64
+	for c.entries > 0 && released < need {
+		c.entries--
+		released += c.entrySize
+	}
+	c.budget.Release(released)
+	return released
+}
+
+func Test_MemoryBudget_BackpressureAndCacheTrim(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+	ProcessMemoryBudget = NewMemoryBudget(100, 50*time.Millisecond)
+	defer func() { ProcessMemoryBudget = nil }()
+	cache := &testCache{budget: ProcessMemoryBudget, entrySize: 10}
+	ProcessMemoryBudget.RegisterReclaimer(cache.reclaim)
+	for i := 0; i < 6; i++ {
+		cache.add()
+	}
+
+	// neither trigger fires during the test, only the budget flushes
+	s, recorder := newTestSender(0, time.Hour)
+	s.budget = ProcessMemoryBudget
+	record := []byte(strings.Repeat("r", 30))
+	for i := 0; i < 3; i++ {
+		s.Enqueue(record)
+	}
+	if cache.entries != 1 || len(recorder.batchSizes()) != 0 {
+		t.Fatalf("after 3 records the cache holds %d entries and %d batches were posted, want the cache trimmed to 1 and no post", cache.entries, len(recorder.batchSizes()))
+	}
+
+	// trimming the cache isn't enough anymore, the buffered records are posted before the record is buffered
+	s.Enqueue(record)
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[3]" {
+		t.Errorf("batch sizes = %s, want [3] posted once the budget was tight", got)
+	}
+	if cache.entries != 0 || s.QueueDepth() != 1 || ProcessMemoryBudget.Used() != 30 {
+		t.Errorf("cache holds %d entries, %d records buffered, %d bytes used, want 0, 1 and 30", cache.entries, s.QueueDepth(), ProcessMemoryBudget.Used())
+	}
+
+	// a record larger than the whole budget waits for memory, then is buffered over the budget
+	s.Enqueue([]byte(strings.Repeat("r", 120)))
+	if s.QueueDepth() != 1 || ProcessMemoryBudget.Used() != 120 {
+		t.Errorf("%d records buffered and %d bytes used, want the oversized record buffered alone over the budget", s.QueueDepth(), ProcessMemoryBudget.Used())
+	}
+	if !loggedContaining(logged(), "Memory budget of 100 bytes exhausted") {
+		t.Errorf("buffering over the budget wasn't logged, got %v", logged())
+	}
+	s.Flush(context.Background())
+	if used := ProcessMemoryBudget.Used(); used != 0 {
+		t.Errorf("%d bytes used after Flush, want 0", used)
+	}
+}
+
+func Test_MemoryBudget_TrimsDeliveredIdempotencyKeys(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	entrySize := int64(sha256.Size*2 + idempotencyKeyEntryOverhead)
+	ProcessMemoryBudget = NewMemoryBudget(3*entrySize+16, time.Minute)
+	defer func() { ProcessMemoryBudget = nil }()
+	key := getIdempotencyKey(map[string]string{"idempotency_key": "true"})
+	for i := 0; i < 3; i++ {
+		body := []byte(fmt.Sprintf(`{"DataItems":[%d]}`, i))
+		key.remember(key.apply(context.Background(), http.Header{}, body))
+	}
+	if key.Len() != 3 || ProcessMemoryBudget.Used() != 3*entrySize {
+		t.Fatalf("%d keys remembered using %d bytes, want 3 using %d", key.Len(), ProcessMemoryBudget.Used(), 3*entrySize)
+	}
+
+	// a key that doesn't fit the budget anymore isn't remembered
+	key.remember(key.apply(context.Background(), http.Header{}, []byte("{}")))
+	if key.Len() != 3 {
+		t.Errorf("%d keys remembered over the budget, want 3", key.Len())
+	}
+
+	// buffering a record needing more than the budget has left trims the keys to make room
+	s, _ := newTestSender(0, time.Hour)
+	s.budget = ProcessMemoryBudget
+	s.Enqueue([]byte(strings.Repeat("r", int(entrySize)+32)))
+	if key.Len() != 1 || ProcessMemoryBudget.Used() != 2*entrySize+32 {
+		t.Errorf("%d keys remembered using %d bytes with the record, want trimmed to 1 using %d", key.Len(), ProcessMemoryBudget.Used(), 2*entrySize+32)
+	}
+	s.Flush(context.Background())
+}
+
+func Test_MemoryBudget_ReserveWaitsForRelease(t *testing.T) {
+	budget := NewMemoryBudget(100, time.Minute)
+	budget.ForceReserve(100)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		budget.Release(50)
+	}()
+	if !budget.Reserve(40) {
+		t.Errorf("Reserve() = false, want the bytes released by another consumer reserved")
+	}
+	if used := budget.Used(); used != 90 {
+		t.Errorf("Used() = %d, want 90", used)
+	}
+}
+
+func Test_memorySpillStore_MemoryBudget(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	store := newMemorySpillStore(100)
+	store.budget = NewMemoryBudget(10, 0)
+	store.Push([][]byte{[]byte("aaaa")})
+	store.Push([][]byte{[]byte("bbbb")})
+	// the oldest batch is dropped to make room in the budget
+	store.Push([][]byte{[]byte("cccc")})
+	if store.Len() != 2 || store.budget.Used() != 8 {
+		t.Errorf("store holds %d batches using %d bytes, want 2 batches of 8 bytes", store.Len(), store.budget.Used())
+	}
+	if err := store.Push([][]byte{[]byte("larger than the budget")}); err == nil {
+		t.Errorf("Push() of a batch larger than the budget succeeded, want error")
+	}
+	// a batch keeps its memory until it is removed
+	batch, id, _, _ := store.Peek()
+	if string(batch[0]) != "bbbb" || store.budget.Used() != 8 {
+		t.Errorf("Peek() = %s with %d bytes used, want bbbb and 8 bytes", batch, store.budget.Used())
+	}
+	if store.Remove(id); store.Len() != 1 || store.budget.Used() != 4 {
+		t.Errorf("Remove() left %d batches using %d bytes, want 1 of 4 bytes", store.Len(), store.budget.Used())
+	}
+}
+
+func Test_getMemoryBudget(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"67108864", 67108864},
+		{"-1", 0},
+		{"abc", 0},
+	}
+	for _, tt := range tests {
+		if got := getMemoryBudget(map[string]string{"memory_budget_bytes": tt.value}).Capacity(); got != tt.want {
+			t.Errorf("getMemoryBudget(%q).Capacity() = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrODSNonRetriable is returned when OMSEndpoint rejects a post with a status code that isn't worth retrying
+	ErrODSNonRetriable = errors.New("non-retriable response from ODS")
+	// ErrODSRetriesExhausted is returned when a post kept failing with retriable errors for MaxRetries attempts
+	ErrODSRetriesExhausted = errors.New("ran out of retries posting to ODS")
+	// ErrIngestionAuthTokenEmpty is returned in AAD MSI auth mode while no ingestion token has been obtained yet
+	ErrIngestionAuthTokenEmpty = errors.New("ODS Ingestion Auth Token is empty. Please check error log.")
+)
+
+// BodyFactory opens a fresh reader over a payload. A consumed stream can't be replayed, so the posting
+// path calls the factory once per attempt (e.g. re-opening a spilled batch file from the start)
+type BodyFactory func() (io.ReadCloser, error)
+
+// PostStreamToODS posts the payload produced by newBody to the given endpoint without buffering it in memory.
+// The body is sent with chunked transfer encoding, so memory stays bounded regardless of the batch size.
+// Retriable failures (transport errors classifyTransportError retries and IsRetriableError status codes) are retried up to MaxRetries times,
+// re-opening the body through newBody for every attempt, as long as ODSRetryBudget has tokens left. Returns the status code of the last response (0 if none).
+// A clock skew rejection (ODSClockSkewDetector) is retried once with the corrected time, right away and not counted against MaxRetries or ODSRetryBudget.
+// Fails with ErrCircuitOpen before dialing while ODSCircuitBreaker is open
+func PostStreamToODS(ctx context.Context, endpoint string, header http.Header, newBody BodyFactory) (int, error) {
+	poster := pluginODSPoster()
+	poster.endpoint = endpoint
+	return poster.postStream(ctx, header, newBody)
+}
+
+// odsPoster posts to an ODS endpoint with its own client, payload settings and clock skew detector: those of the
+// plugin globals for the posts of the plugin (pluginODSPoster), or those of the config of a sender created with
+// NewSender (newODSPoster). The retry budget, circuit breaker and AAD MSI ingestion token are shared by the process
+type odsPoster struct {
+	// getClient returns the client of every attempt
+	getClient func() *http.Client
+	endpoint  string
+	// gzipMinBytes and gzipLevel compress the payloads, see GzipMinBytes and GzipLevel
+	gzipMinBytes int
+	gzipLevel    int
+	checksum     *PayloadChecksum
+	idempotency  *IdempotencyKey
+	clockSkew    *ClockSkewDetector
+	// resourceID is sent as x-ms-AzureResourceId, empty for none
+	resourceID string
+	// recordPosted accounts a delivered batch in telemetry, nil to not count it
+	recordPosted func(records int, payloadBytes int, postedBytes int, gzipped bool)
+}
+
+// pluginODSPoster returns the poster of the plugin, posting to OMSEndpoint with the current plugin globals
+func pluginODSPoster() *odsPoster {
+	resourceID := ""
+	if ResourceCentric {
+		resourceID = ResourceID
+	}
+	return &odsPoster{
+		getClient:    GetClient,
+		endpoint:     OMSEndpoint,
+		gzipMinBytes: GzipMinBytes,
+		gzipLevel:    GzipLevel,
+		checksum:     ODSPayloadChecksum,
+		idempotency:  ODSIdempotencyKey,
+		clockSkew:    ODSClockSkewDetector,
+		resourceID:   resourceID,
+		recordPosted: recordPostedBatch,
+	}
+}
+
+// newODSPoster returns the poster of a NewSender sender, posting to endpoint with client and the gzip, checksum,
+// idempotency key, clock skew and resource_id settings of its config. Its posts aren't counted in the telemetry of the
+// plugin
+func newODSPoster(config map[string]string, endpoint string, client *http.Client) *odsPoster {
+	return &odsPoster{
+		getClient:    func() *http.Client { return client },
+		endpoint:     endpoint,
+		gzipMinBytes: getGzipMinBytes(config),
+		gzipLevel:    getGzipLevel(config),
+		checksum:     getPayloadChecksum(config),
+		idempotency:  getIdempotencyKey(config),
+		clockSkew:    getClockSkewDetector(config),
+		resourceID:   strings.TrimSpace(config["resource_id"]),
+	}
+}
+
+// postStream is PostStreamToODS to the endpoint of the poster
+func (p *odsPoster) postStream(ctx context.Context, header http.Header, newBody BodyFactory) (int, error) {
+	endpoint := p.endpoint
+	if newBody == nil {
+		return 0, errors.New("PostStreamToODS: body factory is nil")
+	}
+	if ODSCircuitBreaker.IsOpen() {
+		return 0, fmt.Errorf("PostStreamToODS: %w, not posting to %s", ErrCircuitOpen, endpoint)
+	}
+	reqID := uuid.New().String()
+	statusCode := 0
+	// skewRetrying is set for the attempt retrying a clock skew rejection, it doesn't wait or take a budget token
+	skewRetried, skewRetrying := false, false
+	var lastErr error
+	for retryCount := 0; retryCount < MaxRetries; retryCount++ {
+		if retryCount > 0 && !skewRetrying {
+			if !ODSRetryBudget.TryTake() {
+				ODSCircuitBreaker.RecordFailure()
+				Log("PostStreamToODS::Error:RequestId %s not retried, retry budget exhausted", reqID)
+				return statusCode, fmt.Errorf("PostStreamToODS: %w: %v", ErrRetryBudgetExhausted, lastErr)
+			}
+			retryDelay := time.Duration(retryCount*100) * time.Millisecond
+			select {
+			case <-ctx.Done():
+				return statusCode, ctx.Err()
+			case <-time.After(retryDelay):
+			}
+		}
+		skewRetrying = false
+
+		body, err := newBody()
+		if err != nil {
+			return statusCode, fmt.Errorf("PostStreamToODS: unable to open request body: %w", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, body)
+		if err != nil {
+			body.Close()
+			return statusCode, fmt.Errorf("PostStreamToODS: %w", err)
+		}
+		// unknown length forces chunked transfer encoding, GetBody lets the transport replay the body if it has to
+		req.ContentLength = -1
+		req.GetBody = newBody
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-Request-ID", reqID)
+		p.clockSkew.apply(req.Header)
+		tunnelTrace := &proxyTunnelTrace{}
+		req = tunnelTrace.withTrace(req)
+
+		client := p.getClient()
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			tunnelErr := classifyProxyTunnelError(client, req, tunnelTrace, err)
+			reportTransportError(tunnelErr)
+			if tunnelErr != nil {
+				lastErr = tunnelErr
+			}
+			if ctx.Err() != nil {
+				return statusCode, ctx.Err()
+			}
+			class, retriable := classifyTransportError(lastErr)
+			if !retriable {
+				ODSCircuitBreaker.RecordFailure()
+				Log("PostStreamToODS::Error:(nonretriable) RequestId %s %s error when sending request %s", reqID, class, lastErr.Error())
+				return statusCode, fmt.Errorf("PostStreamToODS: %w", &nonRetriableTransportError{class: class, err: lastErr})
+			}
+			if tunnelErr != nil {
+				Log("PostStreamToODS::Error:(retriable) RequestId %s %s, retryCount: %d", reqID, tunnelErr.Error(), retryCount)
+			} else {
+				Log("PostStreamToODS::Error:(retriable) RequestId %s %s error when sending request %s, retryCount: %d", reqID, class, err.Error(), retryCount)
+			}
+			continue
+		}
+		var respBody []byte
+		if resp.StatusCode != 200 {
+			respBody, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		statusCode = resp.StatusCode
+		if statusCode == 200 {
+			ODSCircuitBreaker.RecordSuccess()
+			return statusCode, nil
+		}
+		lastErr = fmt.Errorf("RequestId %s Status %s Status Code %d", reqID, resp.Status, statusCode)
+		if p.clockSkew.Matches(statusCode, respBody) {
+			p.clockSkew.Report(reqID, resp.Header.Get("Date"))
+			if skewRetried || !p.clockSkew.ShouldRetry() {
+				return statusCode, fmt.Errorf("PostStreamToODS: %w: %s", ErrODSClockSkew, lastErr.Error())
+			}
+			// the one skew retry per post isn't counted against MaxRetries nor ODSRetryBudget
+			skewRetried, skewRetrying = true, true
+			retryCount--
+			continue
+		}
+		if !IsRetriableError(statusCode) {
+			Log("PostStreamToODS::Error:(nonretriable) RequestId %s Status %s Status Code %d", reqID, resp.Status, statusCode)
+			return statusCode, fmt.Errorf("PostStreamToODS: %w: %s", ErrODSNonRetriable, lastErr.Error())
+		}
+		Log("PostStreamToODS::Error:(retriable) RequestId %s Status %s Status Code %d, retryCount: %d", reqID, resp.Status, statusCode, retryCount)
+	}
+	ODSCircuitBreaker.RecordFailure()
+	return statusCode, fmt.Errorf("PostStreamToODS: %w: %v", ErrODSRetriesExhausted, lastErr)
+}
+
+// Ping checks OMSEndpoint can be reached with the current HTTP client (proxy, TLS and cert included), without
+// posting any data. Any response below 500 means the endpoint is up, as it answers a bare HEAD with a client error
+func Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", OMSEndpoint, nil)
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := GetClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("Ping: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Ping: %s responded with %s", OMSEndpoint, resp.Status)
+	}
+	return nil
+}
+
+// PostRecordsToODS posts a batch of json encoded data items of the given data type to OMSEndpoint
+func PostRecordsToODS(ctx context.Context, dataType string, records [][]byte) error {
+	return PostFormattedRecordsToODS(ctx, JSONRecordFormatter{DataType: dataType}, records)
+}
+
+// PostFormattedRecordsToODS posts a batch of json encoded records to OMSEndpoint in the wire format of formatter.
+// Every attempt carries the same ODSIdempotencyKey, if enabled, and the headers given with WithBatchHeader
+func PostFormattedRecordsToODS(ctx context.Context, formatter RecordFormatter, records [][]byte) error {
+	return pluginODSPoster().postFormattedRecords(ctx, formatter, records)
+}
+
+// postFormattedRecords is PostFormattedRecordsToODS to the endpoint of the poster
+func (p *odsPoster) postFormattedRecords(ctx context.Context, formatter RecordFormatter, records [][]byte) error {
+	header, err := getODSRequestHeader(p.resourceID)
+	if err != nil {
+		return fmt.Errorf("PostFormattedRecordsToODS: %w", err)
+	}
+	body, contentType, err := formatter.Format(records)
+	if err != nil {
+		return fmt.Errorf("PostFormattedRecordsToODS: %w", err)
+	}
+	header.Set("Content-Type", contentType)
+	applyBatchHeader(ctx, header)
+	if _, err = p.postPayload(ctx, header, body, len(records)); err != nil {
+		return fmt.Errorf("PostFormattedRecordsToODS: %d records: %w", len(records), err)
+	}
+	return nil
+}
+
+// postJSONPayload posts a json payload of records records marshalled by a flush that doesn't batch (PostDataHelper
+// without a ContainerLogSender, PostTelegrafMetricsToLA and flushKubeMonAgentEventRecords) like a batch: failing fast
+// with ErrCircuitOpen while ODSCircuitBreaker is open, gzipped, checksummed and keyed as configured, and retried by
+// postStream. extraHeader, nil for none, is set over the ODS request headers. It returns the last status code
+func (p *odsPoster) postJSONPayload(ctx context.Context, body []byte, records int, extraHeader http.Header) (int, error) {
+	header, err := getODSRequestHeader(p.resourceID)
+	if err != nil {
+		return 0, fmt.Errorf("postJSONPayload: %w", err)
+	}
+	for name, values := range extraHeader {
+		header[name] = values
+	}
+	statusCode, err := p.postPayload(ctx, header, body, records)
+	if err != nil {
+		return statusCode, fmt.Errorf("postJSONPayload: %d records: %w", records, err)
+	}
+	return statusCode, nil
+}
+
+// postPayload keys, gzips and checksums a formatted payload of records records as configured and posts it, unless
+// its idempotency key was already delivered
+func (p *odsPoster) postPayload(ctx context.Context, header http.Header, body []byte, records int) (int, error) {
+	key := p.idempotency.apply(ctx, header, body)
+	if p.idempotency.Delivered(key) {
+		Log("PostFormattedRecordsToODS::Info::Not posting %d records again, idempotency key %s was already delivered", records, key)
+		return http.StatusOK, nil
+	}
+	payloadBytes := len(body)
+	gzipped := false
+	if p.gzipMinBytes > 0 && len(body) >= p.gzipMinBytes {
+		if compressed, err := gzipPayload(body, p.gzipLevel); err != nil {
+			Log("PostFormattedRecordsToODS::Error::Unable to gzip payload, sending it uncompressed: %s", err.Error())
+		} else {
+			body = compressed
+			gzipped = true
+			header.Set("Content-Encoding", "gzip")
+		}
+	}
+	p.checksum.apply(header, body)
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	statusCode, err := p.postStream(ctx, header, newBody)
+	if err != nil {
+		return statusCode, err
+	}
+	p.idempotency.remember(key)
+	if p.recordPosted != nil {
+		p.recordPosted(records, payloadBytes, len(body), gzipped)
+	}
+	return statusCode, nil
+}
+
+// recordPostedBatch accounts a delivered batch of records in the batch size and compression ratio telemetry.
+// payloadBytes is the size of the formatted payload, postedBytes the size sent once gzipped
+func recordPostedBatch(records int, payloadBytes int, postedBytes int, gzipped bool) {
+	ContainerLogTelemetryMutex.Lock()
+	defer ContainerLogTelemetryMutex.Unlock()
+	ContainerLogsPostedBatchCount++
+	ContainerLogsPostedBatchRecordCount += float64(records)
+	ContainerLogsPostedBatchBytes += float64(payloadBytes)
+	if float64(payloadBytes) > ContainerLogsPostedBatchMaxBytes {
+		ContainerLogsPostedBatchMaxBytes = float64(payloadBytes)
+	}
+	if gzipped {
+		ContainerLogsGzipInputBytes += float64(payloadBytes)
+		ContainerLogsGzipOutputBytes += float64(postedBytes)
+	}
+}
+
+// gzipPayload compresses a payload for Content-Encoding gzip at level, 0 for the default level
+func gzipPayload(body []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getGzipMinBytes returns gzip_min_bytes from the plugin config, payloads smaller than that are sent uncompressed
+// as compressing them costs more CPU than it saves. 0 disables compression
+func getGzipMinBytes(config map[string]string) int {
+	value := config["gzip_min_bytes"]
+	if value == "" {
+		return defaultGzipMinBytes
+	}
+	minBytes, err := strconv.Atoi(value)
+	if err != nil || minBytes < 0 {
+		Log("Invalid value %s for gzip_min_bytes. Using default of %d", value, defaultGzipMinBytes)
+		return defaultGzipMinBytes
+	}
+	return minBytes
+}
+
+// getGzipLevel returns gzip_level from the plugin config, from 1 (fastest) to 9 (smallest payloads)
+func getGzipLevel(config map[string]string) int {
+	value := config["gzip_level"]
+	if value == "" {
+		return defaultGzipLevel
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil || level < gzip.BestSpeed || level > gzip.BestCompression {
+		Log("Invalid value %s for gzip_level. Using default of %d", value, defaultGzipLevel)
+		return defaultGzipLevel
+	}
+	return level
+}
+
+// buildODSPayload wraps the json encoded data items into the blob expected by the ODS endpoint
+func buildODSPayload(dataType string, records [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"DataType":"`)
+	buf.WriteString(dataType)
+	buf.WriteString(`","IPName":"`)
+	buf.WriteString(IPName)
+	buf.WriteString(`","DataItems":[`)
+	for i, record := range records {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(record)
+	}
+	buf.WriteString(`]}`)
+	return buf.Bytes()
+}
+
+// getODSRequestHeader returns the headers common to every post against the ODS endpoint, with resourceID as
+// x-ms-AzureResourceId unless it is empty
+func getODSRequestHeader(resourceID string) (http.Header, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("User-Agent", userAgent)
+	if resourceID != "" {
+		header.Set("x-ms-AzureResourceId", resourceID)
+	}
+	if IsAADMSIAuthMode == true {
+		IngestionAuthTokenUpdateMutex.Lock()
+		ingestionAuthToken := ODSIngestionAuthToken
+		IngestionAuthTokenUpdateMutex.Unlock()
+		if ODSIngestionTokenProvider != nil {
+			var err error
+			if ingestionAuthToken, err = ODSIngestionTokenProvider.Token(); err != nil {
+				return header, err
+			}
+		}
+		if ingestionAuthToken == "" {
+			return header, ErrIngestionAuthTokenEmpty
+		}
+		// add authorization header to the req
+		header.Set("Authorization", "Bearer "+ingestionAuthToken)
+	}
+	return header, nil
+}
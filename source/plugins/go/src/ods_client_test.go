@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"Docker-Provider/source/plugins/go/src/internal/testutil"
+)
+
+func Test_PostStreamToODS(t *testing.T) {
+	const payloadSize = 32 * 1024 * 1024
+	var attempts int32
+	var received int64
+	var chunked bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		// fail the first attempt to make sure the body is re-opened for the retry
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = n
+		chunked = len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+
+	opened := 0
+	newBody := func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(io.LimitReader(&repeatReader{b: []byte(`{"LogEntry":"abc"},`)}, payloadSize)), nil
+	}
+
+	statusCode, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("PostStreamToODS() = (%d, %v), want (200, nil)", statusCode, err)
+	}
+	if opened != 2 {
+		t.Errorf("body factory called %d times, want 2", opened)
+	}
+	if received != payloadSize {
+		t.Errorf("server received %d bytes, want %d", received, payloadSize)
+	}
+	if !chunked {
+		t.Errorf("request was not sent with chunked transfer encoding")
+	}
+}
+
+func Test_PostStreamToODS_NonRetriable(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	statusCode, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+	if !errors.Is(err, ErrODSNonRetriable) || statusCode != http.StatusBadRequest {
+		t.Errorf("PostStreamToODS() = (%d, %v), want (400, ErrODSNonRetriable)", statusCode, err)
+	}
+	if attempts != 1 {
+		t.Errorf("server got %d attempts, want 1", attempts)
+	}
+}
+
+func Test_PostStreamToODS_RetriesExhausted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	_, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+	if !errors.Is(err, ErrODSRetriesExhausted) {
+		t.Errorf("PostStreamToODS() error = %v, want ErrODSRetriesExhausted", err)
+	}
+
+	failingBody := func() (io.ReadCloser, error) {
+		return nil, ErrCertLoad
+	}
+	_, err = PostStreamToODS(context.Background(), server.URL, http.Header{}, failingBody)
+	if !errors.Is(err, ErrCertLoad) {
+		t.Errorf("PostStreamToODS() error = %v, want the body factory error wrapped", err)
+	}
+}
+
+func Test_PostRecordsToODS_RetryThenSuccess(t *testing.T) {
+	server := testutil.NewMockOMSServer(t, testutil.MockOMSOptions{
+		Statuses:        []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+		RequiredHeaders: []string{"Content-Type", "X-Request-ID"},
+	})
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	defer func() { OMSEndpoint = originalEndpoint }()
+
+	records := [][]byte{[]byte(`{"LogMessage":"first"}`), []byte(`{"LogMessage":"second"}`)}
+	if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, records); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+	requests := server.Requests()
+	if len(requests) != 3 {
+		t.Fatalf("server got %d requests, want 3", len(requests))
+	}
+	for _, request := range requests {
+		if id := request.Header.Get("X-Request-ID"); id != requests[0].Header.Get("X-Request-ID") {
+			t.Errorf("retry sent with X-Request-ID %s, want the one of the first attempt", id)
+		}
+	}
+	if got := server.DeliveredDataItems(); len(got) != 2 || got[0] != string(records[0]) || got[1] != string(records[1]) {
+		t.Errorf("server got records %v, want them delivered once", got)
+	}
+}
+
+func Test_PostRecordsToODS_ErrIngestionAuthTokenEmpty(t *testing.T) {
+	IsAADMSIAuthMode = true
+	defer func() { IsAADMSIAuthMode = false }()
+	ODSIngestionAuthToken = ""
+
+	err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, [][]byte{[]byte("{}")})
+	if !errors.Is(err, ErrIngestionAuthTokenEmpty) {
+		t.Errorf("PostRecordsToODS() error = %v, want ErrIngestionAuthTokenEmpty", err)
+	}
+}
+
+func Test_PostRecordsToODS_GzipMinBytes(t *testing.T) {
+	type request struct {
+		encoding string
+		body     []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.Header.Get("Content-Encoding"), body}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	defer func() {
+		OMSEndpoint = originalEndpoint
+		GzipMinBytes = 0
+	}()
+	GzipMinBytes = 1024
+
+	small := [][]byte{[]byte(`{"LogMessage":"small"}`)}
+	if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, small); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+	if got := <-requests; got.encoding != "" || string(got.body) != string(buildODSPayload(ContainerLogV2DataType, small)) {
+		t.Errorf("small payload sent with Content-Encoding %q, body %q, want it uncompressed", got.encoding, got.body)
+	}
+
+	large := [][]byte{[]byte(`{"LogMessage":"` + strings.Repeat("large", 1000) + `"}`)}
+	if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, large); err != nil {
+		t.Fatalf("PostRecordsToODS() error = %v", err)
+	}
+	got := <-requests
+	if got.encoding != "gzip" {
+		t.Fatalf("large payload sent with Content-Encoding %q, want gzip", got.encoding)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(got.body))
+	if err != nil {
+		t.Fatalf("large payload isn't gzipped: %v", err)
+	}
+	if body, _ := ioutil.ReadAll(reader); string(body) != string(buildODSPayload(ContainerLogV2DataType, large)) {
+		t.Errorf("decompressed payload = %q, want the ODS payload", body)
+	}
+}
+
+func Test_getGzipMinBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", defaultGzipMinBytes},
+		{"0", 0},
+		{"4096", 4096},
+		{"-1", defaultGzipMinBytes},
+		{"abc", defaultGzipMinBytes},
+	}
+	for _, tt := range tests {
+		if got := getGzipMinBytes(map[string]string{"gzip_min_bytes": tt.value}); got != tt.want {
+			t.Errorf("getGzipMinBytes(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_PostRecordsToODS_BatchMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	resetMetrics := func() {
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsPostedBatchCount, ContainerLogsPostedBatchRecordCount = 0, 0
+		ContainerLogsPostedBatchBytes, ContainerLogsPostedBatchMaxBytes = 0, 0
+		ContainerLogsGzipInputBytes, ContainerLogsGzipOutputBytes = 0, 0
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	resetMetrics()
+	defer func() {
+		OMSEndpoint = originalEndpoint
+		GzipMinBytes, GzipLevel = 0, 0
+		resetMetrics()
+	}()
+	GzipMinBytes, GzipLevel = 1024, 9
+
+	small := [][]byte{[]byte(`{"LogMessage":"small"}`)}
+	large := [][]byte{[]byte(`{"LogMessage":"` + strings.Repeat("large", 1000) + `"}`), []byte(`{"LogMessage":"second"}`)}
+	for _, batch := range [][][]byte{small, large} {
+		if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, batch); err != nil {
+			t.Fatalf("PostRecordsToODS() error = %v", err)
+		}
+	}
+
+	smallBytes := float64(len(buildODSPayload(ContainerLogV2DataType, small)))
+	largeBytes := float64(len(buildODSPayload(ContainerLogV2DataType, large)))
+	ContainerLogTelemetryMutex.Lock()
+	defer ContainerLogTelemetryMutex.Unlock()
+	if ContainerLogsPostedBatchCount != 2 || ContainerLogsPostedBatchRecordCount != 3 {
+		t.Errorf("posted %v batches of %v records, want 2 batches of 3 records", ContainerLogsPostedBatchCount, ContainerLogsPostedBatchRecordCount)
+	}
+	if ContainerLogsPostedBatchBytes != smallBytes+largeBytes || ContainerLogsPostedBatchMaxBytes != largeBytes {
+		t.Errorf("posted %v bytes, largest batch %v, want %v and %v", ContainerLogsPostedBatchBytes, ContainerLogsPostedBatchMaxBytes, smallBytes+largeBytes, largeBytes)
+	}
+	// only the large batch is gzipped
+	if ContainerLogsGzipInputBytes != largeBytes || ContainerLogsGzipOutputBytes <= 0 || ContainerLogsGzipOutputBytes >= largeBytes/10 {
+		t.Errorf("gzipped %v bytes into %v, want %v bytes compressed at least tenfold", ContainerLogsGzipInputBytes, ContainerLogsGzipOutputBytes, largeBytes)
+	}
+}
+
+func Test_getGzipLevel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", defaultGzipLevel},
+		{"1", 1},
+		{"9", 9},
+		{"0", defaultGzipLevel},
+		{"10", defaultGzipLevel},
+		{"abc", defaultGzipLevel},
+	}
+	for _, tt := range tests {
+		if got := getGzipLevel(map[string]string{"gzip_level": tt.value}); got != tt.want {
+			t.Errorf("getGzipLevel(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// repeatReader endlessly repeats b, so large payloads can be streamed without allocating them
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.b)
+	}
+	return n, nil
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,7 +18,6 @@ import (
 	"time"
 
 	"github.com/fluent/fluent-bit-go/output"
-	"github.com/google/uuid"
 	"github.com/tinylib/msgp/msgp"
 
 	"Docker-Provider/source/plugins/go/src/extension"
@@ -86,11 +85,72 @@ const WindowsContainerLogPluginConfFilePath = "/etc/omsagentwindows/out_oms.conf
 // IPName
 const IPName = "ContainerInsights"
 
+// path of the ODS endpoint data items are posted to
+const odsPostJSONDataItemsPath = "/OperationalData.svc/PostJsonDataItems"
+
 const defaultContainerInventoryRefreshInterval = 60
 
 const kubeMonAgentConfigEventFlushInterval = 60
 const defaultIngestionAuthTokenRefreshIntervalSeconds = 3600
 
+// defaults for the ODS http client timeouts (connect_timeout, response_header_timeout & overall_timeout in the plugin config)
+const defaultHTTPConnectTimeoutSeconds = 30
+const defaultHTTPResponseHeaderTimeoutSeconds = 30
+const defaultHTTPOverallTimeoutSeconds = 30
+
+// default delay before closing the idle connections of a superseded HTTP client (connection_drain_grace_period in the plugin config)
+const defaultConnectionDrainGracePeriodSeconds = 30
+
+// default time to wait at startup for the cert/key files to be mounted, 0 to fail right away (cert_wait_timeout in the plugin config)
+const defaultCertWaitTimeoutSeconds = 0
+
+// default time the buffered records are flushed for on exit (shutdown_grace_period in the plugin config)
+const defaultShutdownGracePeriodSeconds = 5
+
+// default number of TLS sessions cached for resumption against OMSEndpoint (tls_session_cache_size in the plugin config)
+const defaultTLSSessionCacheSize = 64
+
+// default number of retries per second allowed across all posts to OMSEndpoint (retry_budget_refill_rate in the plugin config)
+const defaultRetryBudgetRefillRate = 10
+
+// defaults for the circuit breaker of posts to OMSEndpoint (circuit_breaker_failure_threshold & circuit_breaker_cooldown in the plugin config)
+const defaultCircuitBreakerFailureThreshold = 5
+const defaultCircuitBreakerCooldownSeconds = 30
+
+// default delays of the exponential backoff retrying the spilled batches while posts fail (spillover_retry_initial_delay and spillover_retry_max_delay in the plugin config)
+const defaultSpillRetryInitialDelaySeconds = 5
+const defaultSpillRetryMaxDelaySeconds = 300
+
+// default interval of the check of the cert/key and proxy files for changes (cert_watch_interval in the plugin config)
+const defaultCertWatchIntervalSeconds = 60
+
+// default number of seconds a record waits for the memory budget to free up before it is buffered over it (memory_budget_wait in the plugin config)
+const defaultMemoryBudgetWaitSeconds = 5
+
+// default number of days before the expiry of an endpoint cert SelfCheck warns about it (cert_expiry_warning_days in the plugin config)
+const defaultCertExpiryWarningDays = 14
+
+// default interval at which the plugin config file is checked for changes (config_watch_interval in the plugin config)
+const defaultConfigWatchIntervalSeconds = 30
+
+// default interval of the OMSEndpoint connectivity heartbeat (connectivity_heartbeat_interval in the plugin config)
+const defaultConnectivityHeartbeatIntervalSeconds = 900
+
+// default size from which payloads are gzipped (gzip_min_bytes in the plugin config)
+const defaultGzipMinBytes = 1024
+
+// default compression level of the gzipped payloads, 1 (fastest) to 9 (smallest) (gzip_level in the plugin config)
+const defaultGzipLevel = 6
+
+// default response identifying a clock skew rejection (clock_skew_status_code and clock_skew_body_signature in the plugin config)
+const defaultClockSkewStatusCode = 403
+const defaultClockSkewBodySignature = "RequestTimeTooSkewed"
+
+// defaults for adaptive batching (adaptive_batch_min_count, adaptive_batch_max_count & adaptive_batch_target_latency_ms in the plugin config)
+const defaultAdaptiveBatchMinCount = 10
+const defaultAdaptiveBatchMaxCount = 1000
+const defaultAdaptiveBatchTargetLatencyMs = 1000
+
 //Eventsource name in mdsd
 const MdsdContainerLogSourceName = "ContainerLogSource"
 const MdsdContainerLogV2SourceName = "ContainerLogV2Source"
@@ -111,6 +171,15 @@ const AADMSIAuthMode = "AAD_MSI_AUTH_MODE"
 // Tag prefix of mdsd output streamid for AMA in MSI auth mode
 const MdsdOutputStreamIdTagPrefix = "dcr-"
 
+//env variable selecting the [profile] section of the plugin config applied on top of its unsectioned keys
+const ConfigProfileEnv = "CONFIG_PROFILE"
+
+//env variable overriding log_level of the plugin config
+const LogLevelEnv = "LOG_LEVEL"
+
+//env variable with the proxy endpoint used when neither proxy_url nor the proxy file of the plugin config set one
+const ProxyEnv = "PROXY"
+
 //env variable to container type
 const ContainerTypeEnv = "CONTAINER_TYPE"
 
@@ -120,7 +189,7 @@ const DefaultAdxDatabaseName = "containerinsights"
 var (
 	// PluginConfiguration the plugins configuration
 	PluginConfiguration map[string]string
-	// HTTPClient for making POST requests to OMSEndpoint
+	// HTTPClient for making POST requests to OMSEndpoint (use GetClient, RecreateHTTPClient swaps it on cert rotation)
 	HTTPClient http.Client
 	// Client for MDSD msgp Unix socket
 	MdsdMsgpUnixSocketClient net.Conn
@@ -150,7 +219,7 @@ var (
 	enrichContainerLogs bool
 	// container runtime engine configured on the kubelet
 	containerRuntime string
-	// Proxy endpoint in format http(s)://<user>:<pwd>@<proxyserver>:<port>
+	// Proxy endpoint in format http(s)://<user>:<pwd>@<proxyserver>:<port>, updated by the cert watcher under HTTPClientUpdateMutex
 	ProxyEndpoint string
 	// container log route for routing thru oneagent
 	ContainerLogsRouteV2 bool
@@ -180,6 +249,11 @@ var (
 	ContainerType string
 	// flag to check whether LA AAD MSI Auth Enabled or not
 	IsAADMSIAuthMode bool
+	// ContainerLogSender batches container log records for ODS direct (nil unless batch_max_count or flush_interval configured).
+	// Records handed to it are acknowledged to fluent-bit right away, so fluent-bit no longer retries failed posts:
+	// batches failing with a retriable error are spilled (spillover_path) and retried by the sender, the others are
+	// deadlettered (deadletter_file_path)
+	ContainerLogSender *Sender
 )
 
 var (
@@ -207,8 +281,40 @@ var (
 	ParentContext = context.Background()
 	// IngestionAuthTokenUpdateMutex read and write mutex access for ODSIngestionAuthToken
 	IngestionAuthTokenUpdateMutex = &sync.Mutex{}
-	// ODSIngestionAuthToken for windows agent AAD MSI Auth
+	// ODSIngestionAuthToken for AAD MSI Auth, kept up to date by ODSIngestionTokenProvider
 	ODSIngestionAuthToken string
+	// ODSIngestionTokenProvider fetches and caches the ingestion token in AAD MSI auth mode, nil otherwise
+	ODSIngestionTokenProvider *IngestionTokenProvider
+	// HTTPClientUpdateMutex read and write mutex access for HTTPClient
+	HTTPClientUpdateMutex = &sync.Mutex{}
+	// clientCertificateOverride cert set with SetClientCertificate, used instead of the cert/key files
+	clientCertificateOverride *tls.Certificate
+	// httpClientReloadMutex guards httpClientReloadTimer
+	httpClientReloadMutex = &sync.Mutex{}
+	// httpClientReloadTimer pending retry of a rejected HTTP client reload
+	httpClientReloadTimer *time.Timer
+	// httpClientReloadRetryInterval delay before retrying a rejected HTTP client reload
+	httpClientReloadRetryInterval = 30 * time.Second
+	// certWaitPollInterval delay between attempts to load the cert/key files while waiting for them at startup
+	certWaitPollInterval = time.Second
+	// certWaitLogInterval minimum delay between two progress logs while waiting for the cert/key files
+	certWaitLogInterval = 10 * time.Second
+	// ODSRetryBudget caps the retries of all posts to OMSEndpoint, nil for unlimited retries
+	ODSRetryBudget *RetryBudget
+	// ODSCircuitBreaker tracks consecutive failed posts to OMSEndpoint, nil if disabled
+	ODSCircuitBreaker *CircuitBreaker
+	// ODSClockSkewDetector recognizes posts rejected for clock skew, nil if disabled
+	ODSClockSkewDetector *ClockSkewDetector
+	// GzipMinBytes is the size from which payloads posted to OMSEndpoint are gzipped, 0 to never compress
+	GzipMinBytes int
+	// GzipLevel is the compression level of the gzipped payloads, 0 for the gzip default
+	GzipLevel int
+	// ODSPayloadChecksum adds an integrity header to the posts to OMSEndpoint, nil if disabled
+	ODSPayloadChecksum *PayloadChecksum
+	// ODSIdempotencyKey adds a key deduplicating retried posts to OMSEndpoint, nil if disabled
+	ODSIdempotencyKey *IdempotencyKey
+	// ProcessMemoryBudget caps the memory of the buffers of the process, nil for no limit
+	ProcessMemoryBudget *MemoryBudget
 )
 
 var (
@@ -223,8 +329,10 @@ var (
 var (
 	// FLBLogger stream
 	FLBLogger = createLogger()
-	// Log wrapper function
-	Log = FLBLogger.Printf
+	// Log wrapper function, dropping the messages below the log level
+	Log = leveledLog(FLBLogger.Printf)
+	// logFileWriter rotating log file FLBLogger writes to unless log_output says otherwise
+	logFileWriter io.Writer
 )
 
 var (
@@ -399,20 +507,57 @@ func createLogger() *log.Logger {
 
 	logger := log.New(logfile, "", 0)
 
-	logger.SetOutput(&lumberjack.Logger{
+	rotatingFile := &lumberjack.Logger{
 		Filename:   logPath,
 		MaxSize:    10, //megabytes
 		MaxBackups: 1,
 		MaxAge:     28,   //days
 		Compress:   true, // false by default
-	})
+	}
+	// closing lumberjack makes its next write reopen the file
+	logFileWriter = newReliableLogWriter(rotatingFile, rotatingFile.Close)
+	logger.SetOutput(logFileWriter)
 
 	logger.SetFlags(log.Ltime | log.Lshortfile | log.LstdFlags)
 	return logger
 }
 
+// containerInventoryRefreshIntervalUpdates takes the container_inventory_refresh_interval of a reloaded config
+var containerInventoryRefreshIntervalUpdates = make(chan time.Duration, 1)
+
+// getContainerInventoryRefreshInterval reads container_inventory_refresh_interval (seconds) from the plugin config,
+// defaulting to defaultContainerInventoryRefreshInterval if it is missing or invalid
+func getContainerInventoryRefreshInterval(config map[string]string) time.Duration {
+	containerInventoryRefreshInterval, err := strconv.Atoi(config["container_inventory_refresh_interval"])
+	if err == nil && containerInventoryRefreshInterval <= 0 {
+		err = fmt.Errorf("%d isn't a positive number of seconds", containerInventoryRefreshInterval)
+	}
+	if err != nil {
+		message := fmt.Sprintf("Error Reading Container Inventory Refresh Interval %s", err.Error())
+		Log(message)
+		SendException(message)
+		Log("Using Default Refresh Interval of %d s\n", defaultContainerInventoryRefreshInterval)
+		containerInventoryRefreshInterval = defaultContainerInventoryRefreshInterval
+	}
+	return time.Duration(containerInventoryRefreshInterval) * time.Second
+}
+
+// waitContainerInventoryRefresh waits for the next tick of ContainerImageNameRefreshTicker, restarting it when a
+// reloaded config changes the refresh interval
+func waitContainerInventoryRefresh() {
+	for {
+		select {
+		case <-ContainerImageNameRefreshTicker.C:
+			return
+		case interval := <-containerInventoryRefreshIntervalUpdates:
+			ContainerImageNameRefreshTicker.Stop()
+			ContainerImageNameRefreshTicker = time.NewTicker(interval)
+		}
+	}
+}
+
 func updateContainerImageNameMaps() {
-	for ; true; <-ContainerImageNameRefreshTicker.C {
+	for ; true; waitContainerInventoryRefresh() {
 		Log("Updating ImageIDMap and NameIDMap")
 
 		_imageIDMap := make(map[string]string)
@@ -774,37 +919,14 @@ func flushKubeMonAgentEventRecords() {
 					Log(message)
 					SendException(message)
 				} else {
-					req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(marshalled))
-					req.Header.Set("Content-Type", "application/json")
-					req.Header.Set("User-Agent", userAgent)
-					reqId := uuid.New().String()
-					req.Header.Set("X-Request-ID", reqId)
-					//expensive to do string len for every request, so use a flag
-					if ResourceCentric == true {
-						req.Header.Set("x-ms-AzureResourceId", ResourceID)
-					}
-
-					if IsAADMSIAuthMode == true {
-						IngestionAuthTokenUpdateMutex.Lock()
-						ingestionAuthToken := ODSIngestionAuthToken
-						IngestionAuthTokenUpdateMutex.Unlock()
-						if ingestionAuthToken == "" {
-							Log("Error::ODS Ingestion Auth Token is empty. Please check error log.")
-						}
-						req.Header.Set("Authorization", "Bearer "+ingestionAuthToken)
-					}
-
-					resp, err := HTTPClient.Do(req)
+					poster := pluginODSPoster()
+					// only container logs count in the posted batch telemetry
+					poster.recordPosted = nil
+					_, err := poster.postJSONPayload(context.Background(), marshalled, len(laKubeMonAgentEventsRecords), nil)
 					elapsed = time.Since(start)
 
 					if err != nil {
-						message := fmt.Sprintf("Error when sending kubemonagentevent request %s \n", err.Error())
-						Log(message)
-						Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
-					} else if resp == nil || resp.StatusCode != 200 {
-						if resp != nil {
-							Log("flushKubeMonAgentEventRecords: RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
-						}
+						Log("Error when sending kubemonagentevent request %s", err.Error())
 						Log("Failed to flush %d records after %s", len(laKubeMonAgentEventsRecords), elapsed)
 					} else {
 						numRecords := len(laKubeMonAgentEventsRecords)
@@ -814,9 +936,6 @@ func flushKubeMonAgentEventRecords() {
 						SendEvent(KubeMonAgentEventsFlushedEvent, telemetryDimensions)
 
 					}
-					if resp != nil && resp.Body != nil {
-						defer resp.Body.Close()
-					}
 				}
 			}
 		} else {
@@ -1009,56 +1128,25 @@ func PostTelegrafMetricsToLA(telegrafRecords []map[interface{}]interface{}) int
 		}
 
 		//Post metrics data to LA
-		req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(jsonBytes))
-
-		//req.URL.Query().Add("api-version","2016-04-01")
-
-		//set headers
-		req.Header.Set("x-ms-date", time.Now().Format(time.RFC3339))
-		req.Header.Set("User-Agent", userAgent)
-		reqID := uuid.New().String()
-		req.Header.Set("X-Request-ID", reqID)
-
-		//expensive to do string len for every request, so use a flag
-		if ResourceCentric == true {
-			req.Header.Set("x-ms-AzureResourceId", ResourceID)
-		}
-		if IsAADMSIAuthMode == true {
-			IngestionAuthTokenUpdateMutex.Lock()
-			ingestionAuthToken := ODSIngestionAuthToken
-			IngestionAuthTokenUpdateMutex.Unlock()
-			if ingestionAuthToken == "" {
-				message := "Error::ODS Ingestion Auth Token is empty. Please check error log."
-				Log(message)
-				return output.FLB_RETRY
-			}
-			// add authorization header to the req
-			req.Header.Set("Authorization", "Bearer "+ingestionAuthToken)
-		}
-
+		poster := pluginODSPoster()
+		// only container logs count in the posted batch telemetry
+		poster.recordPosted = nil
+		header := http.Header{}
+		header.Set("x-ms-date", time.Now().Format(time.RFC3339))
 		start := time.Now()
-		resp, err := HTTPClient.Do(req)
+		statusCode, err := poster.postJSONPayload(context.Background(), jsonBytes, len(laMetrics), header)
 		elapsed := time.Since(start)
 
 		if err != nil {
-			message := fmt.Sprintf("PostTelegrafMetricsToLA::Error:(retriable) when sending %v metrics. duration:%v err:%q \n", len(laMetrics), elapsed, err.Error())
-			Log(message)
-			UpdateNumTelegrafMetricsSentTelemetry(0, 1, 0, 0)
-			return output.FLB_RETRY
-		}
-
-		if resp == nil || resp.StatusCode != 200 {
-			if resp != nil {
-				Log("PostTelegrafMetricsToLA::Error:(retriable) RequestID %s Response Status %v Status Code %v", reqID, resp.Status, resp.StatusCode)
-			}
-			if resp != nil && resp.StatusCode == 429 {
+			Log("PostTelegrafMetricsToLA::Error:(retriable) when sending %v metrics. duration:%v err:%q", len(laMetrics), elapsed, err.Error())
+			if statusCode == 0 {
+				UpdateNumTelegrafMetricsSentTelemetry(0, 1, 0, 0)
+			} else if statusCode == 429 {
 				UpdateNumTelegrafMetricsSentTelemetry(0, 1, 1, 0)
 			}
 			return output.FLB_RETRY
 		}
 
-		defer resp.Body.Close()
-
 		numMetrics := len(laMetrics)
 		UpdateNumTelegrafMetricsSentTelemetry(numMetrics, 0, 0, numWinMetricsWithTagsSize64KBorMore)
 		Log("PostTelegrafMetricsToLA::Info:Successfully flushed %v records in %v", numMetrics, elapsed)
@@ -1395,6 +1483,36 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			}
 		}
 
+		if ContainerLogSender != nil {
+			// the sender posts the batch once batch_max_count records are buffered or flush_interval elapsed. FLB_OK
+			// is returned whatever the outcome of the post, failed batches are spilled or deadlettered by the sender
+			var items []interface{}
+			if recordType == "ContainerLogV2" {
+				for i := range dataItemsLAv2 {
+					items = append(items, dataItemsLAv2[i])
+				}
+			} else {
+				for i := range dataItemsLAv1 {
+					items = append(items, dataItemsLAv1[i])
+				}
+			}
+			for _, item := range items {
+				record, err := json.Marshal(item)
+				if err != nil {
+					message := fmt.Sprintf("Error while Marshalling log Entry: %s", err.Error())
+					Log(message)
+					SendException(message)
+					continue
+				}
+				ContainerLogSender.Enqueue(record)
+				numContainerLogRecords++
+			}
+			elapsed = time.Since(start)
+			Log("PostDataHelper::Info::Enqueued %d %s records for batching in %s", numContainerLogRecords, recordType, elapsed)
+			updateFlushTelemetry(numContainerLogRecords, elapsed, maxLatency, maxLatencyContainer)
+			return output.FLB_OK
+		}
+
 		marshalled, err := json.Marshal(logEntry)
 		//Log("LogEntry::e %s", marshalled)
 		if err != nil {
@@ -1404,29 +1522,7 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			return output.FLB_OK
 		}
 
-		req, _ := http.NewRequest("POST", OMSEndpoint, bytes.NewBuffer(marshalled))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", userAgent)
-		reqId := uuid.New().String()
-		req.Header.Set("X-Request-ID", reqId)
-		//expensive to do string len for every request, so use a flag
-		if ResourceCentric == true {
-			req.Header.Set("x-ms-AzureResourceId", ResourceID)
-		}
-
-		if IsAADMSIAuthMode == true {
-			IngestionAuthTokenUpdateMutex.Lock()
-			ingestionAuthToken := ODSIngestionAuthToken
-			IngestionAuthTokenUpdateMutex.Unlock()
-			if ingestionAuthToken == "" {
-				Log("Error::ODS Ingestion Auth Token is empty. Please check error log.")
-				return output.FLB_RETRY
-			}
-			// add authorization header to the req
-			req.Header.Set("Authorization", "Bearer "+ingestionAuthToken)
-		}
-
-		resp, err := HTTPClient.Do(req)
+		_, err = pluginODSPoster().postJSONPayload(context.Background(), marshalled, loglinesCount, nil)
 		elapsed = time.Since(start)
 
 		if err != nil {
@@ -1440,19 +1536,17 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			return output.FLB_RETRY
 		}
 
-		if resp == nil || resp.StatusCode != 200 {
-			if resp != nil {
-				Log("RequestId %s Status %s Status Code %d", reqId, resp.Status, resp.StatusCode)
-			}
-			return output.FLB_RETRY
-		}
-
-		defer resp.Body.Close()
 		numContainerLogRecords = loglinesCount
 		Log("PostDataHelper::Info::Successfully flushed %d %s records to ODS in %s", numContainerLogRecords, recordType, elapsed)
 
 	}
 
+	updateFlushTelemetry(numContainerLogRecords, elapsed, maxLatency, maxLatencyContainer)
+	return output.FLB_OK
+}
+
+// updateFlushTelemetry accounts the container log records flushed (or enqueued for batching) by PostDataHelper
+func updateFlushTelemetry(numContainerLogRecords int, elapsed time.Duration, maxLatency float64, maxLatencyContainer string) {
 	ContainerLogTelemetryMutex.Lock()
 	defer ContainerLogTelemetryMutex.Unlock()
 
@@ -1465,8 +1559,6 @@ func PostDataHelper(tailPluginRecords []map[interface{}]interface{}) int {
 			AgentLogProcessingMaxLatencyMsContainer = maxLatencyContainer
 		}
 	}
-
-	return output.FLB_OK
 }
 
 func containsKey(currentMap map[string]bool, key string) bool {
@@ -1521,6 +1613,11 @@ func GetContainerIDK8sNamespacePodNameFromFileName(filename string) (string, str
 	return id, ns, podName, containerName
 }
 
+// logPluginConfiguration logs the plugin config read at startup, redacted by DumpConfiguration
+func logPluginConfiguration(config map[string]string) {
+	Log("Plugin configuration: %s", DumpConfiguration(config))
+}
+
 // InitializePlugin reads and populates plugin configuration
 func InitializePlugin(pluginConfPath string, agentVersion string) {
 	go func() {
@@ -1552,7 +1649,7 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		Log("ContainerLogEnrichment=false \n")
 	}
 
-	pluginConfig, err := ReadConfiguration(pluginConfPath)
+	pluginConfig, err := readPluginConfiguration(pluginConfPath)
 	if err != nil {
 		message := fmt.Sprintf("Error Reading plugin config path : %s \n", err.Error())
 		Log(message)
@@ -1560,6 +1657,21 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		time.Sleep(30 * time.Second)
 		log.Fatalln(message)
 	}
+	ApplyLogOutput(pluginConfig)
+	ApplyLogLevel(pluginConfig)
+	validation := ValidateConfig(pluginConfig)
+	for _, warning := range validation.Warnings {
+		Log("Config::Warning::%s", warning)
+	}
+	if validation.HasErrors() {
+		message := fmt.Sprintf("Invalid plugin config %s: %v", pluginConfPath, validation.Errors)
+		Log(message)
+		SendException(message)
+		time.Sleep(30 * time.Second)
+		log.Fatalln(message)
+	}
+	applyDeprecatedConfigKeys(pluginConfig)
+	logPluginConfiguration(pluginConfig)
 
 	ContainerType = os.Getenv(ContainerTypeEnv)
 	Log("Container Type %s", ContainerType)
@@ -1585,7 +1697,14 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 			time.Sleep(30 * time.Second)
 			log.Fatalln(message)
 		}
-		OMSEndpoint = "https://" + WorkspaceID + ".ods." + LogAnalyticsWorkspaceDomain + "/OperationalData.svc/PostJsonDataItems"
+		OMSEndpoint, err = BuildEndpointURL(map[string]string{"workspace_id": WorkspaceID, "domain": LogAnalyticsWorkspaceDomain})
+		if err != nil {
+			message := fmt.Sprintf("Error building OMSEndpoint: %s", err.Error())
+			Log(message)
+			SendException(message)
+			time.Sleep(30 * time.Second)
+			log.Fatalln(message)
+		}
 		// Populate Computer field
 		containerHostName, err1 := ioutil.ReadFile(pluginConfig["container_host_file_path"])
 		if err1 != nil {
@@ -1597,34 +1716,37 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		} else {
 			Computer = strings.TrimSuffix(ToString(containerHostName), "\n")
 		}
-		// read proxyendpoint if proxy configured
-		ProxyEndpoint = ""
-		proxySecretPath := pluginConfig["omsproxy_secret_path"]
-		if _, err := os.Stat(proxySecretPath); err == nil {
-			Log("Reading proxy configuration for Linux from %s", proxySecretPath)
-			proxyConfig, err := ioutil.ReadFile(proxySecretPath)
-			if err != nil {
-				message := fmt.Sprintf("Error Reading omsproxy configuration %s\n", err.Error())
-				Log(message)
-				// if we fail to read proxy secret, AI telemetry might not be working as well
-				SendException(message)
-			} else {
-				ProxyEndpoint = strings.TrimSpace(string(proxyConfig))
-			}
-		}
 	} else {
 		// windows
 		IsWindows = true
 		Computer = os.Getenv("HOSTNAME")
 		WorkspaceID = os.Getenv("WSID")
 		logAnalyticsDomain := os.Getenv("DOMAIN")
-		ProxyEndpoint = os.Getenv("PROXY")
-		OMSEndpoint = "https://" + WorkspaceID + ".ods." + logAnalyticsDomain + "/OperationalData.svc/PostJsonDataItems"
+		OMSEndpoint, err = BuildEndpointURL(map[string]string{"workspace_id": WorkspaceID, "domain": logAnalyticsDomain})
+		if err != nil {
+			message := fmt.Sprintf("Error building OMSEndpoint: %s", err.Error())
+			Log(message)
+			SendException(message)
+			time.Sleep(30 * time.Second)
+			log.Fatalln(message)
+		}
+	}
+
+	// read proxyendpoint if proxy configured
+	var proxySource string
+	ProxyEndpoint, proxySource, err = getProxyEndpoint(pluginConfig)
+	if err != nil {
+		message := fmt.Sprintf("Error Reading omsproxy configuration %s\n", err.Error())
+		Log(message)
+		// if we fail to read proxy secret, AI telemetry might not be working as well
+		SendException(message)
+	} else if ProxyEndpoint != "" {
+		Log("Using the proxy configured with %s", proxySource)
 	}
 
 	Log("OMSEndpoint %s", OMSEndpoint)
 	IsAADMSIAuthMode = false
-	if strings.Compare(strings.ToLower(os.Getenv(AADMSIAuthMode)), "true") == 0 {
+	if isAADMSIAuthModeConfigured(pluginConfig) {
 		IsAADMSIAuthMode = true
 		Log("AAD MSI Auth Mode Configured")
 	}
@@ -1663,16 +1785,9 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	Log("Usage-Agent = %s \n", userAgent)
 
 	// Initialize image,name map refresh ticker
-	containerInventoryRefreshInterval, err := strconv.Atoi(pluginConfig["container_inventory_refresh_interval"])
-	if err != nil {
-		message := fmt.Sprintf("Error Reading Container Inventory Refresh Interval %s", err.Error())
-		Log(message)
-		SendException(message)
-		Log("Using Default Refresh Interval of %d s\n", defaultContainerInventoryRefreshInterval)
-		containerInventoryRefreshInterval = defaultContainerInventoryRefreshInterval
-	}
-	Log("containerInventoryRefreshInterval = %d \n", containerInventoryRefreshInterval)
-	ContainerImageNameRefreshTicker = time.NewTicker(time.Second * time.Duration(containerInventoryRefreshInterval))
+	containerInventoryRefreshInterval := getContainerInventoryRefreshInterval(pluginConfig)
+	Log("containerInventoryRefreshInterval = %s \n", containerInventoryRefreshInterval)
+	ContainerImageNameRefreshTicker = time.NewTicker(containerInventoryRefreshInterval)
 
 	Log("kubeMonAgentConfigEventFlushInterval = %d \n", kubeMonAgentConfigEventFlushInterval)
 	KubeMonAgentConfigEventsSendTicker = time.NewTicker(time.Minute * time.Duration(kubeMonAgentConfigEventFlushInterval))
@@ -1702,6 +1817,9 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	}
 
 	PluginConfiguration = pluginConfig
+	StartConfigReloadOnSignal(pluginConfPath)
+	StartConfigWatcher(pluginConfPath, PluginConfiguration)
+	StartDiagnosticsServer(PluginConfiguration)
 
 	ContainerLogsRoute := strings.TrimSpace(strings.ToLower(os.Getenv("AZMON_CONTAINER_LOGS_ROUTE")))
 	Log("AZMON_CONTAINER_LOGS_ROUTE:%s", ContainerLogsRoute)
@@ -1759,6 +1877,8 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		fmt.Fprintf(os.Stdout, "Routing container logs thru %s route... \n", ContainerLogsRoute)
 	}
 
+	// before the idempotency key, whose delivered keys draw from it
+	ProcessMemoryBudget = getMemoryBudget(PluginConfiguration)
 	if ContainerLogsRouteV2 == true {
 		CreateMDSDClient(ContainerLogV2, ContainerType)
 	} else if ContainerLogsRouteADX == true {
@@ -1766,6 +1886,16 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	} else { // v1 or windows
 		Log("Creating HTTP Client since either OS Platform is Windows or configmap configured with fallback option for ODS direct")
 		CreateHTTPClient()
+		ODSRetryBudget = getRetryBudget(PluginConfiguration)
+		ODSCircuitBreaker = getCircuitBreaker(PluginConfiguration)
+		ODSClockSkewDetector = getClockSkewDetector(PluginConfiguration)
+		GzipMinBytes = getGzipMinBytes(PluginConfiguration)
+		GzipLevel = getGzipLevel(PluginConfiguration)
+		ODSPayloadChecksum = getPayloadChecksum(PluginConfiguration)
+		ODSIdempotencyKey = getIdempotencyKey(PluginConfiguration)
+		StartConnectivityHeartbeat(PluginConfiguration)
+		StartSelfCheck(PluginConfiguration)
+		StartCertWatcher(PluginConfiguration)
 	}
 
 	if IsWindows == false { // mdsd linux specific
@@ -1802,6 +1932,19 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 		Log("Running in replicaset. Disabling container enrichment caching & updates \n")
 	}
 
+	if ContainerLogsRouteV2 != true && ContainerLogsRouteADX != true {
+		batchMaxCount, batchMaxAge, batchingEnabled := getSenderBatchSettings(PluginConfiguration)
+		if batchingEnabled {
+			dataType := ContainerLogDataType
+			if ContainerLogSchemaV2 == true {
+				dataType = ContainerLogV2DataType
+			}
+			Log("Batching container logs for ODS: batch_max_count = %d, flush_interval = %s \n", batchMaxCount, batchMaxAge)
+			ContainerLogSender = newSender(dataType, batchMaxCount, batchMaxAge)
+			ContainerLogSender.configure(PluginConfiguration)
+		}
+	}
+
 	if ContainerLogSchemaV2 == true {
 		MdsdContainerLogTagName = MdsdContainerLogV2SourceName
 	} else {
@@ -1811,9 +1954,10 @@ func InitializePlugin(pluginConfPath string, agentVersion string) {
 	MdsdInsightsMetricsTagName = MdsdInsightsMetricsSourceName
 	MdsdKubeMonAgentEventsTagName = MdsdKubeMonAgentEventsSourceName
 	Log("ContainerLogsRouteADX: %v, IsWindows: %v, IsAADMSIAuthMode = %v \n", ContainerLogsRouteADX, IsWindows, IsAADMSIAuthMode)
-	if !ContainerLogsRouteADX && IsWindows && IsAADMSIAuthMode {
-		Log("defaultIngestionAuthTokenRefreshIntervalSeconds = %d \n", defaultIngestionAuthTokenRefreshIntervalSeconds)
-		IngestionAuthTokenRefreshTicker = time.NewTicker(time.Second * time.Duration(defaultIngestionAuthTokenRefreshIntervalSeconds))
+	// linux posts through mdsd in AAD MSI auth mode unless container logs go to ODS direct
+	if !ContainerLogsRouteADX && IsAADMSIAuthMode && (IsWindows || ContainerLogsRouteV2 != true) {
+		ODSIngestionTokenProvider = getIngestionTokenProvider(PluginConfiguration)
+		IngestionAuthTokenRefreshTicker = time.NewTicker(ingestionTokenCheckInterval)
 		go refreshIngestionAuthToken()
 	}
 }
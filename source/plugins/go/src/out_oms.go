@@ -6,6 +6,7 @@ import (
 )
 import (
 	"C"
+	"context"
 	"os"
 	"strings"
 	"unsafe"
@@ -83,6 +84,12 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 func FLBPluginExit() int {
 	ContainerLogTelemetryTicker.Stop()
 	ContainerImageNameRefreshTicker.Stop()
+	if ContainerLogSender != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), getShutdownGracePeriod(PluginConfiguration))
+		delivered, undelivered := ContainerLogSender.Shutdown(ctx)
+		cancel()
+		Log("Flushed %d buffered records on exit, %d handled by shutdown_on_timeout %s", delivered, undelivered, ContainerLogSender.shutdownPolicy)
+	}
 	return output.FLB_OK
 }
 
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// payload_checksum values and the header each is sent in unless payload_checksum_header is set
+const (
+	payloadChecksumSHA256 = "sha256"
+	payloadChecksumMD5    = "md5"
+
+	defaultSHA256ChecksumHeader = "x-content-sha256"
+	defaultMD5ChecksumHeader    = "Content-MD5"
+)
+
+// PayloadChecksum adds a base64 encoded hash of the body to every post, so the endpoint can verify the payload
+// wasn't corrupted. It hashes the body as sent on the wire, i.e. after compression. A nil checksum adds nothing
+type PayloadChecksum struct {
+	algorithm string
+	header    string
+	newHash   func() hash.Hash
+}
+
+// apply sets the checksum header of body
+func (c *PayloadChecksum) apply(header http.Header, body []byte) {
+	if c == nil {
+		return
+	}
+	h := c.newHash()
+	h.Write(body)
+	header.Set(c.header, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// getPayloadChecksum creates the checksum from payload_checksum (sha256 or md5, none by default) and
+// payload_checksum_header in the plugin config
+func getPayloadChecksum(config map[string]string) *PayloadChecksum {
+	checksum := &PayloadChecksum{header: strings.TrimSpace(config["payload_checksum_header"])}
+	switch algorithm := strings.ToLower(strings.TrimSpace(config["payload_checksum"])); algorithm {
+	case "":
+		return nil
+	case payloadChecksumSHA256:
+		checksum.algorithm = algorithm
+		checksum.newHash = sha256.New
+		if checksum.header == "" {
+			checksum.header = defaultSHA256ChecksumHeader
+		}
+	case payloadChecksumMD5:
+		checksum.algorithm = algorithm
+		checksum.newHash = md5.New
+		if checksum.header == "" {
+			checksum.header = defaultMD5ChecksumHeader
+		}
+	default:
+		Log("Invalid value %s for payload_checksum. Not adding a payload checksum", algorithm)
+		return nil
+	}
+	Log("Adding the %s checksum of every payload in the %s header", checksum.algorithm, checksum.header)
+	return checksum
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_PostRecordsToODS_PayloadChecksum(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.Header, body}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	defer func() {
+		OMSEndpoint = originalEndpoint
+		GzipMinBytes = 0
+		ODSPayloadChecksum = nil
+	}()
+	_, restore := captureLog()
+	defer restore()
+
+	sha256Sum := func(body []byte) string {
+		sum := sha256.Sum256(body)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	md5Sum := func(body []byte) string {
+		sum := md5.Sum(body)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	tests := []struct {
+		name         string
+		config       map[string]string
+		gzipMinBytes int
+		header       string
+		sum          func([]byte) string
+	}{
+		{"sha256", map[string]string{"payload_checksum": "sha256"}, 0, "x-content-sha256", sha256Sum},
+		{"sha256 of the gzipped body", map[string]string{"payload_checksum": "SHA256"}, 1, "x-content-sha256", sha256Sum},
+		{"md5", map[string]string{"payload_checksum": "md5"}, 0, "Content-MD5", md5Sum},
+		{"custom header", map[string]string{"payload_checksum": "sha256", "payload_checksum_header": "x-ms-content-sha256"}, 0, "x-ms-content-sha256", sha256Sum},
+	}
+	records := [][]byte{[]byte(`{"LogMessage":"` + strings.Repeat("a", 100) + `"}`)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ODSPayloadChecksum = getPayloadChecksum(tt.config)
+			GzipMinBytes = tt.gzipMinBytes
+			if err := PostRecordsToODS(context.Background(), ContainerLogV2DataType, records); err != nil {
+				t.Fatalf("PostRecordsToODS() error = %v", err)
+			}
+			got := <-requests
+			if tt.gzipMinBytes > 0 && got.header.Get("Content-Encoding") != "gzip" {
+				t.Fatalf("payload wasn't gzipped")
+			}
+			if checksum, want := got.header.Get(tt.header), tt.sum(got.body); checksum != want {
+				t.Errorf("%s = %q, want %q computed from the received body", tt.header, checksum, want)
+			}
+		})
+	}
+}
+
+func Test_getPayloadChecksum(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	if getPayloadChecksum(map[string]string{}) != nil {
+		t.Errorf("getPayloadChecksum() without payload_checksum isn't disabled")
+	}
+	if getPayloadChecksum(map[string]string{"payload_checksum": "crc32"}) != nil {
+		t.Errorf("getPayloadChecksum() with an unsupported algorithm isn't disabled")
+	}
+	// a nil checksum adds no header
+	header := http.Header{}
+	var checksum *PayloadChecksum
+	checksum.apply(header, []byte("{}"))
+	if len(header) != 0 {
+		t.Errorf("nil checksum set headers %v", header)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PostPacer spaces the posts of a Sender at least interval apart, smoothing bursts into a steady trickle for
+// endpoints that throttle aggressively. Unlike the retry budget it applies to every post, successful ones included.
+// Posts reserve consecutive slots, so concurrent posts are queued one interval after the other, and records enqueued
+// while a post waits for its slot are buffered for the next batch
+type PostPacer struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	// earliest time the next post may start
+	next time.Time
+	// clock and sleep, replaced in tests
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewPostPacer creates a pacer spacing posts interval apart
+func NewPostPacer(interval time.Duration) *PostPacer {
+	return &PostPacer{interval: interval, now: time.Now, sleep: sleepContext}
+}
+
+// Wait blocks until the next post may start, returning ctx.Err() if ctx is done first. A nil pacer never waits
+func (p *PostPacer) Wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	now := p.now()
+	start := p.next
+	if start.Before(now) {
+		start = now
+	}
+	p.next = start.Add(p.interval)
+	p.mutex.Unlock()
+
+	if delay := start.Sub(now); delay > 0 {
+		return p.sleep(ctx, delay)
+	}
+	return ctx.Err()
+}
+
+// sleepContext sleeps for d, returning early with ctx.Err() if ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// getPostPacer creates the pacer from min_post_interval in the plugin config, in seconds or as a duration (500ms).
+// Returns nil, not pacing posts, if it isn't set, 0 or invalid
+func getPostPacer(config map[string]string) *PostPacer {
+	value := strings.TrimSpace(config["min_post_interval"])
+	if value == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(value)
+	if seconds, atoiErr := strconv.Atoi(value); atoiErr == nil {
+		interval, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil || interval < 0 {
+		Log("Invalid value %s for min_post_interval. Not pacing posts", value)
+		return nil
+	}
+	if interval == 0 {
+		return nil
+	}
+	Log("Pacing posts at least %s apart", interval)
+	return NewPostPacer(interval)
+}
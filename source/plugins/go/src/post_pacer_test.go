@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_Sender_MinPostInterval(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	now := time.Unix(1000, 0)
+	var slept []time.Duration
+	pacer := NewPostPacer(2 * time.Second)
+	pacer.now = func() time.Time { return now }
+	pacer.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		now = now.Add(d)
+		return nil
+	}
+	s := newSender(ContainerLogDataType, 1, 0)
+	s.pacer = pacer
+	var posts []time.Time
+	s.post = func(ctx context.Context, records [][]byte) error {
+		posts = append(posts, now)
+		// the post itself takes a while
+		now = now.Add(500 * time.Millisecond)
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		s.Enqueue([]byte(`{"LogEntry":"burst"}`))
+	}
+	// after an idle period the next post goes out right away
+	now = now.Add(10 * time.Second)
+	s.Enqueue([]byte(`{"LogEntry":"after idle"}`))
+
+	if len(posts) != 4 {
+		t.Fatalf("got %d posts, want 4", len(posts))
+	}
+	for i := 1; i < len(posts); i++ {
+		if gap := posts[i].Sub(posts[i-1]); gap < 2*time.Second {
+			t.Errorf("post %d started %s after the previous one, want at least 2s", i, gap)
+		}
+	}
+	if want := []time.Duration{1500 * time.Millisecond, 1500 * time.Millisecond}; len(slept) != len(want) || slept[0] != want[0] || slept[1] != want[1] {
+		t.Errorf("pacer slept %v, want %v", slept, want)
+	}
+}
+
+func Test_PostPacer_Wait(t *testing.T) {
+	var p *PostPacer
+	if err := p.Wait(context.Background()); err != nil {
+		t.Errorf("nil PostPacer Wait() = %v, want nil", err)
+	}
+
+	p = NewPostPacer(time.Hour)
+	if err := p.Wait(context.Background()); err != nil {
+		t.Fatalf("first Wait() = %v, want no wait", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() for a slot an hour away = %v, want the context deadline", err)
+	}
+}
+
+func Test_getPostPacer(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"2", 2 * time.Second},
+		{"250ms", 250 * time.Millisecond},
+		{"-1", 0},
+		{"fast", 0},
+	}
+	for _, tt := range tests {
+		p := getPostPacer(map[string]string{"min_post_interval": tt.value})
+		got := time.Duration(0)
+		if p != nil {
+			got = p.interval
+		}
+		if got != tt.want {
+			t.Errorf("getPostPacer(%q) interval = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// in-cluster destinations always reached without the proxy: services, the API server and IMDS
+const defaultProxyBypass = ".svc,.cluster.local,169.254.169.254"
+
+// ProxyBypass is a NO_PROXY style list of destinations reached without the proxy. An entry is a host name matching
+// itself and its subdomains ("example.com"), a domain matching only its subdomains (".example.com"), an IP address,
+// a CIDR range of addresses or "*" for every destination. Ports of entries are ignored
+type ProxyBypass struct {
+	all     bool
+	domains []string
+	hosts   []string
+	ips     []net.IP
+	nets    []*net.IPNet
+}
+
+// ParseProxyBypass parses a comma or space separated bypass list
+func ParseProxyBypass(list string) ProxyBypass {
+	var bypass ProxyBypass
+	for _, entry := range strings.FieldsFunc(strings.ToLower(list), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if entry == "*" {
+			bypass.all = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			bypass.nets = append(bypass.nets, ipNet)
+			continue
+		}
+		if host, _, err := net.SplitHostPort(entry); err == nil {
+			entry = host
+		}
+		entry = strings.Trim(entry, "[]")
+		if ip := net.ParseIP(entry); ip != nil {
+			bypass.ips = append(bypass.ips, ip)
+		} else if strings.HasPrefix(entry, ".") {
+			bypass.domains = append(bypass.domains, entry)
+		} else if entry != "" {
+			bypass.hosts = append(bypass.hosts, entry)
+		}
+	}
+	return bypass
+}
+
+// Matches reports whether requests to host (without port) bypass the proxy
+func (b ProxyBypass) Matches(host string) bool {
+	if b.all {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		for _, bypassed := range b.ips {
+			if bypassed.Equal(ip) {
+				return true
+			}
+		}
+		for _, ipNet := range b.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, domain := range b.domains {
+		if strings.HasSuffix(host, domain) {
+			return true
+		}
+	}
+	for _, bypassed := range b.hosts {
+		if host == bypassed || strings.HasSuffix(host, "."+bypassed) {
+			return true
+		}
+	}
+	return false
+}
+
+// withProxyBypass returns a transport Proxy function sending the requests to bypassed hosts directly and the others
+// through proxy
+func withProxyBypass(bypass ProxyBypass, proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass.Matches(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxy(req)
+	}
+}
+
+// getProxyBypass returns the destinations never reached through the proxy: the in-cluster defaults and the API
+// server (KUBERNETES_SERVICE_HOST), proxy_bypass in the plugin config and the NO_PROXY env variable
+func getProxyBypass(config map[string]string) ProxyBypass {
+	lists := []string{defaultProxyBypass, os.Getenv("KUBERNETES_SERVICE_HOST"), config["proxy_bypass"], os.Getenv("NO_PROXY")}
+	if noProxy := os.Getenv("no_proxy"); noProxy != os.Getenv("NO_PROXY") {
+		lists = append(lists, noProxy)
+	}
+	return ParseProxyBypass(strings.Join(lists, ","))
+}
+
+// applyProxyCredentials sets the credentials of the omsproxy_credentials_path file ("user:password") on a proxy
+// endpoint without any, so they are sent as Proxy-Authorization. Credentials in the endpoint url take precedence
+func applyProxyCredentials(config map[string]string, proxyURL *url.URL) error {
+	credentialsPath := strings.TrimSpace(config["omsproxy_credentials_path"])
+	if credentialsPath == "" || proxyURL.User != nil {
+		return nil
+	}
+	content, err := ioutil.ReadFile(credentialsPath)
+	if err != nil {
+		return fmt.Errorf("reading the proxy credentials: %w", err)
+	}
+	credentials := strings.TrimSpace(string(content))
+	separator := strings.Index(credentials, ":")
+	if separator <= 0 {
+		return fmt.Errorf("the proxy credentials in %s aren't formatted user:password", credentialsPath)
+	}
+	proxyURL.User = url.UserPassword(credentials[:separator], credentials[separator+1:])
+	return nil
+}
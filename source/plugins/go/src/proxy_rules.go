@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// proxyRuleDirect is the proxy of a rule for destinations reached without a proxy
+const proxyRuleDirect = "DIRECT"
+
+// ProxyRule routes requests to destination hosts matching Pattern through ProxyURL, or directly if ProxyURL is nil
+type ProxyRule struct {
+	// Pattern is a host name or a glob matched against the lower cased destination host (e.g. *.ods.opinsights.azure.com)
+	Pattern  string
+	ProxyURL *url.URL
+}
+
+// ReadProxyRules reads the proxy rule file configured with proxy_rules_path. Every line holds a host pattern and the
+// proxy url to use for it, or DIRECT, separated by whitespace. Empty lines and lines starting with # are ignored
+func ReadProxyRules(filePath string) ([]ProxyRule, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("ReadProxyRules: %w", err)
+	}
+	defer file.Close()
+
+	var rules []ProxyRule
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ReadProxyRules: %s line %d: want a host pattern and a proxy, got %q", filePath, lineNumber, line)
+		}
+		pattern := strings.ToLower(fields[0])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("ReadProxyRules: %s line %d: invalid host pattern %q: %w", filePath, lineNumber, fields[0], err)
+		}
+		rule := ProxyRule{Pattern: pattern}
+		if !strings.EqualFold(fields[1], proxyRuleDirect) {
+			proxyURL, err := url.Parse(fields[1])
+			if err != nil || proxyURL.Host == "" {
+				return nil, fmt.Errorf("ReadProxyRules: %s line %d: invalid proxy url %q", filePath, lineNumber, fields[1])
+			}
+			rule.ProxyURL = proxyURL
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadProxyRules: %w", err)
+	}
+	return rules, nil
+}
+
+// proxyFromRules returns a transport Proxy function applying the first rule matching the destination host.
+// Requests to hosts no rule matches go through fallback, or directly if fallback is nil
+func proxyFromRules(rules []ProxyRule, fallback *url.URL) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		for _, rule := range rules {
+			if matched, _ := path.Match(rule.Pattern, host); matched {
+				return rule.ProxyURL, nil
+			}
+		}
+		return fallback, nil
+	}
+}
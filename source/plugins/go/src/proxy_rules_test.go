@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func proxyForHost(t *testing.T, client http.Client, host string) string {
+	proxy := client.Transport.(*http.Transport).Proxy
+	if proxy == nil {
+		return ""
+	}
+	req, err := http.NewRequest("POST", "https://"+host+"/OperationalData.svc/PostJsonDataItems", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL, err := proxy(req)
+	if err != nil {
+		t.Fatalf("Proxy(%s) error = %v", host, err)
+	}
+	if proxyURL == nil {
+		return ""
+	}
+	return proxyURL.String()
+}
+
+func Test_newHTTPClient_ProxyRules(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "proxy-rules")
+	rules := "# ingestion goes through the regional proxy\n" +
+		"*.ods.opinsights.azure.com http://regional-proxy:3128\n" +
+		"\n" +
+		"*.internal.example.test   DIRECT\n"
+	if err := ioutil.WriteFile(rulesPath, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ProxyEndpoint = "http://default-proxy:8080"
+	defer func() {
+		ProxyEndpoint = ""
+		PluginConfiguration = nil
+	}()
+
+	PluginConfiguration = map[string]string{"proxy_rules_path": rulesPath}
+	client := newHTTPClient(nil)
+	tests := []struct {
+		host  string
+		proxy string
+	}{
+		{"WorkspaceId.ODS.opinsights.azure.com", "http://regional-proxy:3128"},
+		{"ingest.internal.example.test", ""},
+		{"dc.services.visualstudio.com", "http://default-proxy:8080"},
+	}
+	for _, tt := range tests {
+		if got := proxyForHost(t, client, tt.host); got != tt.proxy {
+			t.Errorf("proxy for %s = %q, want %q", tt.host, got, tt.proxy)
+		}
+	}
+
+	// without a rule file every request goes through the proxy endpoint
+	PluginConfiguration = map[string]string{}
+	client = newHTTPClient(nil)
+	if got := proxyForHost(t, client, "ingest.internal.example.test"); got != "http://default-proxy:8080" {
+		t.Errorf("proxy without rules = %q, want the proxy endpoint", got)
+	}
+	// so it does with an unreadable rule file
+	PluginConfiguration = map[string]string{"proxy_rules_path": filepath.Join(t.TempDir(), "missing")}
+	client = newHTTPClient(nil)
+	if got := proxyForHost(t, client, "ingest.internal.example.test"); got != "http://default-proxy:8080" {
+		t.Errorf("proxy with a missing rule file = %q, want the proxy endpoint", got)
+	}
+}
+
+func Test_ReadProxyRules_Invalid(t *testing.T) {
+	for _, rules := range []string{
+		"*.example.test\n",
+		"*.example.test http://proxy:3128 extra\n",
+		"[example.test http://proxy:3128\n",
+		"*.example.test not-a-url\n",
+	} {
+		rulesPath := filepath.Join(t.TempDir(), "proxy-rules")
+		if err := ioutil.WriteFile(rulesPath, []byte(rules), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadProxyRules(rulesPath); err == nil {
+			t.Errorf("ReadProxyRules(%q) succeeded, want an error", rules)
+		}
+	}
+}
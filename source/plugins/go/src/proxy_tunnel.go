@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+)
+
+// ErrProxyTunnel is returned when the proxy didn't establish the CONNECT tunnel to OMSEndpoint, as opposed to the
+// endpoint itself failing
+var ErrProxyTunnel = errors.New("proxy refused the CONNECT tunnel")
+
+// proxyTunnelTrace records how far a request through a proxy got. Connected to the proxy without ever starting the
+// TLS handshake with the endpoint means the CONNECT tunnel wasn't established
+type proxyTunnelTrace struct {
+	proxyConnected int32
+	tlsStarted     int32
+	gotConn        int32
+}
+
+// withTrace returns req tracing into t
+func (t *proxyTunnelTrace) withTrace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				atomic.StoreInt32(&t.proxyConnected, 1)
+			}
+		},
+		TLSHandshakeStart: func() {
+			atomic.StoreInt32(&t.tlsStarted, 1)
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			atomic.StoreInt32(&t.gotConn, 1)
+		},
+		// not needed to classify tunnel failures, but the trace sees every handshake of the posts
+		TLSHandshakeDone: recordTLSHandshake,
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// tunnelFailed reports whether a request failed establishing the CONNECT tunnel
+func (t *proxyTunnelTrace) tunnelFailed() bool {
+	return atomic.LoadInt32(&t.proxyConnected) == 1 && atomic.LoadInt32(&t.tlsStarted) == 0 && atomic.LoadInt32(&t.gotConn) == 0
+}
+
+// requestProxy returns the proxy client uses for req, nil if it goes direct
+func requestProxy(client *http.Client, req *http.Request) *url.URL {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return nil
+	}
+	proxyURL, err := transport.Proxy(req)
+	if err != nil {
+		return nil
+	}
+	return proxyURL
+}
+
+// classifyProxyTunnelError wraps the transport error of a request to an https endpoint into ErrProxyTunnel with an
+// actionable message if the proxy didn't establish the tunnel, and returns nil otherwise.
+// The transport only reports the status text the proxy answered the CONNECT with, e.g. "Forbidden"
+func classifyProxyTunnelError(client *http.Client, req *http.Request, trace *proxyTunnelTrace, err error) error {
+	if req.URL.Scheme != "https" || !trace.tunnelFailed() {
+		return nil
+	}
+	proxyURL := requestProxy(client, req)
+	if proxyURL == nil {
+		return nil
+	}
+	status := err.Error()
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		status = urlErr.Err.Error()
+	}
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &recordHeaderErr) {
+		// the proxy answered in plain text, so its status isn't known
+		status = "a non-TLS response"
+	}
+	return fmt.Errorf("%w: proxy %s returned %q for CONNECT to %s, check the proxy configuration and that it allows %s",
+		ErrProxyTunnel, proxyURL.Host, status, req.URL.Host, req.URL.Hostname())
+}
+
+// reportTransportError counts a transport error of a post as a proxy tunnel or an endpoint failure
+func reportTransportError(tunnelErr error) {
+	ContainerLogTelemetryMutex.Lock()
+	defer ContainerLogTelemetryMutex.Unlock()
+	if tunnelErr != nil {
+		ContainerLogsProxyTunnelFailureCount++
+	} else {
+		ContainerLogsEndpointTransportErrorCount++
+	}
+}
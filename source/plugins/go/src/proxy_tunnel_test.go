@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_PostStreamToODS_ProxyTunnelRefused(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+
+	endpoint := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer endpoint.Close()
+	// a proxy refusing every CONNECT
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			t.Errorf("proxy got %s, want CONNECT", r.Method)
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	HTTPClient = http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	ContainerLogsProxyTunnelFailureCount = 0
+	ContainerLogsEndpointTransportErrorCount = 0
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	_, err := PostStreamToODS(context.Background(), endpoint.URL, http.Header{}, newBody)
+	if !errors.Is(err, ErrODSRetriesExhausted) || !strings.Contains(err.Error(), "CONNECT") {
+		t.Fatalf("PostStreamToODS() error = %v, want ErrODSRetriesExhausted for a refused CONNECT", err)
+	}
+	endpointHost := strings.TrimPrefix(endpoint.URL, "https://")
+	if !loggedContaining(logged(), `proxy `+proxyURL.Host+` returned "Forbidden" for CONNECT to `+endpointHost) {
+		t.Errorf("refused CONNECT wasn't logged with the proxy status, got %v", logged())
+	}
+	if ContainerLogsProxyTunnelFailureCount != float64(MaxRetries) || ContainerLogsEndpointTransportErrorCount != 0 {
+		t.Errorf("proxy tunnel failures = %v, endpoint transport errors = %v, want %d and 0",
+			ContainerLogsProxyTunnelFailureCount, ContainerLogsEndpointTransportErrorCount, MaxRetries)
+	}
+}
+
+func Test_PostStreamToODS_EndpointTransportError(t *testing.T) {
+	endpoint := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	endpointURL := endpoint.URL
+	endpoint.Close()
+	HTTPClient = http.Client{Transport: &http.Transport{}}
+	ContainerLogsProxyTunnelFailureCount = 0
+	ContainerLogsEndpointTransportErrorCount = 0
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	if _, err := PostStreamToODS(context.Background(), endpointURL, http.Header{}, newBody); errors.Is(err, ErrProxyTunnel) || strings.Contains(err.Error(), "CONNECT") {
+		t.Errorf("PostStreamToODS() error = %v, want a plain transport error without a proxy", err)
+	}
+	if ContainerLogsProxyTunnelFailureCount != 0 || ContainerLogsEndpointTransportErrorCount == 0 {
+		t.Errorf("proxy tunnel failures = %v, endpoint transport errors = %v, want only endpoint errors",
+			ContainerLogsProxyTunnelFailureCount, ContainerLogsEndpointTransportErrorCount)
+	}
+}
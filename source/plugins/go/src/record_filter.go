@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RecordFilterRule allows (or denies) records whose Field is one of Values
+type RecordFilterRule struct {
+	Allow  bool
+	Field  string
+	Values []string
+}
+
+// ParseRecordFilter parses the record_filter rules of the plugin config: rules separated by ';', each of the form
+// "allow <Field>=<value>[,<value>...]" or "deny <Field>=<value>[,<value>...]", for instance
+// "allow PodNamespace=default,monitoring; deny ContainerName=istio-proxy"
+func ParseRecordFilter(text string) ([]RecordFilterRule, error) {
+	var rules []RecordFilterRule
+	for _, ruleText := range strings.Split(text, ";") {
+		ruleText = strings.TrimSpace(ruleText)
+		if ruleText == "" {
+			continue
+		}
+		fields := strings.Fields(ruleText)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ParseRecordFilter: want \"allow|deny <Field>=<values>\", got %q", ruleText)
+		}
+		rule := RecordFilterRule{}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			rule.Allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("ParseRecordFilter: unknown action %q in %q, want allow or deny", fields[0], ruleText)
+		}
+		equals := strings.Index(fields[1], "=")
+		if equals <= 0 {
+			return nil, fmt.Errorf("ParseRecordFilter: want <Field>=<values> in %q", ruleText)
+		}
+		rule.Field = fields[1][:equals]
+		for _, value := range strings.Split(fields[1][equals+1:], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				rule.Values = append(rule.Values, value)
+			}
+		}
+		if len(rule.Values) == 0 {
+			return nil, fmt.Errorf("ParseRecordFilter: no values in %q", ruleText)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// NewRecordFilter returns a transform dropping the records the rules don't let through: a record is dropped if it
+// matches any deny rule, or if it doesn't match every allow rule. A record without the field of a rule doesn't match
+// it, so it is dropped by an allow rule and kept by a deny rule. Only the fields the rules refer to are decoded
+func NewRecordFilter(rules []RecordFilterRule) RecordTransform {
+	return func(record []byte) ([]byte, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(record, &fields); err != nil {
+			return nil, fmt.Errorf("record filter: record isn't a json object: %w", err)
+		}
+		for _, rule := range rules {
+			if rule.matches(fields) != rule.Allow {
+				ContainerLogTelemetryMutex.Lock()
+				ContainerLogsFilteredRecordCount += 1
+				ContainerLogTelemetryMutex.Unlock()
+				return nil, ErrDropRecord
+			}
+		}
+		return record, nil
+	}
+}
+
+func (rule RecordFilterRule) matches(fields map[string]json.RawMessage) bool {
+	raw, ok := fields[rule.Field]
+	if !ok {
+		return false
+	}
+	value := string(raw)
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		value = text
+	}
+	for _, allowed := range rule.Values {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_NewRecordFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		record  string
+		allowed bool
+	}{
+		{"allowed namespace", "allow PodNamespace=default,monitoring", `{"PodNamespace":"monitoring","LogMessage":"a"}`, true},
+		{"namespace not allowed", "allow PodNamespace=default,monitoring", `{"PodNamespace":"kube-system","LogMessage":"a"}`, false},
+		{"absent field with allow", "allow PodNamespace=default", `{"LogMessage":"a"}`, false},
+		{"denied container", "deny ContainerName=istio-proxy", `{"ContainerName":"istio-proxy"}`, false},
+		{"container not denied", "deny ContainerName=istio-proxy", `{"ContainerName":"app"}`, true},
+		{"absent field with deny", "deny ContainerName=istio-proxy", `{"LogMessage":"a"}`, true},
+		{"allowed and denied", "allow PodNamespace=default; deny ContainerName=istio-proxy", `{"PodNamespace":"default","ContainerName":"istio-proxy"}`, false},
+		{"allowed and not denied", "allow PodNamespace=default; deny ContainerName=istio-proxy", `{"PodNamespace":"default","ContainerName":"app"}`, true},
+		{"non string field", "allow Level=3", `{"Level":3}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRecordFilter(tt.rules)
+			if err != nil {
+				t.Fatalf("ParseRecordFilter() error = %v", err)
+			}
+			ContainerLogsFilteredRecordCount = 0
+			transformed, err := NewRecordFilter(rules)([]byte(tt.record))
+			if tt.allowed {
+				if err != nil || string(transformed) != tt.record {
+					t.Errorf("filter(%s) = (%s, %v), want the record unchanged", tt.record, transformed, err)
+				}
+				if ContainerLogsFilteredRecordCount != 0 {
+					t.Errorf("ContainerLogsFilteredRecordCount = %v, want 0", ContainerLogsFilteredRecordCount)
+				}
+				return
+			}
+			if err != ErrDropRecord {
+				t.Errorf("filter(%s) error = %v, want ErrDropRecord", tt.record, err)
+			}
+			if ContainerLogsFilteredRecordCount != 1 {
+				t.Errorf("ContainerLogsFilteredRecordCount = %v, want 1", ContainerLogsFilteredRecordCount)
+			}
+		})
+	}
+}
+
+func Test_ParseRecordFilter_Invalid(t *testing.T) {
+	for _, rules := range []string{
+		"allow",
+		"keep PodNamespace=default",
+		"allow PodNamespace",
+		"allow =default",
+		"allow PodNamespace=",
+		"allow PodNamespace=default extra",
+	} {
+		if _, err := ParseRecordFilter(rules); err == nil {
+			t.Errorf("ParseRecordFilter(%q) succeeded, want an error", rules)
+		}
+	}
+}
+
+func Test_Sender_RecordFilter(t *testing.T) {
+	rules, err := ParseRecordFilter("allow PodNamespace=default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, recorder := newTestSender(2, 0)
+	s.AddTransform(NewRecordFilter(rules))
+	s.Enqueue([]byte(`{"PodNamespace":"default"}`))
+	s.Enqueue([]byte(`{"PodNamespace":"kube-system"}`))
+	s.Enqueue([]byte(`{"PodNamespace":"default"}`))
+	if got := recorder.batchSizes(); len(got) != 1 || got[0] != 2 {
+		t.Errorf("posted batch sizes = %v, want [2] with the kube-system record filtered out before batching", got)
+	}
+}
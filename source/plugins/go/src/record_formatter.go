@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// payload_format values
+const (
+	payloadFormatJSON   = "json"
+	payloadFormatNDJSON = "ndjson"
+)
+
+// RecordFormatter assembles a batch of json encoded records into the body of a post and its Content-Type
+type RecordFormatter interface {
+	Format(records [][]byte) ([]byte, string, error)
+}
+
+// JSONRecordFormatter wraps the records into the ODS blob {"DataType":..,"IPName":..,"DataItems":[..]}
+type JSONRecordFormatter struct {
+	DataType string
+}
+
+// Format implements RecordFormatter
+func (f JSONRecordFormatter) Format(records [][]byte) ([]byte, string, error) {
+	return buildODSPayload(f.DataType, records), "application/json", nil
+}
+
+// NDJSONRecordFormatter writes one record per line, every line terminated by a newline
+type NDJSONRecordFormatter struct{}
+
+// Format implements RecordFormatter
+func (f NDJSONRecordFormatter) Format(records [][]byte) ([]byte, string, error) {
+	var buf bytes.Buffer
+	for _, record := range records {
+		if bytes.IndexByte(record, '\n') >= 0 {
+			return nil, "", fmt.Errorf("NDJSONRecordFormatter: record spans several lines")
+		}
+		buf.Write(record)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), "application/x-ndjson", nil
+}
+
+// getRecordFormatter returns the formatter selected with payload_format in the plugin config, json by default
+func getRecordFormatter(config map[string]string, dataType string) RecordFormatter {
+	switch format := strings.ToLower(strings.TrimSpace(config["payload_format"])); format {
+	case "", payloadFormatJSON:
+		return JSONRecordFormatter{DataType: dataType}
+	case payloadFormatNDJSON:
+		return NDJSONRecordFormatter{}
+	default:
+		Log("Invalid value %s for payload_format. Using %s", format, payloadFormatJSON)
+		return JSONRecordFormatter{DataType: dataType}
+	}
+}
+
+// payloadFraming returns the size a formatter adds around the first record of a payload and between two records
+func payloadFraming(formatter RecordFormatter) (int, int) {
+	one, _, err := formatter.Format([][]byte{{}})
+	if err != nil {
+		return 0, 0
+	}
+	two, _, err := formatter.Format([][]byte{{}, {}})
+	if err != nil {
+		return len(one), 0
+	}
+	return len(one), len(two) - len(one)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_JSONRecordFormatter(t *testing.T) {
+	formatter := JSONRecordFormatter{DataType: ContainerLogV2DataType}
+	tests := []struct {
+		name    string
+		records [][]byte
+		want    int
+	}{
+		{"empty", nil, 0},
+		{"single", [][]byte{[]byte(`{"LogMessage":"a"}`)}, 1},
+		{"several", [][]byte{[]byte(`{"LogMessage":"a"}`), []byte(`{"LogMessage":"b"}`)}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType, err := formatter.Format(tt.records)
+			if err != nil {
+				t.Fatalf("Format() error = %v", err)
+			}
+			if contentType != "application/json" {
+				t.Errorf("Format() content type = %s, want application/json", contentType)
+			}
+			var payload struct {
+				DataType  string
+				DataItems []json.RawMessage
+			}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Fatalf("Format() = %s, not valid json: %v", body, err)
+			}
+			if payload.DataType != ContainerLogV2DataType || len(payload.DataItems) != tt.want {
+				t.Errorf("Format() = %s, want %d %s data items", body, tt.want, ContainerLogV2DataType)
+			}
+		})
+	}
+}
+
+func Test_NDJSONRecordFormatter(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]byte
+		want    string
+		wantErr bool
+	}{
+		{"empty", nil, "", false},
+		{"single", [][]byte{[]byte(`{"LogMessage":"a"}`)}, "{\"LogMessage\":\"a\"}\n", false},
+		{"several", [][]byte{[]byte(`{"LogMessage":"a"}`), []byte(`{"LogMessage":"b"}`)}, "{\"LogMessage\":\"a\"}\n{\"LogMessage\":\"b\"}\n", false},
+		{"multiline record", [][]byte{[]byte("{\"LogMessage\":\n\"a\"}")}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType, err := NDJSONRecordFormatter{}.Format(tt.records)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Format() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if string(body) != tt.want {
+				t.Errorf("Format() = %q, want %q", body, tt.want)
+			}
+			if contentType != "application/x-ndjson" {
+				t.Errorf("Format() content type = %s, want application/x-ndjson", contentType)
+			}
+		})
+	}
+}
+
+func Test_getRecordFormatter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  RecordFormatter
+	}{
+		{"", JSONRecordFormatter{DataType: ContainerLogV2DataType}},
+		{"json", JSONRecordFormatter{DataType: ContainerLogV2DataType}},
+		{" NDJSON ", NDJSONRecordFormatter{}},
+		{"xml", JSONRecordFormatter{DataType: ContainerLogV2DataType}},
+	}
+	for _, tt := range tests {
+		if got := getRecordFormatter(map[string]string{"payload_format": tt.value}, ContainerLogV2DataType); got != tt.want {
+			t.Errorf("getRecordFormatter(%q) = %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_Sender_PayloadFormatContentType(t *testing.T) {
+	contentTypes := make(chan string, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		contentTypes <- r.Header.Get("Content-Type")
+		bodies <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	defer func() { OMSEndpoint = originalEndpoint }()
+
+	sender := newSender(ContainerLogV2DataType, 2, time.Hour)
+	sender.formatter = NDJSONRecordFormatter{}
+	sender.Enqueue([]byte(`{"LogMessage":"a"}`))
+	sender.Enqueue([]byte(`{"LogMessage":"b"}`))
+
+	if got := <-contentTypes; got != "application/x-ndjson" {
+		t.Errorf("posted Content-Type = %s, want application/x-ndjson", got)
+	}
+	if got, want := <-bodies, "{\"LogMessage\":\"a\"}\n{\"LogMessage\":\"b\"}\n"; got != want {
+		t.Errorf("posted body = %q, want %q", got, want)
+	}
+}
+
+func Test_Sender_OversizedBatchSplit_NDJSON(t *testing.T) {
+	sender, recorder := newTestSender(10, time.Hour)
+	sender.formatter = NDJSONRecordFormatter{}
+	record := []byte(`{"LogMessage":"0123456789"}`)
+	// two records and their newlines fit, a third doesn't
+	sender.maxPayloadBytes = 2 * (len(record) + 1)
+	sender.send(context.Background(), [][]byte{record, record, record, record, record}, nil)
+	if got := recorder.batchSizes(); len(got) != 3 || got[0] != 2 || got[1] != 2 || got[2] != 1 {
+		t.Errorf("batch sizes = %v, want [2 2 1]", got)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// ErrConfigFetch is returned by ConfigURLCache.Fetch when the config url doesn't answer with a config
+var ErrConfigFetch = errors.New("unable to fetch config")
+
+// default number of config urls ConfigURLCache keeps the last response for
+const defaultConfigURLCacheSize = 8
+
+// maxRemoteConfigBytes bounds the size of a fetched config
+const maxRemoteConfigBytes = 1024 * 1024
+
+// remoteConfigEntry is the last response fetched from a config url with its validators
+type remoteConfigEntry struct {
+	url          string
+	etag         string
+	lastModified string
+	config       map[string]string
+}
+
+// ConfigURLCache fetches property files from http(s) urls with conditional GETs: the ETag and Last-Modified of the
+// last response are sent back as If-None-Match and If-Modified-Since, and a 304 returns the cached config without
+// reparsing it. The responses of the capacity most recently fetched urls are kept
+type ConfigURLCache struct {
+	mutex    sync.Mutex
+	capacity int
+	// most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+	parse   func(body []byte, name string) (map[string]string, error)
+}
+
+// NewConfigURLCache creates a cache for up to capacity urls
+func NewConfigURLCache(capacity int) *ConfigURLCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &ConfigURLCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		parse:    parseConfiguration,
+	}
+}
+
+// Fetch returns the config at configURL and whether it changed since the previous fetch of that url
+func (c *ConfigURLCache) Fetch(ctx context.Context, client *http.Client, configURL string) (map[string]string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", configURL, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("ConfigURLCache: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	cached := c.get(configURL)
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("ConfigURLCache: %w: %v", ErrConfigFetch, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return copyConfiguration(cached.config), false, nil
+	case resp.StatusCode != http.StatusOK:
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, false, fmt.Errorf("ConfigURLCache: %w: %s responded with %s", ErrConfigFetch, configURL, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigBytes+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("ConfigURLCache: %w: %v", ErrConfigFetch, err)
+	}
+	if len(body) > maxRemoteConfigBytes {
+		return nil, false, fmt.Errorf("ConfigURLCache: %w: %s is larger than %d bytes", ErrConfigFetch, configURL, maxRemoteConfigBytes)
+	}
+	config, err := c.parse(body, configURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("ConfigURLCache: %w", err)
+	}
+	c.put(&remoteConfigEntry{
+		url:          configURL,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		config:       config,
+	})
+	return copyConfiguration(config), true, nil
+}
+
+// get returns the cached entry of configURL, marking it most recently used
+func (c *ConfigURLCache) get(configURL string) *remoteConfigEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[configURL]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*remoteConfigEntry)
+}
+
+// put caches entry, evicting the least recently used url when full
+func (c *ConfigURLCache) put(entry *remoteConfigEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[entry.url]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[entry.url] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*remoteConfigEntry).url)
+	}
+}
+
+// parseConfiguration parses the content of a property file like ReadConfiguration
+func parseConfiguration(body []byte, name string) (map[string]string, error) {
+	config := map[string]string{}
+	err := scanConfigurationReader(bytes.NewReader(body), name, func(section string, key string, value string) {
+		if key != "" {
+			config[key] = value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// copyConfiguration returns a copy callers can modify without affecting the cache
+func copyConfiguration(config map[string]string) map[string]string {
+	copied := make(map[string]string, len(config))
+	for key, value := range config {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_ConfigURLCache_ConditionalGet(t *testing.T) {
+	const etag = `"v1"`
+	const lastModified = "Wed, 14 Oct 2026 08:00:00 GMT"
+	var conditional []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag && r.Header.Get("If-Modified-Since") == lastModified {
+			conditional = append(conditional, r.URL.Path)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("flush_interval=5\nlog_output=stdout\n"))
+	}))
+	defer server.Close()
+
+	cache := NewConfigURLCache(defaultConfigURLCacheSize)
+	parses := 0
+	cache.parse = func(body []byte, name string) (map[string]string, error) {
+		parses++
+		return parseConfiguration(body, name)
+	}
+	want := map[string]string{"flush_interval": "5", "log_output": "stdout"}
+
+	config, changed, err := cache.Fetch(context.Background(), server.Client(), server.URL+"/out_oms.conf")
+	if err != nil || !changed || !reflect.DeepEqual(config, want) {
+		t.Fatalf("first Fetch() = (%v, %t, %v), want (%v, true, nil)", config, changed, err, want)
+	}
+	// the caller modifying its copy doesn't affect the cache
+	config["flush_interval"] = "1"
+
+	config, changed, err = cache.Fetch(context.Background(), server.Client(), server.URL+"/out_oms.conf")
+	if err != nil || changed || !reflect.DeepEqual(config, want) {
+		t.Fatalf("second Fetch() = (%v, %t, %v), want (%v, false, nil)", config, changed, err, want)
+	}
+	if len(conditional) != 1 {
+		t.Errorf("server got %d conditional requests, want 1", len(conditional))
+	}
+	if parses != 1 {
+		t.Errorf("config parsed %d times, want only once as the second response was 304", parses)
+	}
+}
+
+func Test_ConfigURLCache_Eviction(t *testing.T) {
+	fetches := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches[r.URL.Path]++
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		w.Write([]byte("key=" + r.URL.Path + "\n"))
+	}))
+	defer server.Close()
+
+	cache := NewConfigURLCache(2)
+	for _, path := range []string{"/a", "/b", "/a", "/c", "/a", "/b"} {
+		if _, _, err := cache.Fetch(context.Background(), server.Client(), server.URL+path); err != nil {
+			t.Fatalf("Fetch(%s) error = %v", path, err)
+		}
+	}
+	// /b was the least recently used when /c was added
+	if want := map[string]int{"/a": 1, "/b": 2, "/c": 1}; !reflect.DeepEqual(fetches, want) {
+		t.Errorf("full fetches = %v, want %v", fetches, want)
+	}
+}
+
+func Test_ConfigURLCache_Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+	// a 304 for a url that was never fetched can't be served from the cache
+	if _, _, err := NewConfigURLCache(1).Fetch(context.Background(), server.Client(), server.URL); !errors.Is(err, ErrConfigFetch) {
+		t.Errorf("Fetch() error = %v, want ErrConfigFetch", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrRetryBudgetExhausted is returned when a post would have been retried but the shared retry budget is used up
+var ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// RetryBudget is a token bucket shared by all posts to OMSEndpoint. Every retry takes a token and tokens are refilled
+// at refillRate per second up to one second worth of them, so the aggregate retry traffic stays bounded during a
+// broad outage no matter how many goroutines are posting
+type RetryBudget struct {
+	mutex      sync.Mutex
+	tokens     float64
+	capacity   float64
+	refillRate float64
+	last       time.Time
+}
+
+// NewRetryBudget creates a full budget refilled at refillRate retries per second
+func NewRetryBudget(refillRate float64) *RetryBudget {
+	capacity := refillRate
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &RetryBudget{
+		tokens:     capacity,
+		capacity:   capacity,
+		refillRate: refillRate,
+		last:       time.Now(),
+	}
+}
+
+// TryTake takes a token for one retry, returning false (without blocking) if the budget is exhausted.
+// A nil budget is unlimited
+func (b *RetryBudget) TryTake() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.refillRate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// getRetryBudget creates the retry budget from retry_budget_refill_rate (retries per second) in the plugin config,
+// defaulting to defaultRetryBudgetRefillRate. 0 disables the budget, leaving retries unlimited
+func getRetryBudget(config map[string]string) *RetryBudget {
+	refillRate := float64(defaultRetryBudgetRefillRate)
+	if value := config["retry_budget_refill_rate"]; value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			Log("Invalid value %s for retry_budget_refill_rate. Using default of %d", value, defaultRetryBudgetRefillRate)
+		} else {
+			refillRate = rate
+		}
+	}
+	if refillRate == 0 {
+		return nil
+	}
+	return NewRetryBudget(refillRate)
+}
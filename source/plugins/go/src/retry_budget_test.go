@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_getRetryBudget(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     map[string]string
+		refillRate float64
+		unlimited  bool
+	}{
+		{"default", map[string]string{}, defaultRetryBudgetRefillRate, false},
+		{"configured", map[string]string{"retry_budget_refill_rate": "2.5"}, 2.5, false},
+		{"disabled", map[string]string{"retry_budget_refill_rate": "0"}, 0, true},
+		{"invalid", map[string]string{"retry_budget_refill_rate": "fast"}, defaultRetryBudgetRefillRate, false},
+		{"negative", map[string]string{"retry_budget_refill_rate": "-1"}, defaultRetryBudgetRefillRate, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := getRetryBudget(tt.config)
+			if tt.unlimited {
+				if budget != nil || !budget.TryTake() {
+					t.Errorf("getRetryBudget() = %+v, want an unlimited (nil) budget", budget)
+				}
+				return
+			}
+			if budget == nil || budget.refillRate != tt.refillRate {
+				t.Errorf("getRetryBudget() = %+v, want refill rate %v", budget, tt.refillRate)
+			}
+		})
+	}
+}
+
+func Test_RetryBudget_BoundsAggregateRetries(t *testing.T) {
+	const posters = 50
+	const refillRate = 5
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	ODSRetryBudget = NewRetryBudget(refillRate)
+	defer func() { ODSRetryBudget = nil }()
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	var failedFast int32
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < posters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+			if errors.Is(err, ErrRetryBudgetExhausted) {
+				atomic.AddInt32(&failedFast, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// every poster makes its first attempt, retries are limited to the bucket capacity plus what was refilled
+	retries := int(atomic.LoadInt32(&attempts)) - posters
+	maxRetries := refillRate + int(elapsed.Seconds()*refillRate) + 1
+	if retries > maxRetries {
+		t.Errorf("%d retries in %s, want at most %d", retries, elapsed, maxRetries)
+	}
+	if failedFast == 0 {
+		t.Errorf("no post failed fast with ErrRetryBudgetExhausted")
+	}
+}
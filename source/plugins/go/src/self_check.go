@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// selfCheckTimeout bounds a SelfCheck run
+const selfCheckTimeout = 30 * time.Second
+
+// StartSelfCheck runs SelfCheck at startup unless self_check is off. It runs in the background unless
+// self_check_blocking is set, so a slow or failing endpoint doesn't hold up the plugin init. The problems found are
+// only logged and reported, they never fail the startup
+func StartSelfCheck(config map[string]string) {
+	if !GetBool(config, "self_check", true) {
+		return
+	}
+	run := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+		defer cancel()
+		SelfCheck(ctx)
+	}
+	if GetBool(config, "self_check_blocking", false) {
+		run()
+		return
+	}
+	go run()
+}
+
+// SelfCheck pings OMSEndpoint and inspects the cert chain it presents, so a cert that doesn't cover the endpoint host
+// (or tls_server_name) or expires within cert_expiry_warning_days is reported before posts fail on it. Every problem
+// is logged as a warning and the outcome is sent as a telemetry event. Returns the problems found, none if healthy
+func SelfCheck(ctx context.Context) []string {
+	var problems []string
+	if err := Ping(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("endpoint isn't reachable: %s", err.Error()))
+	}
+	PluginConfigurationMutex.Lock()
+	config := PluginConfiguration
+	PluginConfigurationMutex.Unlock()
+	warnBefore := time.Duration(getPositiveInt(config, "cert_expiry_warning_days", defaultCertExpiryWarningDays)) * 24 * time.Hour
+	certProblems, err := checkEndpointCertificate(ctx, GetClient(), OMSEndpoint, warnBefore)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("unable to inspect the endpoint cert: %s", err.Error()))
+	}
+	problems = append(problems, certProblems...)
+
+	for _, problem := range problems {
+		Log("SelfCheck::Warning::%s", problem)
+	}
+	if len(problems) == 0 {
+		Log("SelfCheck::Info::%s is reachable and its cert is valid", OMSEndpoint)
+	}
+	SendEvent(eventNameSelfCheck, map[string]string{
+		"Healthy":  strconv.FormatBool(len(problems) == 0),
+		"Problems": strings.Join(problems, "; "),
+	})
+	return problems
+}
+
+// checkEndpointCertificate connects to endpoint the way client does (proxy, host overrides, client cert) without
+// verifying the server cert, and returns the problems of the chain it presents: a leaf not valid for the name the
+// client verifies, certs expired or expiring within warnBefore. Non-https endpoints aren't checked
+func checkEndpointCertificate(ctx context.Context, client *http.Client, endpoint string, warnBefore time.Duration) ([]string, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpointURL.Scheme != "https" {
+		return nil, nil
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("the HTTP client has no http.Transport")
+	}
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	// the chain is inspected here instead, a cert that doesn't verify would fail the handshake
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = nil
+	inspecting := transport.Clone()
+	inspecting.TLSClientConfig = tlsConfig
+	defer inspecting.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := (&http.Client{Transport: inspecting, Timeout: client.Timeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("the endpoint presented no cert")
+	}
+
+	name := tlsConfig.ServerName
+	if name == "" {
+		name = endpointURL.Hostname()
+	}
+	var problems []string
+	leaf := resp.TLS.PeerCertificates[0]
+	if err := leaf.VerifyHostname(name); err != nil {
+		problems = append(problems, fmt.Sprintf("endpoint cert %q doesn't cover %s, posts will fail: %s", leaf.Subject.CommonName, name, err.Error()))
+	}
+	now := time.Now()
+	for _, cert := range resp.TLS.PeerCertificates {
+		if now.After(cert.NotAfter) {
+			problems = append(problems, fmt.Sprintf("endpoint cert %q expired on %s", cert.Subject.CommonName, cert.NotAfter.UTC().Format(time.RFC3339)))
+		} else if cert.NotAfter.Sub(now) < warnBefore {
+			problems = append(problems, fmt.Sprintf("endpoint cert %q expires on %s", cert.Subject.CommonName, cert.NotAfter.UTC().Format(time.RFC3339)))
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTLSServer starts a TLS server presenting a cert for hosts, and trusts its cert in HTTPClient
+func newTestTLSServer(t *testing.T, hosts ...string) *httptest.Server {
+	certPEM, keyPEM := generateTestCertificate(t, "test endpoint", hosts...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	originalClient := HTTPClient
+	HTTPClient = http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = server.URL
+	t.Cleanup(func() {
+		HTTPClient = originalClient
+		OMSEndpoint = originalEndpoint
+	})
+	return server
+}
+
+func Test_SelfCheck_HostnameMismatch(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+	client := injectTelemetryClient(t)
+	// the endpoint is dialed as 127.0.0.1, which the cert doesn't cover
+	newTestTLSServer(t, "other.contoso.com")
+
+	problems := SelfCheck(context.Background())
+	var mismatch, nearExpiry bool
+	for _, problem := range problems {
+		mismatch = mismatch || strings.Contains(problem, "doesn't cover 127.0.0.1")
+		nearExpiry = nearExpiry || strings.Contains(problem, "expires on")
+	}
+	if !mismatch {
+		t.Errorf("SelfCheck() = %v, want the hostname mismatch reported", problems)
+	}
+	if !nearExpiry {
+		t.Errorf("SelfCheck() = %v, want the cert expiring within %d days reported", problems, defaultCertExpiryWarningDays)
+	}
+	if !loggedContaining(logged(), "SelfCheck::Warning::endpoint cert") {
+		t.Errorf("the mismatch wasn't logged as a warning, got %v", logged())
+	}
+	if len(client.events) != 1 || client.events[0] != eventNameSelfCheck {
+		t.Errorf("events = %v, want [%s]", client.events, eventNameSelfCheck)
+	}
+}
+
+func Test_checkEndpointCertificate(t *testing.T) {
+	server := newTestTLSServer(t, "127.0.0.1")
+	problems, err := checkEndpointCertificate(context.Background(), GetClient(), server.URL, time.Hour)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("checkEndpointCertificate() of a matching cert = (%v, %v), want no problems", problems, err)
+	}
+
+	// tls_server_name is the name verified instead of the endpoint host
+	transport := GetClient().Transport.(*http.Transport)
+	transport.TLSClientConfig.ServerName = "ods.contoso.com"
+	problems, err = checkEndpointCertificate(context.Background(), &http.Client{Transport: transport}, server.URL, time.Hour)
+	if err != nil || len(problems) != 1 || !strings.Contains(problems[0], "doesn't cover ods.contoso.com") {
+		t.Errorf("checkEndpointCertificate() with tls_server_name = (%v, %v), want its mismatch reported", problems, err)
+	}
+
+	// plain http endpoints have no cert to check
+	problems, err = checkEndpointCertificate(context.Background(), GetClient(), "http://127.0.0.1", time.Hour)
+	if err != nil || problems != nil {
+		t.Errorf("checkEndpointCertificate() of an http endpoint = (%v, %v), want nothing checked", problems, err)
+	}
+}
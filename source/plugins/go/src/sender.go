@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDropRecord can be returned by a RecordTransform to skip the record without deadlettering it
+var ErrDropRecord = errors.New("drop record")
+
+// RecordTransform enriches or redacts a json encoded record before it is buffered for posting. Returning
+// ErrDropRecord skips the record, any other error routes the record to the deadletter
+type RecordTransform func(record []byte) ([]byte, error)
+
+// Sender buffers json encoded records bound for OMSEndpoint and flushes them as one batch as soon as either
+// maxCount records are buffered, maxInflightBytes are buffered or the oldest buffered record is maxAge old, whichever
+// comes first. Batches are gzipped from gzip_min_bytes, see PostFormattedRecordsToODS.
+// Setting maxCount (batch_max_count) or maxAge (flush_interval) to 0 disables that trigger, and with both disabled
+// every record is flushed as it arrives
+type Sender struct {
+	// number of buffered records and enqueue time (unix nanoseconds, 0 when empty) of the oldest one,
+	// mirrored for lock free reads by QueueDepth and OldestRecordAge. Kept first for 64-bit alignment of atomics
+	queueDepth      int64
+	oldestUnixNanos int64
+	// total size of the buffered records, see BufferedBytes
+	bufferedBytes int64
+	// time (unix nanoseconds, 0 if never) of the last successful post, see LastSuccessfulPost
+	lastSuccessUnixNanos int64
+	// error of the last failed post, see LastError
+	lastError atomic.Value
+
+	mutex sync.Mutex
+	// records buffered for the next batch
+	records [][]byte
+	// header the buffered records were enqueued with (EnqueueWithHeader), nil for none
+	header http.Header
+	// enqueue time of the oldest buffered record
+	oldest time.Time
+	// incremented on every flush, so an age timer armed for an already flushed batch is ignored
+	generation uint64
+	ageTimer   *time.Timer
+
+	dataType string
+	maxCount int
+	maxAge   time.Duration
+	// maxPayloadBytes limits the size of a posted payload (max_payload_bytes), 0 for no limit
+	maxPayloadBytes int
+	// maxInflightBytes limits the total size of the buffered records (max_inflight_bytes), 0 for no limit
+	maxInflightBytes int64
+	// budget the buffered records and the replayed spilled batches draw from, nil for no limit
+	budget *MemoryBudget
+	// formatter assembles the body of a post (payload_format)
+	formatter RecordFormatter
+	// post delivers a batch, PostFormattedRecordsToODS unless replaced (tests)
+	post func(ctx context.Context, records [][]byte) error
+	// replayPost delivers the records replayed from the deadletter, PostRecordsToODS unless replaced
+	replayPost DeadletterPost
+	// transforms applied in order to every enqueued record
+	transforms []RecordTransform
+	// recordFilter holds the record_filter transform (recordFilterHolder), replaced by SetRecordFilter on config reload
+	recordFilter atomic.Value
+	// deadletter for records that can't be delivered
+	deadletter *Deadletter
+	// spill keeps batches that failed with a retriable error until the endpoint recovers, nil to deadletter them
+	spill spillStore
+	// backoff between attempts of the spill retry loop (spillover_retry_initial_delay, spillover_retry_max_delay),
+	// 0 to only retry the spilled batches after a successful post
+	spillRetryInitialDelay time.Duration
+	spillRetryMaxDelay     time.Duration
+	// the spill retry loop is running, spillRetryCancel stops it and spillRetryWake cuts its backoff short.
+	// Guarded by mutex
+	spillRetrying    bool
+	spillRetryCancel context.CancelFunc
+	spillRetryWake   chan struct{}
+	// set by Shutdown, the spill retry loop isn't started anymore. Guarded by mutex
+	spillRetryStopped bool
+	// held by retrySpilled, so a spilled batch is posted by one caller at a time
+	spillReplayMutex sync.Mutex
+	// shutdownPolicy handles the records still undelivered when the Shutdown deadline elapses (shutdown_on_timeout)
+	shutdownPolicy string
+	// adaptive replaces maxCount with a batch size following the post latency (adaptive_batching), nil if disabled
+	adaptive *AdaptiveBatchSizer
+	// pacer spaces the posts min_post_interval apart, nil if disabled
+	pacer *PostPacer
+}
+
+// NewSender creates a sender isolated from the plugin globals, for running several output plugins in one process:
+// its endpoint (BuildEndpointURL), HTTP client (cert_file_path/key_file_path, timeouts, TLS and proxy settings),
+// batching (batch_max_count, flush_interval, max_payload_bytes, max_inflight_bytes, payload_format, record_filter,
+// min_post_interval), sequence numbers (sequence_number_field), deadletter and spillover are all derived from config,
+// and data_type selects the records it posts (CONTAINER_LOG_BLOB by default). Its posts, deadletter replays included,
+// use the gzip, checksum, idempotency key, clock skew and resource_id settings of config, see newODSPoster.
+// Give each plugin its own deadletter_file_path and spillover_path. The retry budget, circuit breaker, memory budget
+// and AAD MSI ingestion token remain shared by the process
+func NewSender(config map[string]string) (*Sender, error) {
+	endpoint, err := BuildEndpointURL(config)
+	if err != nil {
+		return nil, fmt.Errorf("NewSender: %w", err)
+	}
+
+	var cert *tls.Certificate
+	if !IsAADMSIAuthMode {
+		certFilePath, keyFilePath := config["cert_file_path"], config["key_file_path"]
+		if workspaceID := config["workspace_id"]; workspaceID != "" {
+			certFilePath = strings.Replace(certFilePath, "%s", workspaceID, 1)
+			keyFilePath = strings.Replace(keyFilePath, "%s", workspaceID, 1)
+		}
+		loaded, err := loadClientCertificate(certFilePath, keyFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("NewSender: %w", err)
+		}
+		cert = &loaded
+	}
+	proxyEndpoint, _, err := getProxyEndpoint(config)
+	if err != nil {
+		return nil, fmt.Errorf("NewSender: reading proxy configuration: %w", err)
+	}
+	client := buildHTTPClient(config, proxyEndpoint, cert)
+
+	dataType := ContainerLogDataType
+	if value := strings.TrimSpace(config["data_type"]); value != "" {
+		dataType = value
+	}
+	maxCount, maxAge, _ := getSenderBatchSettings(config)
+	s := newSender(dataType, maxCount, maxAge)
+	poster := newODSPoster(config, endpoint, &client)
+	s.post = func(ctx context.Context, records [][]byte) error {
+		return poster.postFormattedRecords(ctx, s.formatter, records)
+	}
+	s.replayPost = func(ctx context.Context, dataType string, records [][]byte) error {
+		return poster.postFormattedRecords(ctx, s.replayFormatter(dataType), records)
+	}
+	s.configure(config)
+	return s, nil
+}
+
+// configure applies the payload, deadletter, spillover, adaptive batching, pacing, record_filter and sequence number
+// settings of config, and starts retrying the batches spilled before a restart. s.post must be set
+func (s *Sender) configure(config map[string]string) {
+	s.budget = ProcessMemoryBudget
+	s.adaptive = getAdaptiveBatchSizer(config, s.maxCount)
+	s.pacer = getPostPacer(config)
+	s.deadletter = getDeadletter(config)
+	s.maxPayloadBytes = getMaxPayloadBytes(config)
+	s.maxInflightBytes = getMaxInflightBytes(config)
+	s.formatter = getRecordFormatter(config, s.dataType)
+	s.spill = newSpillStore(config)
+	s.spillRetryInitialDelay, s.spillRetryMaxDelay = getSpillRetryDelays(config)
+	s.shutdownPolicy = getShutdownPolicy(config, s.spill)
+	if err := s.SetRecordFilter(config["record_filter"]); err != nil {
+		message := fmt.Sprintf("Error parsing record_filter, not filtering %s records: %s", s.dataType, err.Error())
+		Log(message)
+		SendException(message)
+	}
+	s.AddTransform(s.filterRecord)
+	// after the filter, so dropped records don't leave gaps
+	if counter, field := getSequenceCounter(config, s.spill); counter != nil {
+		s.AddTransform(counter.Transform(field))
+	}
+	s.startSpillRetry()
+}
+
+// newSender creates a sender posting batches of dataType records to OMSEndpoint
+func newSender(dataType string, maxCount int, maxAge time.Duration) *Sender {
+	s := &Sender{
+		dataType:  dataType,
+		maxCount:  maxCount,
+		maxAge:    maxAge,
+		formatter: JSONRecordFormatter{DataType: dataType},
+	}
+	s.post = func(ctx context.Context, records [][]byte) error {
+		return PostFormattedRecordsToODS(ctx, s.formatter, records)
+	}
+	s.replayPost = func(ctx context.Context, dataType string, records [][]byte) error {
+		return PostFormattedRecordsToODS(ctx, s.replayFormatter(dataType), records)
+	}
+	return s
+}
+
+// replayFormatter returns the formatter of the deadlettered records of dataType: the payload_format of the sender
+// for its own records, json for the others
+func (s *Sender) replayFormatter(dataType string) RecordFormatter {
+	if dataType == s.dataType {
+		return s.formatter
+	}
+	return JSONRecordFormatter{DataType: dataType}
+}
+
+// AddTransform appends a transform to the chain applied to every record before it is buffered.
+// Not safe to call concurrently with Enqueue, register transforms before the sender is used
+func (s *Sender) AddTransform(transform RecordTransform) {
+	s.transforms = append(s.transforms, transform)
+}
+
+// SetRecordFilter replaces the record_filter rules of a running sender, an empty filter lets every record through.
+// Records enqueued concurrently are filtered with either the previous or the new rules. An invalid filter is
+// rejected and the current rules kept
+func (s *Sender) SetRecordFilter(recordFilter string) error {
+	var transform RecordTransform
+	if recordFilter = strings.TrimSpace(recordFilter); recordFilter != "" {
+		rules, err := ParseRecordFilter(recordFilter)
+		if err != nil {
+			return fmt.Errorf("Sender: %w", err)
+		}
+		Log("Filtering %s records with %d record_filter rules", s.dataType, len(rules))
+		transform = NewRecordFilter(rules)
+	}
+	s.recordFilter.Store(recordFilterHolder{transform: transform})
+	return nil
+}
+
+// recordFilterHolder wraps the transform stored in Sender.recordFilter, nil for no filter
+type recordFilterHolder struct {
+	transform RecordTransform
+}
+
+// filterRecord is the transform applying the current record_filter rules
+func (s *Sender) filterRecord(record []byte) ([]byte, error) {
+	if holder, ok := s.recordFilter.Load().(recordFilterHolder); ok && holder.transform != nil {
+		return holder.transform(record)
+	}
+	return record, nil
+}
+
+// SetBatchSettings changes maxCount and maxAge of a running sender (batch_max_count and flush_interval on config
+// reload). The buffered records are kept: the age timer of the current batch is rescheduled to fire maxAge after its
+// oldest record was buffered, and the batch is flushed right away if it already reached the new limits. With adaptive
+// batching enabled the adaptive size still takes precedence over maxCount
+func (s *Sender) SetBatchSettings(maxCount int, maxAge time.Duration) {
+	s.mutex.Lock()
+	s.maxCount = maxCount
+	s.maxAge = maxAge
+	if s.ageTimer != nil {
+		s.ageTimer.Stop()
+		s.ageTimer = nil
+	}
+	if s.adaptive != nil {
+		maxCount = s.adaptive.Size()
+	}
+	var batch [][]byte
+	var header http.Header
+	if len(s.records) > 0 {
+		remaining := maxAge - time.Since(s.oldest)
+		if maxCount <= 0 && maxAge <= 0 || maxCount > 0 && len(s.records) >= maxCount || maxAge > 0 && remaining <= 0 {
+			batch, header = s.takeBatchLocked()
+		} else if maxAge > 0 {
+			generation := s.generation
+			s.ageTimer = time.AfterFunc(remaining, func() { s.flushAged(generation) })
+		}
+	}
+	s.mutex.Unlock()
+
+	if batch != nil {
+		s.send(context.Background(), batch, header)
+	}
+}
+
+// Enqueue buffers a record, flushing the batch if it reached maxCount records (the adaptive size if enabled) or
+// maxInflightBytes. A record that would take the buffer over maxInflightBytes first flushes the records buffered
+// before it, so the caller is held back by that post and memory stays bounded whatever the size of the records.
+// Likewise a record that doesn't fit the memory budget of the process first flushes the buffered records, then waits
+// for the other buffers to release memory
+func (s *Sender) Enqueue(record []byte) {
+	s.enqueue(record, nil)
+}
+
+// EnqueueWithHeader is Enqueue for a record whose batch is posted with header on top of the headers common to every
+// post (see WithBatchHeader), e.g. a routing header of its record source. Records are only batched with records
+// enqueued with the same header, a record with another header first flushes the buffered ones. Batches spilled or
+// deadlettered after a failed post, or left to shutdown_on_timeout, are retried without their header
+func (s *Sender) EnqueueWithHeader(record []byte, header http.Header) error {
+	if err := validateBatchHeader(header); err != nil {
+		return fmt.Errorf("Sender: %w", err)
+	}
+	s.enqueue(record, canonicalBatchHeader(header))
+	return nil
+}
+
+// enqueue buffers a record enqueued with an already validated and canonical header
+func (s *Sender) enqueue(record []byte, header http.Header) {
+	for _, transform := range s.transforms {
+		transformed, err := transform(record)
+		if errors.Is(err, ErrDropRecord) {
+			return
+		}
+		if err != nil {
+			s.deadletter.Write(s.dataType, record, fmt.Sprintf("transform failed: %s", err.Error()))
+			return
+		}
+		record = transformed
+	}
+
+	size := int64(len(record))
+	if !s.budget.TryReserve(size) {
+		s.mutex.Lock()
+		batch, batchHeader := s.takeBatchLocked()
+		s.mutex.Unlock()
+		if batch != nil {
+			s.send(context.Background(), batch, batchHeader)
+		}
+		if !s.budget.Reserve(size) {
+			Log("Sender::Warning::Memory budget of %d bytes exhausted, buffering a %s record of %d bytes over it", s.budget.Capacity(), s.dataType, size)
+		}
+	}
+
+	s.mutex.Lock()
+	var earlier [][]byte
+	var earlierHeader http.Header
+	if len(s.records) > 0 && (!sameBatchHeader(s.header, header) ||
+		s.maxInflightBytes > 0 && s.bufferedBytes+size > s.maxInflightBytes) {
+		earlier, earlierHeader = s.takeBatchLocked()
+	}
+	if len(s.records) == 0 {
+		s.header = header
+		s.oldest = time.Now()
+		atomic.StoreInt64(&s.oldestUnixNanos, s.oldest.UnixNano())
+		if s.maxAge > 0 {
+			generation := s.generation
+			s.ageTimer = time.AfterFunc(s.maxAge, func() { s.flushAged(generation) })
+		}
+	}
+	s.records = append(s.records, record)
+	atomic.StoreInt64(&s.queueDepth, int64(len(s.records)))
+	atomic.AddInt64(&s.bufferedBytes, size)
+	maxCount := s.maxCount
+	if s.adaptive != nil {
+		maxCount = s.adaptive.Size()
+	}
+	var batch [][]byte
+	if maxCount <= 0 && s.maxAge <= 0 || maxCount > 0 && len(s.records) >= maxCount ||
+		s.maxInflightBytes > 0 && s.bufferedBytes >= s.maxInflightBytes {
+		batch, header = s.takeBatchLocked()
+	}
+	s.mutex.Unlock()
+
+	if earlier != nil {
+		s.send(context.Background(), earlier, earlierHeader)
+	}
+	if batch != nil {
+		s.send(context.Background(), batch, header)
+	}
+}
+
+// Flush posts whatever is buffered, including records enqueued while it is flushing, until the buffer is empty or
+// ctx is done. Returns the number of records delivered by this flush and the number left undelivered, i.e. records
+// that failed to post (spilled or deadlettered, including a post interrupted by ctx) plus the records still buffered
+func (s *Sender) Flush(ctx context.Context) (delivered int, undelivered int) {
+	for ctx.Err() == nil {
+		s.mutex.Lock()
+		batch, header := s.takeBatchLocked()
+		s.mutex.Unlock()
+		if batch == nil {
+			break
+		}
+		sent, failed := s.send(ctx, batch, header)
+		delivered += sent
+		undelivered += failed
+	}
+	return delivered, undelivered + s.QueueDepth()
+}
+
+// ReplayDeadletter replays the deadletter of the sender to its endpoint, see Deadletter.Replay
+func (s *Sender) ReplayDeadletter(ctx context.Context) (DeadletterReplayResult, error) {
+	if s.deadletter == nil {
+		return DeadletterReplayResult{}, nil
+	}
+	return s.deadletter.Replay(ctx, s.replayPost)
+}
+
+// QueueDepth returns the number of records buffered and not yet handed over for posting
+func (s *Sender) QueueDepth() int {
+	return int(atomic.LoadInt64(&s.queueDepth))
+}
+
+// BufferedBytes returns the total size of the buffered records
+func (s *Sender) BufferedBytes() int64 {
+	return atomic.LoadInt64(&s.bufferedBytes)
+}
+
+// OldestRecordAge returns how long the oldest buffered record has been waiting, 0 if nothing is buffered
+func (s *Sender) OldestRecordAge() time.Duration {
+	oldest := atomic.LoadInt64(&s.oldestUnixNanos)
+	if oldest == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, oldest))
+}
+
+// AdaptiveBatchSize returns the current adaptive batch size, 0 if adaptive batching is disabled
+func (s *Sender) AdaptiveBatchSize() int {
+	return s.adaptive.Size()
+}
+
+// LastSuccessfulPost returns when a batch was last delivered, the zero time if none was yet
+func (s *Sender) LastSuccessfulPost() time.Time {
+	lastSuccess := atomic.LoadInt64(&s.lastSuccessUnixNanos)
+	if lastSuccess == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastSuccess)
+}
+
+// LastError returns the error of the last failed post, nil if none failed yet. It isn't cleared by a later successful
+// post, compare with LastSuccessfulPost to know whether delivery recovered
+func (s *Sender) LastError() error {
+	if holder, ok := s.lastError.Load().(postError); ok {
+		return holder.err
+	}
+	return nil
+}
+
+// postError wraps the errors stored in Sender.lastError, as an atomic.Value needs values of one concrete type
+type postError struct {
+	err error
+}
+
+// flushAged is called by the age timer armed when the first record of a batch was buffered
+func (s *Sender) flushAged(generation uint64) {
+	s.mutex.Lock()
+	if generation != s.generation {
+		// that batch was already flushed by the count trigger
+		s.mutex.Unlock()
+		return
+	}
+	batch, header := s.takeBatchLocked()
+	s.mutex.Unlock()
+
+	if batch != nil {
+		s.send(context.Background(), batch, header)
+	}
+}
+
+// takeBatchLocked hands over the buffered records and the header they were enqueued with, and resets the batch
+// state. s.mutex must be held
+func (s *Sender) takeBatchLocked() ([][]byte, http.Header) {
+	if len(s.records) == 0 {
+		return nil, nil
+	}
+	batch, header := s.records, s.header
+	s.records = nil
+	s.header = nil
+	s.oldest = time.Time{}
+	atomic.StoreInt64(&s.queueDepth, 0)
+	atomic.StoreInt64(&s.oldestUnixNanos, 0)
+	s.budget.Release(atomic.SwapInt64(&s.bufferedBytes, 0))
+	s.generation++
+	if s.ageTimer != nil {
+		s.ageTimer.Stop()
+		s.ageTimer = nil
+	}
+	return batch, header
+}
+
+// send posts a batch with its header, returning the number of records delivered and the number that failed
+func (s *Sender) send(ctx context.Context, batch [][]byte, header http.Header) (int, int) {
+	delivered := 0
+	for _, chunk := range s.splitOversized(batch) {
+		if s.sendBatch(withBatchHeader(ctx, header), chunk) {
+			delivered += len(chunk)
+		}
+	}
+	if delivered > 0 {
+		s.wakeSpillRetry()
+	}
+	return delivered, len(batch) - delivered
+}
+
+// retrySpilled posts the spilled batches, oldest first, from the spill retry loop.
+// A batch is removed from the store once posted, or deadlettered if it fails with a non-retriable error. Stops at the
+// first batch that fails with a retriable error, which is left in place. Returns whether every spilled batch was posted
+func (s *Sender) retrySpilled(ctx context.Context) bool {
+	if s.spill == nil {
+		return true
+	}
+	s.spillReplayMutex.Lock()
+	defer s.spillReplayMutex.Unlock()
+	// the header of the batch that succeeded doesn't belong to the spilled ones
+	ctx = withBatchHeader(ctx, nil)
+	for ctx.Err() == nil {
+		batch, id, ok, err := s.spill.Peek()
+		if err != nil {
+			Log("Sender::Error::Failed to read spilled batch: %s", err.Error())
+			return false
+		}
+		if !ok {
+			return true
+		}
+		// a batch read from disk is held in memory while it is posted, those of a memorySpillStore already are
+		size := int64(0)
+		if _, inMemory := s.spill.(*memorySpillStore); !inMemory {
+			size = batchBytes(batch)
+		}
+		s.budget.Reserve(size)
+		err = s.postBatch(ctx, batch)
+		s.budget.Release(size)
+		if err != nil && !errors.Is(err, ErrODSNonRetriable) {
+			return false
+		}
+		if err != nil {
+			s.deadletterBatch(batch, err)
+		}
+		if err := s.spill.Remove(id); err != nil {
+			Log("Sender::Error::Failed to remove spilled batch %s: %s", id, err.Error())
+			return false
+		}
+	}
+	return false
+}
+
+// sendBatch posts a batch, spilling or deadlettering it if that fails
+func (s *Sender) sendBatch(ctx context.Context, batch [][]byte) bool {
+	if err := s.postBatch(ctx, batch); err != nil {
+		s.keepFailed(batch, err)
+		return false
+	}
+	return true
+}
+
+// postBatch posts a batch once the pacer allows it, recording the outcome for LastSuccessfulPost, LastError and the
+// adaptive batch size
+func (s *Sender) postBatch(ctx context.Context, batch [][]byte) error {
+	if err := s.pacer.Wait(ctx); err != nil {
+		return fmt.Errorf("Sender: waiting for min_post_interval: %w", err)
+	}
+	start := time.Now()
+	adaptiveStart := s.adaptive.start()
+	err := s.post(ctx, batch)
+	s.adaptive.observe(adaptiveStart, err)
+	if err != nil {
+		s.lastError.Store(postError{err: err})
+		message := fmt.Sprintf("Sender::Error::Failed to flush %d %s records after %s: %s", len(batch), s.dataType, time.Since(start), err.Error())
+		Log(message)
+		return err
+	}
+	atomic.StoreInt64(&s.lastSuccessUnixNanos, time.Now().UnixNano())
+	Log("Sender::Info::Successfully flushed %d %s records in %s", len(batch), s.dataType, time.Since(start))
+	return nil
+}
+
+// keepFailed spills a batch that failed with a retriable error, or deadletters it
+func (s *Sender) keepFailed(batch [][]byte, err error) {
+	if s.spill != nil && !errors.Is(err, ErrODSNonRetriable) {
+		spillErr := s.spill.Push(batch)
+		if spillErr == nil {
+			s.startSpillRetry()
+			return
+		}
+		Log("Sender::Error::Failed to spill %d %s records, deadlettering them: %s", len(batch), s.dataType, spillErr.Error())
+	}
+	s.deadletterBatch(batch, err)
+}
+
+// deadletterBatch keeps the records of a batch that failed with err so they can be replayed with ReplayDeadletter
+func (s *Sender) deadletterBatch(batch [][]byte, err error) {
+	for _, record := range batch {
+		s.deadletter.Write(s.dataType, record, err.Error())
+	}
+}
+
+// splitOversized splits a batch whose payload would exceed maxPayloadBytes into batches that fit.
+// Records that don't fit a payload on their own are deadlettered instead, as the endpoint would reject them anyway
+func (s *Sender) splitOversized(batch [][]byte) [][][]byte {
+	if s.maxPayloadBytes <= 0 {
+		return [][][]byte{batch}
+	}
+	// size of a payload = first + records + separator between every two records
+	first, separator := payloadFraming(s.formatter)
+	var chunks [][][]byte
+	var chunk [][]byte
+	chunkSize := 0
+	batchSize := first - separator
+	rejections := 0
+	for _, record := range batch {
+		if first+len(record) > s.maxPayloadBytes {
+			reason := fmt.Sprintf("record of %d bytes exceeds max_payload_bytes %d", len(record), s.maxPayloadBytes)
+			Log("Sender::Warning::Deadlettering %s %s", s.dataType, reason)
+			s.deadletter.Write(s.dataType, record, reason)
+			rejections++
+			continue
+		}
+		batchSize += separator + len(record)
+		if len(chunk) > 0 && chunkSize+separator+len(record) > s.maxPayloadBytes {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+		if len(chunk) == 0 {
+			chunkSize = first + len(record)
+		} else {
+			chunkSize += separator + len(record)
+		}
+		chunk = append(chunk, record)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) > 1 {
+		Log("Sender::Warning::Splitting %d %s records of about %d bytes exceeding max_payload_bytes %d into %d batches", len(batch), s.dataType, batchSize, s.maxPayloadBytes, len(chunks))
+		rejections++
+	}
+	if rejections > 0 {
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsOversizePayloadCount += float64(rejections)
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	return chunks
+}
+
+// getSenderBatchSettings reads batch_max_count and flush_interval (seconds) from the plugin config.
+// Batching through a Sender is enabled only if at least one of them is set to a positive value
+func getSenderBatchSettings(config map[string]string) (int, time.Duration, bool) {
+	maxCount := 0
+	if value := config["batch_max_count"]; value != "" {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			Log("Invalid value %s for batch_max_count. Disabling count triggered flush", value)
+		} else {
+			maxCount = count
+		}
+	}
+	maxAge := time.Duration(0)
+	if value := config["flush_interval"]; value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			Log("Invalid value %s for flush_interval. Disabling age triggered flush", value)
+		} else {
+			maxAge = time.Duration(seconds) * time.Second
+		}
+	}
+	return maxCount, maxAge, maxCount > 0 || maxAge > 0
+}
+
+// getMaxPayloadBytes reads max_payload_bytes from the plugin config, 0 (no limit) if it isn't set or invalid
+func getMaxPayloadBytes(config map[string]string) int {
+	value := config["max_payload_bytes"]
+	if value == "" {
+		return 0
+	}
+	maxPayloadBytes, err := strconv.Atoi(value)
+	if err != nil || maxPayloadBytes < 0 {
+		Log("Invalid value %s for max_payload_bytes. Not limiting the payload size", value)
+		return 0
+	}
+	return maxPayloadBytes
+}
+
+// getMaxInflightBytes reads max_inflight_bytes from the plugin config, 0 (no limit) if it isn't set or invalid
+func getMaxInflightBytes(config map[string]string) int64 {
+	value := config["max_inflight_bytes"]
+	if value == "" {
+		return 0
+	}
+	maxInflightBytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || maxInflightBytes < 0 {
+		Log("Invalid value %s for max_inflight_bytes. Not limiting the buffered bytes", value)
+		return 0
+	}
+	return maxInflightBytes
+}
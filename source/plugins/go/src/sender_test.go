@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+)
+
+// batchRecorder captures the batches posted by a sender
+type batchRecorder struct {
+	mutex   sync.Mutex
+	batches [][][]byte
+}
+
+func (r *batchRecorder) post(ctx context.Context, records [][]byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.batches = append(r.batches, records)
+	return nil
+}
+
+func (r *batchRecorder) batchSizes() []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var sizes []int
+	for _, batch := range r.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func newTestSender(maxCount int, maxAge time.Duration) (*Sender, *batchRecorder) {
+	recorder := &batchRecorder{}
+	s := newSender(ContainerLogV2DataType, maxCount, maxAge)
+	s.post = recorder.post
+	return s, recorder
+}
+
+func Test_Sender_CountTriggeredFlush(t *testing.T) {
+	s, recorder := newTestSender(3, 0)
+
+	for i := 0; i < 7; i++ {
+		s.Enqueue([]byte(fmt.Sprintf(`{"id":%d}`, i)))
+	}
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[3 3]" {
+		t.Errorf("batch sizes after 7 records = %s, want [3 3]", got)
+	}
+
+	// with the age trigger disabled the remaining record stays buffered
+	time.Sleep(50 * time.Millisecond)
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[3 3]" {
+		t.Errorf("batch sizes after waiting = %s, want [3 3]", got)
+	}
+
+	s.Flush(context.Background())
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[3 3 1]" {
+		t.Errorf("batch sizes after Flush = %s, want [3 3 1]", got)
+	}
+}
+
+func Test_Sender_AgeTriggeredFlush(t *testing.T) {
+	maxAge := 100 * time.Millisecond
+	s, recorder := newTestSender(0, maxAge)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		s.Enqueue([]byte(fmt.Sprintf(`{"id":%d}`, i)))
+	}
+	if got := recorder.batchSizes(); len(got) != 0 {
+		t.Fatalf("batch flushed before the oldest record aged: %v", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.batchSizes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch was not flushed once the oldest record exceeded %s", maxAge)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < maxAge {
+		t.Errorf("batch flushed after %s, want at least %s", elapsed, maxAge)
+	}
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[5]" {
+		t.Errorf("batch sizes = %s, want [5]", got)
+	}
+}
+
+func Test_Sender_SetBatchSettings(t *testing.T) {
+	s, recorder := newTestSender(0, 10*time.Second)
+	waitForBatches := func(n int) time.Time {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(recorder.batchSizes()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("got batches %v, want %d", recorder.batchSizes(), n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return time.Now()
+	}
+
+	// the buffered record is kept and flushed on the new interval instead of the original 10s
+	start := time.Now()
+	s.Enqueue([]byte(`{"id":0}`))
+	s.SetBatchSettings(0, 100*time.Millisecond)
+	if got := s.QueueDepth(); got != 1 {
+		t.Fatalf("QueueDepth() after SetBatchSettings = %d, want the record kept", got)
+	}
+	if elapsed := waitForBatches(1).Sub(start); elapsed < 100*time.Millisecond {
+		t.Errorf("batch flushed after %s, want at least 100ms", elapsed)
+	}
+
+	// the new cadence applies to the following batches
+	start = time.Now()
+	s.Enqueue([]byte(`{"id":1}`))
+	s.Enqueue([]byte(`{"id":2}`))
+	if elapsed := waitForBatches(2).Sub(start); elapsed < 100*time.Millisecond {
+		t.Errorf("second batch flushed after %s, want at least 100ms", elapsed)
+	}
+
+	// a batch already older than the new interval is flushed right away
+	s.SetBatchSettings(0, time.Second)
+	s.Enqueue([]byte(`{"id":3}`))
+	time.Sleep(30 * time.Millisecond)
+	s.SetBatchSettings(0, 10*time.Millisecond)
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[1 2 1]" {
+		t.Errorf("batch sizes after shortening the interval = %s, want [1 2 1]", got)
+	}
+
+	// as is one that reached the new count
+	s.SetBatchSettings(0, time.Minute)
+	s.Enqueue([]byte(`{"id":4}`))
+	s.Enqueue([]byte(`{"id":5}`))
+	s.SetBatchSettings(2, time.Minute)
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[1 2 1 2]" {
+		t.Errorf("batch sizes after lowering batch_max_count = %s, want [1 2 1 2]", got)
+	}
+}
+
+func Test_getSenderBatchSettings(t *testing.T) {
+	type test_struct struct {
+		testname string
+		config   map[string]string
+		maxCount int
+		maxAge   time.Duration
+		enabled  bool
+	}
+
+	tests := []test_struct{
+		{"not configured", map[string]string{}, 0, 0, false},
+		{"count only", map[string]string{"batch_max_count": "500", "flush_interval": "0"}, 500, 0, true},
+		{"age only", map[string]string{"batch_max_count": "0", "flush_interval": "15"}, 0, 15 * time.Second, true},
+		{"both", map[string]string{"batch_max_count": "500", "flush_interval": "15"}, 500, 15 * time.Second, true},
+		{"invalid", map[string]string{"batch_max_count": "many", "flush_interval": "-1"}, 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testname, func(t *testing.T) {
+			maxCount, maxAge, enabled := getSenderBatchSettings(tt.config)
+			if maxCount != tt.maxCount || maxAge != tt.maxAge || enabled != tt.enabled {
+				t.Errorf("getSenderBatchSettings(%v) = (%d, %s, %t), want (%d, %s, %t)", tt.config, maxCount, maxAge, enabled, tt.maxCount, tt.maxAge, tt.enabled)
+			}
+		})
+	}
+}
+
+// readDeadletterEntries returns the entries written to the deadletter file at path
+func readDeadletterEntries(t *testing.T, path string) []DeadletterEntry {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	var entries []DeadletterEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry DeadletterEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("malformed deadletter line %s: %s", line, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func Test_Sender_Transforms(t *testing.T) {
+	deadletterPath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	s, recorder := newTestSender(0, 0)
+	s.deadletter = NewDeadletter(deadletterPath)
+
+	// redact, then drop, then fail: the chain runs in registration order
+	s.AddTransform(func(record []byte) ([]byte, error) {
+		return bytes.Replace(record, []byte("secret"), []byte("***"), -1), nil
+	})
+	s.AddTransform(func(record []byte) ([]byte, error) {
+		if bytes.Contains(record, []byte("kube-system")) {
+			return nil, ErrDropRecord
+		}
+		return record, nil
+	})
+	s.AddTransform(func(record []byte) ([]byte, error) {
+		if bytes.Contains(record, []byte("poison")) {
+			return nil, errors.New("unable to enrich")
+		}
+		return append(record[:len(record)-1:len(record)-1], []byte(`,"enriched":true}`)...), nil
+	})
+
+	s.Enqueue([]byte(`{"LogMessage":"token=secret"}`))
+	s.Enqueue([]byte(`{"PodNamespace":"kube-system"}`))
+	s.Enqueue([]byte(`{"LogMessage":"poison"}`))
+
+	recorder.mutex.Lock()
+	batches := recorder.batches
+	recorder.mutex.Unlock()
+	if len(batches) != 1 || len(batches[0]) != 1 {
+		t.Fatalf("posted batches = %q, want a single record", batches)
+	}
+	if got := string(batches[0][0]); got != `{"LogMessage":"token=***","enriched":true}` {
+		t.Errorf("transformed record = %s", got)
+	}
+
+	entries := readDeadletterEntries(t, deadletterPath)
+	if len(entries) != 1 {
+		t.Fatalf("deadletter entries = %v, want 1", entries)
+	}
+	if entries[0].Record != `{"LogMessage":"poison"}` || !strings.Contains(entries[0].Reason, "unable to enrich") {
+		t.Errorf("deadletter entry = %+v", entries[0])
+	}
+}
+
+func Test_Sender_QueueDepthAndOldestRecordAge(t *testing.T) {
+	s, _ := newTestSender(3, 0)
+
+	if s.QueueDepth() != 0 || s.OldestRecordAge() != 0 {
+		t.Fatalf("empty sender: QueueDepth() = %d, OldestRecordAge() = %s, want 0, 0", s.QueueDepth(), s.OldestRecordAge())
+	}
+
+	s.Enqueue([]byte(`{"id":1}`))
+	time.Sleep(20 * time.Millisecond)
+	s.Enqueue([]byte(`{"id":2}`))
+	if s.QueueDepth() != 2 {
+		t.Errorf("QueueDepth() = %d, want 2", s.QueueDepth())
+	}
+	if age := s.OldestRecordAge(); age < 20*time.Millisecond {
+		t.Errorf("OldestRecordAge() = %s, want at least the age of the first record", age)
+	}
+
+	// the third record reaches batch_max_count and hands the batch over
+	s.Enqueue([]byte(`{"id":3}`))
+	if s.QueueDepth() != 0 || s.OldestRecordAge() != 0 {
+		t.Errorf("after count flush: QueueDepth() = %d, OldestRecordAge() = %s, want 0, 0", s.QueueDepth(), s.OldestRecordAge())
+	}
+
+	s.Enqueue([]byte(`{"id":4}`))
+	if s.QueueDepth() != 1 || s.OldestRecordAge() >= 20*time.Millisecond {
+		t.Errorf("new batch: QueueDepth() = %d, OldestRecordAge() = %s, want 1 and a fresh age", s.QueueDepth(), s.OldestRecordAge())
+	}
+	s.Flush(context.Background())
+	if s.QueueDepth() != 0 || s.OldestRecordAge() != 0 {
+		t.Errorf("after Flush: QueueDepth() = %d, OldestRecordAge() = %s, want 0, 0", s.QueueDepth(), s.OldestRecordAge())
+	}
+}
+
+func Test_Sender_OversizedRecord(t *testing.T) {
+	deadletterPath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	s, recorder := newTestSender(3, 0)
+	s.deadletter = NewDeadletter(deadletterPath)
+	s.maxPayloadBytes = len(buildODSPayload(s.dataType, nil)) + 40
+	ContainerLogsOversizePayloadCount = 0
+
+	oversized := `{"LogEntry":"` + strings.Repeat("x", 40) + `"}`
+	s.Enqueue([]byte(`{"LogEntry":"a"}`))
+	s.Enqueue([]byte(oversized))
+	s.Enqueue([]byte(`{"LogEntry":"b"}`))
+
+	if got := recorder.batchSizes(); len(got) != 1 || got[0] != 2 {
+		t.Errorf("posted batch sizes = %v, want [2]", got)
+	}
+	entries := readDeadletterEntries(t, deadletterPath)
+	if len(entries) != 1 || entries[0].Record != oversized || !strings.Contains(entries[0].Reason, "max_payload_bytes") {
+		t.Errorf("deadletter entries = %+v, want the oversized record with a max_payload_bytes reason", entries)
+	}
+	if ContainerLogsOversizePayloadCount != 1 {
+		t.Errorf("ContainerLogsOversizePayloadCount = %v, want 1", ContainerLogsOversizePayloadCount)
+	}
+}
+
+func Test_Sender_OversizedBatchSplit(t *testing.T) {
+	s, recorder := newTestSender(5, 0)
+	record := []byte(`{"LogEntry":"0123456789"}`)
+	// room for two records and the separating comma
+	s.maxPayloadBytes = len(buildODSPayload(s.dataType, [][]byte{record, record}))
+	ContainerLogsOversizePayloadCount = 0
+
+	for i := 0; i < 5; i++ {
+		s.Enqueue(record)
+	}
+
+	if got, want := recorder.batchSizes(), []int{2, 2, 1}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("posted batch sizes = %v, want %v", got, want)
+	}
+	for _, batch := range recorder.batches {
+		if size := len(buildODSPayload(s.dataType, batch)); size > s.maxPayloadBytes {
+			t.Errorf("posted payload of %d bytes, want at most %d", size, s.maxPayloadBytes)
+		}
+	}
+	if ContainerLogsOversizePayloadCount != 1 {
+		t.Errorf("ContainerLogsOversizePayloadCount = %v, want 1", ContainerLogsOversizePayloadCount)
+	}
+}
+
+func Test_Sender_MaxInflightBytes(t *testing.T) {
+	s, recorder := newTestSender(100, 0)
+	s.maxInflightBytes = 1000
+	record := []byte(`{"LogEntry":"` + strings.Repeat("x", 386) + `"}`)
+
+	// the third 400 byte record would take the buffer over 1000 bytes, long before 100 records are buffered
+	for i := 0; i < 3; i++ {
+		s.Enqueue(record)
+	}
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[2]" {
+		t.Errorf("batch sizes after 3 records = %s, want [2]", got)
+	}
+	if got := s.BufferedBytes(); got != int64(len(record)) {
+		t.Errorf("BufferedBytes() = %d, want %d", got, len(record))
+	}
+
+	// a record larger than the cap flushes what was buffered before it and is posted on its own
+	large := []byte(`{"LogEntry":"` + strings.Repeat("y", 2000) + `"}`)
+	s.Enqueue(large)
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[2 1 1]" {
+		t.Errorf("batch sizes after the large record = %s, want [2 1 1]", got)
+	}
+	if got := string(recorder.batches[2][0]); got != string(large) {
+		t.Errorf("last batch = %s, want the large record", got)
+	}
+	if got := s.BufferedBytes(); got != 0 {
+		t.Errorf("BufferedBytes() after the large record = %d, want 0", got)
+	}
+
+	s.Enqueue(record)
+	s.Flush(context.Background())
+	if got := s.BufferedBytes(); got != 0 {
+		t.Errorf("BufferedBytes() after Flush = %d, want 0", got)
+	}
+}
+
+func Test_getMaxInflightBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1048576", 1048576},
+		{"-1", 0},
+		{"abc", 0},
+	}
+	for _, tt := range tests {
+		if got := getMaxInflightBytes(map[string]string{"max_inflight_bytes": tt.value}); got != tt.want {
+			t.Errorf("getMaxInflightBytes(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_Sender_FlushDeadline(t *testing.T) {
+	deadletterPath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	// neither trigger fires during the test, records are only posted by Flush
+	s, _ := newTestSender(100, time.Hour)
+	s.deadletter = NewDeadletter(deadletterPath)
+	posts := 0
+	s.post = func(ctx context.Context, records [][]byte) error {
+		posts++
+		if posts == 1 {
+			// records enqueued while the first batch is posted are picked up by the same flush
+			for i := 0; i < 3; i++ {
+				s.Enqueue([]byte(`{"LogEntry":"late"}`))
+			}
+			return nil
+		}
+		// the endpoint hangs, the post is interrupted by the flush deadline
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	for i := 0; i < 5; i++ {
+		s.Enqueue([]byte(`{"LogEntry":"early"}`))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	delivered, undelivered := s.Flush(ctx)
+	if delivered != 5 || undelivered != 3 {
+		t.Errorf("Flush() = (%d, %d), want (5, 3)", delivered, undelivered)
+	}
+	if entries := readDeadletterEntries(t, deadletterPath); len(entries) != 3 {
+		t.Errorf("%d deadletter entries, want the 3 records of the interrupted post", len(entries))
+	}
+
+	// with the deadline already expired nothing is posted and everything buffered is reported
+	s.Enqueue([]byte(`{"LogEntry":"buffered"}`))
+	s.Enqueue([]byte(`{"LogEntry":"buffered"}`))
+	delivered, undelivered = s.Flush(ctx)
+	if delivered != 0 || undelivered != 2 {
+		t.Errorf("Flush() after the deadline = (%d, %d), want (0, 2)", delivered, undelivered)
+	}
+	if got := s.QueueDepth(); got != 2 {
+		t.Errorf("QueueDepth() = %d, want the 2 records to stay buffered", got)
+	}
+}
+
+func Test_Sender_LastSuccessfulPost(t *testing.T) {
+	s, recorder := newTestSender(1, 0)
+	if !s.LastSuccessfulPost().IsZero() || s.LastError() != nil {
+		t.Fatalf("LastSuccessfulPost() = %s, LastError() = %v before any post, want zero and nil", s.LastSuccessfulPost(), s.LastError())
+	}
+	failing := false
+	s.post = func(ctx context.Context, records [][]byte) error {
+		if failing {
+			return ErrODSRetriesExhausted
+		}
+		return recorder.post(ctx, records)
+	}
+
+	before := time.Now()
+	s.Enqueue([]byte(`{"LogEntry":"a"}`))
+	lastSuccess := s.LastSuccessfulPost()
+	if lastSuccess.Before(before) || lastSuccess.After(time.Now()) {
+		t.Errorf("LastSuccessfulPost() = %s, want the time of the successful post", lastSuccess)
+	}
+
+	failing = true
+	s.Enqueue([]byte(`{"LogEntry":"b"}`))
+	if got := s.LastSuccessfulPost(); !got.Equal(lastSuccess) {
+		t.Errorf("LastSuccessfulPost() = %s after a failed post, want it unchanged at %s", got, lastSuccess)
+	}
+	if !errors.Is(s.LastError(), ErrODSRetriesExhausted) {
+		t.Errorf("LastError() = %v, want the post error", s.LastError())
+	}
+}
+
+// newBatchSizeServer records the number of data items of every payload posted to it
+func newBatchSizeServer(t *testing.T) (*httptest.Server, func() []int) {
+	var mutex sync.Mutex
+	var sizes []int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			DataItems []json.RawMessage
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("server got malformed payload: %v", err)
+		}
+		mutex.Lock()
+		sizes = append(sizes, len(payload.DataItems))
+		mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]int(nil), sizes...)
+	}
+}
+
+// newIsolatedSenderConfig returns a function building the config of a NewSender sender posting to endpoint, with
+// its own deadletter and spillover path under a temporary directory
+func newIsolatedSenderConfig(t *testing.T) func(name string, endpoint string, batchMaxCount string) map[string]string {
+	dir := t.TempDir()
+	certPEM, keyPEM := generateTestCertificate(t, "sender")
+	certFile, keyFile := filepath.Join(dir, "oms.crt"), filepath.Join(dir, "oms.key")
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return func(name string, endpoint string, batchMaxCount string) map[string]string {
+		return map[string]string{
+			"endpoint":             endpoint,
+			"cert_file_path":       certFile,
+			"key_file_path":        keyFile,
+			"insecure_skip_verify": "true",
+			"batch_max_count":      batchMaxCount,
+			"data_type":            ContainerLogV2DataType,
+			"deadletter_file_path": filepath.Join(dir, name+"-deadletter.jsonl"),
+			"spillover_path":       filepath.Join(dir, name+"-buffer"),
+		}
+	}
+}
+
+func Test_NewSender_Isolated(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	// the plugin globals aren't used
+	originalEndpoint := OMSEndpoint
+	OMSEndpoint = "https://unused.invalid"
+	defer func() { OMSEndpoint = originalEndpoint }()
+
+	newConfig := newIsolatedSenderConfig(t)
+	serverA, sizesA := newBatchSizeServer(t)
+	serverB, sizesB := newBatchSizeServer(t)
+	senderA, err := NewSender(newConfig("a", serverA.URL, "2"))
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+	senderB, err := NewSender(newConfig("b", serverB.URL, "3"))
+	if err != nil {
+		t.Fatalf("NewSender() error = %v", err)
+	}
+
+	for i := 0; i < 7; i++ {
+		record := []byte(fmt.Sprintf(`{"LogMessage":"%d"}`, i))
+		senderA.Enqueue(record)
+		senderB.Enqueue(record)
+	}
+	if got, want := sizesA(), []int{2, 2, 2}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sender A posted batches of %v, want %v", got, want)
+	}
+	if got, want := sizesB(), []int{3, 3}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sender B posted batches of %v, want %v", got, want)
+	}
+	if senderA.QueueDepth() != 1 || senderB.QueueDepth() != 1 {
+		t.Errorf("queue depths = %d and %d, want 1 each", senderA.QueueDepth(), senderB.QueueDepth())
+	}
+
+	// a failing endpoint only affects its own sender
+	serverB.Close()
+	senderA.Flush(context.Background())
+	senderB.Flush(context.Background())
+	if senderA.LastError() != nil || senderA.LastSuccessfulPost().IsZero() {
+		t.Errorf("sender A LastError() = %v, want delivery to succeed", senderA.LastError())
+	}
+	if senderB.LastError() == nil {
+		t.Errorf("sender B LastError() = nil, want the failed post to its closed endpoint")
+	}
+}
+
+func Test_NewSender_ReplaysDeadletterToItsEndpoint(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	// records posted to each server, and whether they were gzipped
+	newRecordingServer := func() (*httptest.Server, func() []string) {
+		var mutex sync.Mutex
+		var received []string
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				reader, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Errorf("server got malformed gzip payload: %v", err)
+					return
+				}
+				body = reader
+			}
+			var payload struct {
+				DataItems []json.RawMessage
+			}
+			if err := json.NewDecoder(body).Decode(&payload); err != nil {
+				t.Errorf("server got malformed payload: %v", err)
+			}
+			mutex.Lock()
+			for _, item := range payload.DataItems {
+				received = append(received, fmt.Sprintf("%s gzip=%t", item, r.Header.Get("Content-Encoding") == "gzip"))
+			}
+			mutex.Unlock()
+			w.WriteHeader(http.StatusOK)
+		}))
+		t.Cleanup(server.Close)
+		return server, func() []string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return append([]string(nil), received...)
+		}
+	}
+	serverA, receivedA := newRecordingServer()
+	serverB, receivedB := newRecordingServer()
+	pluginServer, receivedByPlugin := newRecordingServer()
+	originalEndpoint, originalClient := OMSEndpoint, HTTPClient
+	OMSEndpoint, HTTPClient = pluginServer.URL, *pluginServer.Client()
+	defer func() { OMSEndpoint, HTTPClient = originalEndpoint, originalClient }()
+
+	newConfig := newIsolatedSenderConfig(t)
+	configA := newConfig("a", serverA.URL, "1")
+	// only sender A gzips its payloads, the plugin doesn't
+	configA["gzip_min_bytes"] = "1"
+	senders := map[string]*Sender{}
+	for name, config := range map[string]map[string]string{"a": configA, "b": newConfig("b", serverB.URL, "1")} {
+		sender, err := NewSender(config)
+		if err != nil {
+			t.Fatalf("NewSender() error = %v", err)
+		}
+		if err := ioutil.WriteFile(config["deadletter_file_path"], []byte(deadletterLine(t, `{"LogMessage":"`+name+`"}`)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		senders[name] = sender
+	}
+
+	for name, sender := range senders {
+		if result, err := sender.ReplayDeadletter(context.Background()); err != nil || result.Replayed != 1 {
+			t.Fatalf("sender %s ReplayDeadletter() = (%+v, %v), want 1 replayed", name, result, err)
+		}
+	}
+	if got := fmt.Sprint(receivedA()); got != `[{"LogMessage":"a"} gzip=true]` {
+		t.Errorf("server A received %s, want only the record of sender A, gzipped", got)
+	}
+	if got := fmt.Sprint(receivedB()); got != `[{"LogMessage":"b"} gzip=false]` {
+		t.Errorf("server B received %s, want only the record of sender B", got)
+	}
+	if got := receivedByPlugin(); len(got) != 0 {
+		t.Errorf("OMSEndpoint of the plugin received %v, want nothing", got)
+	}
+}
+
+func Test_NewSender_Errors(t *testing.T) {
+	if _, err := NewSender(map[string]string{}); !errors.Is(err, ErrInvalidEndpointURL) {
+		t.Errorf("NewSender() without an endpoint error = %v, want ErrInvalidEndpointURL", err)
+	}
+	config := map[string]string{"endpoint": "https://example.com", "cert_file_path": "/nonexistent.crt", "key_file_path": "/nonexistent.key"}
+	if _, err := NewSender(config); !errors.Is(err, ErrCertLoad) {
+		t.Errorf("NewSender() with missing cert error = %v, want ErrCertLoad", err)
+	}
+}
+
+func Test_PostDataHelper_SenderUpdatesFlushTelemetry(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	sender, recorder := newTestSender(2, 0)
+	ContainerLogSender = sender
+	defer func() { ContainerLogSender = nil }()
+	resetTelemetry := func() {
+		ContainerLogTelemetryMutex.Lock()
+		FlushedRecordsCount, FlushedRecordsTimeTaken, FlushedRecordsSize = 0, 0, 0
+		AgentLogProcessingMaxLatencyMs, AgentLogProcessingMaxLatencyMsContainer = 0, ""
+		ContainerLogTelemetryMutex.Unlock()
+	}
+	resetTelemetry()
+	defer resetTelemetry()
+
+	loggedAt := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	var records []map[interface{}]interface{}
+	for _, line := range []string{"first", "second"} {
+		records = append(records, map[interface{}]interface{}{
+			"filepath": []byte("/var/log/containers/web-0_default_nginx-0123456789abcdef.log"),
+			"stream":   []byte("stdout"),
+			"log":      []byte(line),
+			"time":     []byte(loggedAt),
+		})
+	}
+	if code := PostDataHelper(records); code != output.FLB_OK {
+		t.Fatalf("PostDataHelper() = %d, want FLB_OK", code)
+	}
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[2]" {
+		t.Errorf("batch sizes = %s, want [2]", got)
+	}
+	ContainerLogTelemetryMutex.Lock()
+	defer ContainerLogTelemetryMutex.Unlock()
+	if FlushedRecordsCount != 2 {
+		t.Errorf("FlushedRecordsCount = %v, want 2", FlushedRecordsCount)
+	}
+	if AgentLogProcessingMaxLatencyMs < float64(time.Minute/time.Millisecond) || AgentLogProcessingMaxLatencyMsContainer != "=0123456789abcdef" {
+		t.Errorf("max latency = %v ms of %q, want at least a minute for the nginx container", AgentLogProcessingMaxLatencyMs, AgentLogProcessingMaxLatencyMsContainer)
+	}
+}
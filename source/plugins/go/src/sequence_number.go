@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// name of the file the sequence lease is persisted to, in the spillover directory
+const sequenceFileName = "sequence"
+
+// numbers leased per write of the sequence file, a restart skips what was left of the lease
+const sequenceLeaseSize = 1000
+
+// SequenceCounter hands out monotonically increasing sequence numbers, starting at 1. It can persist them to a file
+// so they keep increasing across restarts: the file holds the end of a lease of sequenceLeaseSize numbers, written
+// before any number of the lease is handed out, and a restarted counter resumes at that end. Numbers are unique and
+// increasing but not contiguous across a restart
+type SequenceCounter struct {
+	mutex sync.Mutex
+	next  uint64
+	// leaseEnd is the first number not covered by the persisted lease
+	leaseEnd uint64
+	// path of the sequence file, empty if the counter isn't persisted
+	path string
+}
+
+// NewSequenceCounter creates a counter starting at 1 on every start
+func NewSequenceCounter() *SequenceCounter {
+	return &SequenceCounter{next: 1}
+}
+
+// LoadSequenceCounter creates a counter persisted to path, resuming after the numbers a previous run may have handed
+// out. A missing file starts at 1
+func LoadSequenceCounter(path string) (*SequenceCounter, error) {
+	counter := &SequenceCounter{next: 1, path: path}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("LoadSequenceCounter: %w", err)
+	}
+	if err == nil {
+		leaseEnd, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("LoadSequenceCounter: %s is corrupt: %w", path, err)
+		}
+		counter.next = leaseEnd
+		counter.leaseEnd = leaseEnd
+	}
+	return counter, nil
+}
+
+// Next returns the next sequence number, extending the persisted lease when it is used up. If the lease can't be
+// written the numbers keep increasing for this run, only resuming after a restart isn't guaranteed
+func (c *SequenceCounter) Next() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.path != "" && c.next >= c.leaseEnd {
+		leaseEnd := c.next + sequenceLeaseSize
+		if err := writeSequenceLease(c.path, leaseEnd); err != nil {
+			message := fmt.Sprintf("SequenceCounter::Error::Unable to persist the sequence lease to %s: %s", c.path, err.Error())
+			Log(message)
+			SendException(message)
+		} else {
+			c.leaseEnd = leaseEnd
+		}
+	}
+	n := c.next
+	c.next++
+	return n
+}
+
+// writeSequenceLease replaces the sequence file, through a temp file so a crash never leaves it half written
+func writeSequenceLease(path string, leaseEnd uint64) error {
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, []byte(strconv.FormatUint(leaseEnd, 10)), 0600); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Transform returns a transform stamping every record, a json object, with the next sequence number in field.
+// The field is appended last, so it wins over a field of the same name already in the record
+func (c *SequenceCounter) Transform(field string) RecordTransform {
+	encodedField := strconv.Quote(field)
+	return func(record []byte) ([]byte, error) {
+		trimmed := bytes.TrimSpace(record)
+		if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' {
+			return nil, errors.New("record isn't a json object, unable to add its sequence number")
+		}
+		body := bytes.TrimSpace(trimmed[1 : len(trimmed)-1])
+		stamped := make([]byte, 0, len(trimmed)+len(encodedField)+22)
+		stamped = append(stamped, '{')
+		if len(body) > 0 {
+			stamped = append(stamped, body...)
+			stamped = append(stamped, ',')
+		}
+		stamped = append(stamped, encodedField...)
+		stamped = append(stamped, ':')
+		stamped = strconv.AppendUint(stamped, c.Next(), 10)
+		return append(stamped, '}'), nil
+	}
+}
+
+// getSequenceCounter creates the counter stamping records in sequence_number_field (off unless set). With
+// sequence_number_persist the counter is persisted alongside the disk spillover, so it keeps increasing across
+// restarts
+func getSequenceCounter(config map[string]string, spill spillStore) (*SequenceCounter, string) {
+	field := strings.TrimSpace(config["sequence_number_field"])
+	if field == "" {
+		return nil, ""
+	}
+	if !GetBool(config, "sequence_number_persist", false) {
+		Log("Stamping records with a sequence number in %s", field)
+		return NewSequenceCounter(), field
+	}
+	store, ok := spill.(*diskSpillStore)
+	if !ok {
+		message := fmt.Sprintf("sequence_number_persist needs a writable spillover_path, %s sequence numbers restart at 1 on restart", field)
+		Log(message)
+		SendException(message)
+		return NewSequenceCounter(), field
+	}
+	path := filepath.Join(store.dir, sequenceFileName)
+	counter, err := LoadSequenceCounter(path)
+	if err != nil {
+		message := fmt.Sprintf("Error loading the sequence counter, %s sequence numbers aren't persisted: %s", field, err.Error())
+		Log(message)
+		SendException(message)
+		return NewSequenceCounter(), field
+	}
+	Log("Stamping records with a sequence number in %s, persisted to %s", field, path)
+	return counter, field
+}
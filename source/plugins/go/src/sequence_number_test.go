@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// sequenceNumbers decodes the Seq field of the posted records, in the order they were posted
+func sequenceNumbers(t *testing.T, recorder *batchRecorder) []uint64 {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	var numbers []uint64
+	for _, batch := range recorder.batches {
+		for _, record := range batch {
+			var stamped struct{ Seq uint64 }
+			if err := json.Unmarshal(record, &stamped); err != nil {
+				t.Fatalf("stamped record %s isn't json: %v", record, err)
+			}
+			numbers = append(numbers, stamped.Seq)
+		}
+	}
+	return numbers
+}
+
+func Test_SequenceCounter_AcrossBatchesAndRestart(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	config := map[string]string{
+		"sequence_number_field":   "Seq",
+		"sequence_number_persist": "true",
+		"spillover_path":          filepath.Join(t.TempDir(), "buffer"),
+	}
+	newStampingSender := func() (*Sender, *batchRecorder) {
+		s, recorder := newTestSender(3, 0)
+		s.configure(config)
+		s.post = recorder.post
+		return s, recorder
+	}
+
+	s, recorder := newStampingSender()
+	for i := 0; i < 7; i++ {
+		s.Enqueue([]byte(fmt.Sprintf(`{"LogEntry":"%d"}`, i)))
+	}
+	s.Flush(context.Background())
+	if got := fmt.Sprint(sequenceNumbers(t, recorder)); got != "[1 2 3 4 5 6 7]" {
+		t.Errorf("sequence numbers = %s, want [1 2 3 4 5 6 7] across the batches", got)
+	}
+
+	// a restarted sender resumes after every number the previous run may have handed out
+	restarted, restartedRecorder := newStampingSender()
+	restarted.Enqueue([]byte(`{"LogEntry":"after restart"}`))
+	restarted.Enqueue([]byte(`{"LogEntry":"after restart"}`))
+	restarted.Flush(context.Background())
+	numbers := sequenceNumbers(t, restartedRecorder)
+	if len(numbers) != 2 || numbers[0] <= 7 || numbers[1] != numbers[0]+1 {
+		t.Errorf("sequence numbers after restart = %v, want increasing numbers after 7", numbers)
+	}
+}
+
+func Test_SequenceCounter_Concurrent(t *testing.T) {
+	counter, err := LoadSequenceCounter(filepath.Join(t.TempDir(), sequenceFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const goroutines, perGoroutine = 8, 500
+	var mutex sync.Mutex
+	var numbers []uint64
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var mine []uint64
+			for j := 0; j < perGoroutine; j++ {
+				n := counter.Next()
+				if len(mine) > 0 && n <= mine[len(mine)-1] {
+					t.Errorf("got %d after %d, want increasing numbers", n, mine[len(mine)-1])
+				}
+				mine = append(mine, n)
+			}
+			mutex.Lock()
+			numbers = append(numbers, mine...)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for i, n := range numbers {
+		if n != uint64(i+1) {
+			t.Fatalf("sorted sequence numbers[%d] = %d, want %d: numbers aren't unique", i, n, i+1)
+		}
+	}
+}
+
+func Test_SequenceCounter_Transform(t *testing.T) {
+	transform := NewSequenceCounter().Transform("Seq")
+	tests := []struct {
+		record  string
+		want    string
+		wantErr bool
+	}{
+		{`{"LogEntry":"a"}`, `{"LogEntry":"a","Seq":1}`, false},
+		{` {} `, `{"Seq":2}`, false},
+		{`{"Seq":"mine"}`, `{"Seq":"mine","Seq":3}`, false},
+		{`["not","an","object"]`, ``, true},
+		{``, ``, true},
+	}
+	for _, tt := range tests {
+		got, err := transform([]byte(tt.record))
+		if (err != nil) != tt.wantErr || string(got) != tt.want {
+			t.Errorf("transform(%q) = (%s, %v), want (%s, error %t)", tt.record, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func Test_LoadSequenceCounter_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), sequenceFileName)
+	if err := ioutil.WriteFile(path, []byte("not a number"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSequenceCounter(path); err == nil {
+		t.Errorf("LoadSequenceCounter() of a corrupt file succeeded, want error")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// shutdown_on_timeout values
+const (
+	// the undelivered records are spilled to disk and posted after the restart (deadlettered without a disk store)
+	shutdownSpillToDisk = "spill_to_disk"
+	// the undelivered records are discarded
+	shutdownDrop = "drop"
+	// the undelivered records are left buffered in the sender, only their count is logged
+	shutdownLogOnly = "log_only"
+)
+
+// Shutdown flushes the sender until ctx is done, then hands the records that weren't delivered by then to the
+// shutdown_on_timeout policy, including a post interrupted by the deadline. Posts failing before the deadline are
+// spilled or deadlettered as usual. The spill retry loop is stopped, the spilled batches are left for the next start.
+// Returns the number of records delivered and the number handled by the policy
+func (s *Sender) Shutdown(ctx context.Context) (int, int) {
+	s.stopSpillRetry()
+	delivered := 0
+	var pending [][]byte
+	for {
+		s.mutex.Lock()
+		batch, header := s.takeBatchLocked()
+		s.mutex.Unlock()
+		if batch == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			pending = append(pending, batch...)
+			continue
+		}
+		for _, chunk := range s.splitOversized(batch) {
+			if ctx.Err() != nil {
+				pending = append(pending, chunk...)
+				continue
+			}
+			err := s.postBatch(withBatchHeader(ctx, header), chunk)
+			switch {
+			case err == nil:
+				delivered += len(chunk)
+			case ctx.Err() != nil:
+				pending = append(pending, chunk...)
+			default:
+				s.keepFailed(chunk, err)
+			}
+		}
+	}
+	if len(pending) > 0 {
+		s.applyShutdownPolicy(pending)
+	}
+	return delivered, len(pending)
+}
+
+// applyShutdownPolicy handles the records left when the shutdown deadline elapsed
+func (s *Sender) applyShutdownPolicy(records [][]byte) {
+	switch s.shutdownPolicy {
+	case shutdownSpillToDisk:
+		if store, ok := s.spill.(*diskSpillStore); ok {
+			err := store.Push(records)
+			if err == nil {
+				Log("Shutdown::Warning::Shutdown deadline elapsed, spilled %d undelivered %s records to %s", len(records), s.dataType, store.dir)
+				return
+			}
+			Log("Shutdown::Error::Failed to spill %d %s records, deadlettering them: %s", len(records), s.dataType, err.Error())
+		}
+		for _, record := range records {
+			s.deadletter.Write(s.dataType, record, "shutdown deadline elapsed")
+		}
+		Log("Shutdown::Warning::Shutdown deadline elapsed, deadlettered %d undelivered %s records", len(records), s.dataType)
+	case shutdownDrop:
+		Log("Shutdown::Warning::Shutdown deadline elapsed, dropped %d undelivered %s records", len(records), s.dataType)
+		ContainerLogTelemetryMutex.Lock()
+		ContainerLogsOverflowDroppedRecordCount += float64(len(records))
+		ContainerLogTelemetryMutex.Unlock()
+	default:
+		s.mutex.Lock()
+		s.records = append(append([][]byte(nil), records...), s.records...)
+		atomic.StoreInt64(&s.queueDepth, int64(len(s.records)))
+		size := batchBytes(records)
+		atomic.AddInt64(&s.bufferedBytes, size)
+		s.budget.ForceReserve(size)
+		s.mutex.Unlock()
+		Log("Shutdown::Warning::Shutdown deadline elapsed, %d undelivered %s records are left buffered", len(records), s.dataType)
+	}
+}
+
+// getShutdownPolicy returns shutdown_on_timeout from the plugin config. It defaults to spill_to_disk when the
+// sender spills to disk and to log_only otherwise
+func getShutdownPolicy(config map[string]string, spill spillStore) string {
+	defaultPolicy := shutdownLogOnly
+	if _, ok := spill.(*diskSpillStore); ok {
+		defaultPolicy = shutdownSpillToDisk
+	}
+	switch policy := strings.ToLower(strings.TrimSpace(config["shutdown_on_timeout"])); policy {
+	case "":
+		return defaultPolicy
+	case shutdownSpillToDisk, shutdownDrop, shutdownLogOnly:
+		return policy
+	default:
+		Log("Invalid value %s for shutdown_on_timeout. Using %s", policy, defaultPolicy)
+		return defaultPolicy
+	}
+}
+
+// getShutdownGracePeriod reads shutdown_grace_period (seconds) from the plugin config, how long the buffered records
+// are flushed on exit before shutdown_on_timeout applies (right away with 0)
+func getShutdownGracePeriod(config map[string]string) time.Duration {
+	return getTimeoutFromConfig(config, "shutdown_grace_period", defaultShutdownGracePeriodSeconds)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newHangingSender returns a sender with 5 buffered records whose first post delivers and buffers 3 more records,
+// while every later post hangs until its context is done
+func newHangingSender(t *testing.T, policy string) *Sender {
+	s, _ := newTestSender(100, time.Hour)
+	s.deadletter = NewDeadletter(filepath.Join(t.TempDir(), "deadletter.jsonl"))
+	s.shutdownPolicy = policy
+	posts := 0
+	s.post = func(ctx context.Context, records [][]byte) error {
+		posts++
+		if posts == 1 {
+			for i := 0; i < 3; i++ {
+				s.Enqueue([]byte(`{"LogEntry":"late"}`))
+			}
+			return nil
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	for i := 0; i < 5; i++ {
+		s.Enqueue([]byte(`{"LogEntry":"early"}`))
+	}
+	return s
+}
+
+func Test_Sender_Shutdown(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+
+	tests := []struct {
+		name             string
+		policy           string
+		diskSpill        bool
+		wantSpilled      int
+		wantDeadlettered int
+		wantBuffered     int
+		wantLogSubstr    string
+	}{
+		{"spill to disk", shutdownSpillToDisk, true, 1, 0, 0, "spilled 3 undelivered"},
+		{"spill without a disk store", shutdownSpillToDisk, false, 0, 3, 0, "deadlettered 3 undelivered"},
+		{"drop", shutdownDrop, true, 0, 0, 0, "dropped 3 undelivered"},
+		{"log only", shutdownLogOnly, true, 0, 0, 3, "3 undelivered " + ContainerLogV2DataType + " records are left buffered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newHangingSender(t, tt.policy)
+			if tt.diskSpill {
+				store, err := newDiskSpillStore(filepath.Join(t.TempDir(), "buffer"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.spill = store
+			} else {
+				s.spill = newMemorySpillStore(100)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			delivered, handled := s.Shutdown(ctx)
+			if delivered != 5 || handled != 3 {
+				t.Errorf("Shutdown() = (%d, %d), want (5, 3)", delivered, handled)
+			}
+			if _, ok := s.spill.(*diskSpillStore); ok && s.spill.Len() != tt.wantSpilled {
+				t.Errorf("%d spilled batches, want %d", s.spill.Len(), tt.wantSpilled)
+			}
+			deadlettered := 0
+			if _, err := os.Stat(s.deadletter.path); err == nil {
+				deadlettered = len(readDeadletterEntries(t, s.deadletter.path))
+			}
+			if deadlettered != tt.wantDeadlettered {
+				t.Errorf("%d deadlettered records, want %d", deadlettered, tt.wantDeadlettered)
+			}
+			if s.QueueDepth() != tt.wantBuffered {
+				t.Errorf("QueueDepth() = %d, want %d", s.QueueDepth(), tt.wantBuffered)
+			}
+			if want := int64(tt.wantBuffered * len(`{"LogEntry":"late"}`)); s.BufferedBytes() != want {
+				t.Errorf("BufferedBytes() = %d, want %d", s.BufferedBytes(), want)
+			}
+			if !loggedContaining(logged(), tt.wantLogSubstr) {
+				t.Errorf("%q wasn't logged", tt.wantLogSubstr)
+			}
+		})
+	}
+}
+
+func Test_getShutdownPolicy(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	disk, err := newDiskSpillStore(filepath.Join(t.TempDir(), "buffer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value string
+		spill spillStore
+		want  string
+	}{
+		{"", disk, shutdownSpillToDisk},
+		{"", newMemorySpillStore(10), shutdownLogOnly},
+		{"", nil, shutdownLogOnly},
+		{"DROP", disk, shutdownDrop},
+		{"log_only", disk, shutdownLogOnly},
+		{"spill_to_disk", nil, shutdownSpillToDisk},
+		{"retry", disk, shutdownSpillToDisk},
+	}
+	for _, tt := range tests {
+		if got := getShutdownPolicy(map[string]string{"shutdown_on_timeout": tt.value}, tt.spill); got != tt.want {
+			t.Errorf("getShutdownPolicy(%q, %T) = %s, want %s", tt.value, tt.spill, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// startSpillRetry starts the loop posting the spilled batches with exponential backoff, unless it already runs, the
+// sender was shut down or spillover_retry_initial_delay is 0. Spilled batches are otherwise only retried once
+// wakeSpillRetry is called after a post succeeded, which never happens while nothing new is logged
+func (s *Sender) startSpillRetry() {
+	if s.spill == nil || s.spillRetryInitialDelay <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.runSpillRetryLocked(false)
+}
+
+// wakeSpillRetry has the spill retry loop post the spilled batches right away, starting it if needed. Called after a
+// post succeeded, the spilled batches are posted in the background rather than holding up the caller
+func (s *Sender) wakeSpillRetry() {
+	if s.spill == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.runSpillRetryLocked(true)
+}
+
+// runSpillRetryLocked starts the spill retry loop unless it already runs, the sender was shut down or nothing is
+// spilled. wake cuts the backoff of the loop short. s.mutex must be held
+func (s *Sender) runSpillRetryLocked(wake bool) {
+	if s.spillRetryStopped || s.spill.Len() == 0 {
+		return
+	}
+	if s.spillRetryWake == nil {
+		s.spillRetryWake = make(chan struct{}, 1)
+	}
+	if wake {
+		select {
+		case s.spillRetryWake <- struct{}{}:
+		default:
+		}
+	}
+	if s.spillRetrying {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.spillRetrying = true
+	s.spillRetryCancel = cancel
+	go s.spillRetryLoop(ctx, s.spillRetryWake)
+}
+
+// spillRetryLoop posts the spilled batches spillRetryInitialDelay after they were spilled, doubling the delay up to
+// spillRetryMaxDelay every time the oldest batch fails again, until the store is empty or ctx is done. A wake posts
+// them right away, with a delay of 0 the loop only posts when woken
+func (s *Sender) spillRetryLoop(ctx context.Context, wake <-chan struct{}) {
+	delay := s.spillRetryInitialDelay
+	for {
+		// checked under the mutex so a batch spilled as the loop ends starts a new one
+		s.mutex.Lock()
+		if ctx.Err() != nil || s.spill.Len() == 0 {
+			s.spillRetrying = false
+			s.spillRetryCancel = nil
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+
+		var timer *time.Timer
+		var elapsed <-chan time.Time
+		if delay > 0 {
+			timer = time.NewTimer(delay)
+			elapsed = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-elapsed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+		if s.retrySpilled(ctx) {
+			delay = s.spillRetryInitialDelay
+			continue
+		}
+		if delay == 0 {
+			Log("Sender::Warning::Posting the spilled %s batches failed, %d left, retrying after the next successful post", s.dataType, s.spill.Len())
+			continue
+		}
+		Log("Sender::Warning::Posting the spilled %s batches failed, %d left, retrying in %s", s.dataType, s.spill.Len(), delay)
+		delay *= 2
+		if delay > s.spillRetryMaxDelay {
+			delay = s.spillRetryMaxDelay
+		}
+	}
+}
+
+// stopSpillRetry stops the spill retry loop for good, the spilled batches are left for the next start
+func (s *Sender) stopSpillRetry() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.spillRetryStopped = true
+	if s.spillRetryCancel != nil {
+		s.spillRetryCancel()
+	}
+}
+
+// getSpillRetryDelays reads spillover_retry_initial_delay and spillover_retry_max_delay (seconds) from the plugin
+// config. A max delay below the initial delay is raised to it
+func getSpillRetryDelays(config map[string]string) (time.Duration, time.Duration) {
+	initialDelay := getTimeoutFromConfig(config, "spillover_retry_initial_delay", defaultSpillRetryInitialDelaySeconds)
+	maxDelay := getTimeoutFromConfig(config, "spillover_retry_max_delay", defaultSpillRetryMaxDelaySeconds)
+	if maxDelay < initialDelay {
+		maxDelay = initialDelay
+	}
+	return initialDelay, maxDelay
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default directory batches that failed to post are spilled to, can be overridden with spillover_path in the plugin config
+const defaultLinuxSpilloverPath = "/var/opt/microsoft/docker-cimprov/state/buffer"
+const defaultWindowsSpilloverPath = "/etc/omsagentwindows/buffer"
+
+// default number of records kept in memory when the spillover path isn't writable (memory_overflow_max_records in the plugin config)
+const defaultMemoryOverflowMaxRecords = 10000
+
+// default total size of the spilled batch files, the oldest are dropped beyond it (spillover_max_bytes in the plugin config)
+const defaultSpilloverMaxBytes = 100 * 1024 * 1024
+
+// default number of seconds a spilled batch is kept before it is dropped unposted (spillover_retention in the plugin config)
+const defaultSpilloverRetentionSeconds = 24 * 60 * 60
+
+// spilled batch files are named <unix nanoseconds>-<sequence>.batch so they sort oldest first
+const spillFileSuffix = ".batch"
+
+// spillStore keeps batches that failed to post with a retriable error until they can be retried, oldest first
+type spillStore interface {
+	// Push stores a batch
+	Push(batch [][]byte) error
+	// Peek returns the oldest batch without removing it, with the id to Remove it by once it was posted, false if
+	// there is none
+	Peek() ([][]byte, string, bool, error)
+	// Remove removes the batch with the id returned by Peek, unless it was dropped in the meantime
+	Remove(id string) error
+	// Len returns the number of stored batches
+	Len() int
+}
+
+// newSpillStore returns a disk store under spillover_path bounded by spillover_max_bytes and spillover_retention, or,
+// if that path isn't writable (e.g. read-only root filesystem), a bounded in-memory store of
+// memory_overflow_max_records records dropping the oldest on overflow
+func newSpillStore(config map[string]string) spillStore {
+	path := getSpilloverPath(config)
+	store, err := newDiskSpillStore(path)
+	if err == nil {
+		store.maxBytes = getSpilloverMaxBytes(config)
+		store.retention = getTimeoutFromConfig(config, "spillover_retention", defaultSpilloverRetentionSeconds)
+		Log("Spilling batches that fail to post to %s, keeping at most %d bytes for %s", path, store.maxBytes, store.retention)
+		return store
+	}
+
+	maxRecords := defaultMemoryOverflowMaxRecords
+	if value := config["memory_overflow_max_records"]; value != "" {
+		count, convErr := strconv.Atoi(value)
+		if convErr != nil || count <= 0 {
+			Log("Invalid value %s for memory_overflow_max_records. Using default of %d", value, defaultMemoryOverflowMaxRecords)
+		} else {
+			maxRecords = count
+		}
+	}
+	message := fmt.Sprintf("Warning::DEGRADED MODE::spillover path %s isn't writable, keeping at most %d records that fail to post in memory. They are lost on restart and the oldest are dropped on overflow: %s", path, maxRecords, err.Error())
+	warnLoudly(message, "", nil)
+	memoryStore := newMemorySpillStore(maxRecords)
+	memoryStore.budget = ProcessMemoryBudget
+	return memoryStore
+}
+
+// getSpilloverPath returns spillover_path from the plugin config or the default for the OS
+func getSpilloverPath(config map[string]string) string {
+	if path := strings.TrimSpace(config["spillover_path"]); path != "" {
+		return path
+	}
+	if strings.Compare(strings.ToLower(os.Getenv("OS_TYPE")), "windows") == 0 {
+		return defaultWindowsSpilloverPath
+	}
+	return defaultLinuxSpilloverPath
+}
+
+// getSpilloverMaxBytes reads spillover_max_bytes from the plugin config, 0 for no limit
+func getSpilloverMaxBytes(config map[string]string) int64 {
+	value := config["spillover_max_bytes"]
+	if value == "" {
+		return defaultSpilloverMaxBytes
+	}
+	maxBytes, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || maxBytes < 0 {
+		Log("Invalid value %s for spillover_max_bytes. Using default of %d", value, defaultSpilloverMaxBytes)
+		return defaultSpilloverMaxBytes
+	}
+	return maxBytes
+}
+
+// diskSpillStore keeps every batch in its own file, one record per line. When maxBytes is set the oldest batches are
+// dropped to keep the total size of the files under it, and when retention is set batches older than that are
+// dropped unposted
+type diskSpillStore struct {
+	mutex    sync.Mutex
+	dir      string
+	sequence uint64
+	count    int
+	// total size of the batch files
+	bytes     int64
+	maxBytes  int64
+	retention time.Duration
+}
+
+// newDiskSpillStore creates the spillover directory if needed and makes sure batches can be written to it
+func newDiskSpillStore(dir string) (*diskSpillStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("newDiskSpillStore: %w", err)
+	}
+	probe, err := ioutil.TempFile(dir, "probe")
+	if err != nil {
+		return nil, fmt.Errorf("newDiskSpillStore: %w", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	store := &diskSpillStore{dir: dir}
+	// batches spilled before a restart are retried too
+	names, err := store.batchFiles()
+	if err != nil {
+		return nil, err
+	}
+	store.count = len(names)
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			store.bytes += info.Size()
+		}
+	}
+	return store, nil
+}
+
+func (d *diskSpillStore) Push(batch [][]byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	content := bytes.Join(batch, []byte("\n"))
+	size := int64(len(content))
+	if d.maxBytes > 0 && size > d.maxBytes {
+		return fmt.Errorf("diskSpillStore: batch of %d bytes exceeds spillover_max_bytes %d", size, d.maxBytes)
+	}
+	if err := d.expireLocked(); err != nil {
+		return err
+	}
+	for d.maxBytes > 0 && d.count > 0 && d.bytes+size > d.maxBytes {
+		if err := d.dropOldestLocked("spillover_max_bytes reached"); err != nil {
+			return err
+		}
+	}
+	d.sequence++
+	name := fmt.Sprintf("%020d-%010d%s", time.Now().UnixNano(), d.sequence, spillFileSuffix)
+	temp := filepath.Join(d.dir, name+".tmp")
+	if err := ioutil.WriteFile(temp, content, 0600); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("diskSpillStore: %w", err)
+	}
+	// renamed once complete, so a crash never leaves a partial batch behind
+	if err := os.Rename(temp, filepath.Join(d.dir, name)); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("diskSpillStore: %w", err)
+	}
+	d.count++
+	d.bytes += size
+	return nil
+}
+
+// Peek reads the oldest batch file, its name is the id. The file is only deleted by Remove, so a batch is never lost
+// to a crash while it is posted and keeps its place and age if the post fails
+func (d *diskSpillStore) Peek() ([][]byte, string, bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.expireLocked(); err != nil {
+		return nil, "", false, err
+	}
+	names, err := d.batchFiles()
+	if err != nil || len(names) == 0 {
+		return nil, "", false, err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(d.dir, names[0]))
+	if err != nil {
+		return nil, "", false, fmt.Errorf("diskSpillStore: %w", err)
+	}
+	return bytes.Split(content, []byte("\n")), names[0], true, nil
+}
+
+func (d *diskSpillStore) Remove(id string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	path := filepath.Join(d.dir, id)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// dropped by spillover_max_bytes or spillover_retention while it was posted
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("diskSpillStore: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("diskSpillStore: %w", err)
+	}
+	d.count--
+	d.bytes -= info.Size()
+	return nil
+}
+
+// expireLocked drops the batches spilled longer than retention ago. d.mutex must be held
+func (d *diskSpillStore) expireLocked() error {
+	if d.retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-d.retention).UnixNano()
+	names, err := d.batchFiles()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		spilledAt, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+		if err != nil || spilledAt >= cutoff {
+			// the files are sorted oldest first
+			break
+		}
+		if err := d.dropOldestLocked("spillover_retention elapsed"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropOldestLocked deletes the oldest batch file unposted, counting its records as dropped. d.mutex must be held
+func (d *diskSpillStore) dropOldestLocked(reason string) error {
+	names, err := d.batchFiles()
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	path := filepath.Join(d.dir, names[0])
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("diskSpillStore: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("diskSpillStore: %w", err)
+	}
+	d.count--
+	d.bytes -= int64(len(content))
+	records := bytes.Count(content, []byte("\n")) + 1
+	Log("Warning::%s, dropping the %d records of the oldest spilled batch", reason, records)
+	ContainerLogTelemetryMutex.Lock()
+	ContainerLogsOverflowDroppedRecordCount += float64(records)
+	ContainerLogTelemetryMutex.Unlock()
+	return nil
+}
+
+func (d *diskSpillStore) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.count
+}
+
+// batchFiles returns the names of the spilled batch files, oldest first
+func (d *diskSpillStore) batchFiles() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, fmt.Errorf("diskSpillStore: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spillFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// memorySpillStore keeps at most maxRecords records, dropping the oldest batches to make room. The stored batches draw
+// from budget, oldest batches are dropped to make room in it too
+type memorySpillStore struct {
+	mutex   sync.Mutex
+	batches [][][]byte
+	// id of batches[0], batches are only ever removed from the front so batches[i] has the id first+i
+	first      uint64
+	records    int
+	maxRecords int
+	budget     *MemoryBudget
+}
+
+func newMemorySpillStore(maxRecords int) *memorySpillStore {
+	return &memorySpillStore{maxRecords: maxRecords}
+}
+
+func (m *memorySpillStore) Push(batch [][]byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(batch) > m.maxRecords {
+		// only the newest records of a batch larger than the whole buffer fit
+		m.countDropped(len(batch) - m.maxRecords)
+		batch = batch[len(batch)-m.maxRecords:]
+	}
+	for m.records+len(batch) > m.maxRecords {
+		m.dropOldest()
+	}
+	size := batchBytes(batch)
+	if m.budget != nil && size > m.budget.Capacity() {
+		// dropping the stored batches wouldn't make room
+		return fmt.Errorf("memorySpillStore: %d bytes don't fit the memory budget of %d bytes", size, m.budget.Capacity())
+	}
+	for !m.budget.TryReserve(size) {
+		if len(m.batches) == 0 {
+			return fmt.Errorf("memorySpillStore: %d bytes don't fit the memory budget of %d bytes left", size, m.budget.Capacity()-m.budget.Used())
+		}
+		m.dropOldest()
+	}
+	m.batches = append(m.batches, batch)
+	m.records += len(batch)
+	return nil
+}
+
+// dropOldest drops the oldest stored batch. m.mutex must be held
+func (m *memorySpillStore) dropOldest() {
+	oldest := m.removeOldest()
+	m.countDropped(len(oldest))
+}
+
+// removeOldest removes the oldest stored batch and gives back its memory. m.mutex must be held
+func (m *memorySpillStore) removeOldest() [][]byte {
+	oldest := m.batches[0]
+	m.batches = m.batches[1:]
+	m.first++
+	m.records -= len(oldest)
+	m.budget.Release(batchBytes(oldest))
+	return oldest
+}
+
+func (m *memorySpillStore) countDropped(records int) {
+	Log("Warning::in-memory overflow buffer is full, dropping the %d oldest records", records)
+	ContainerLogTelemetryMutex.Lock()
+	ContainerLogsOverflowDroppedRecordCount += float64(records)
+	ContainerLogTelemetryMutex.Unlock()
+}
+
+func (m *memorySpillStore) Peek() ([][]byte, string, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.batches) == 0 {
+		return nil, "", false, nil
+	}
+	return m.batches[0], strconv.FormatUint(m.first, 10), true, nil
+}
+
+func (m *memorySpillStore) Remove(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// a batch dropped meanwhile has an id below first
+	if len(m.batches) > 0 && id == strconv.FormatUint(m.first, 10) {
+		m.removeOldest()
+	}
+	return nil
+}
+
+func (m *memorySpillStore) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.batches)
+}
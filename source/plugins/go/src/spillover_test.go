@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_newSpillStore_UnwritablePathFallsBackToMemory(t *testing.T) {
+	// a regular file where the spillover directory should be makes the path unwritable, even when running as root
+	blocker := filepath.Join(t.TempDir(), "state")
+	if err := ioutil.WriteFile(blocker, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	logged, restore := captureLog()
+	defer restore()
+
+	store := newSpillStore(map[string]string{
+		"spillover_path":              filepath.Join(blocker, "buffer"),
+		"memory_overflow_max_records": "3",
+	})
+	memory, ok := store.(*memorySpillStore)
+	if !ok {
+		t.Fatalf("newSpillStore() = %T, want the in-memory fallback", store)
+	}
+	if memory.maxRecords != 3 {
+		t.Errorf("maxRecords = %d, want 3", memory.maxRecords)
+	}
+	if !loggedContaining(logged(), "DEGRADED MODE") {
+		t.Errorf("degraded mode not logged, got %v", logged())
+	}
+
+	// overflowing drops the oldest batch
+	ContainerLogsOverflowDroppedRecordCount = 0
+	store.Push([][]byte{[]byte("1"), []byte("2")})
+	store.Push([][]byte{[]byte("3")})
+	store.Push([][]byte{[]byte("4"), []byte("5")})
+	if ContainerLogsOverflowDroppedRecordCount != 2 {
+		t.Errorf("ContainerLogsOverflowDroppedRecordCount = %v, want 2", ContainerLogsOverflowDroppedRecordCount)
+	}
+	var popped []string
+	for {
+		batch, ok := popSpilled(t, store)
+		if !ok {
+			break
+		}
+		popped = append(popped, fmt.Sprintf("%s", batch))
+	}
+	if fmt.Sprint(popped) != "[[3] [4 5]]" {
+		t.Errorf("batches left = %v, want [[3] [4 5]]", popped)
+	}
+}
+
+func Test_newSpillStore_Disk(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "buffer")
+	store := newSpillStore(map[string]string{"spillover_path": dir})
+	if _, ok := store.(*diskSpillStore); !ok {
+		t.Fatalf("newSpillStore() = %T, want a disk store", store)
+	}
+	store.Push([][]byte{[]byte(`{"LogEntry":"a"}`), []byte(`{"LogEntry":"b"}`)})
+	store.Push([][]byte{[]byte(`{"LogEntry":"c"}`)})
+
+	// batches survive a restart
+	reopened, err := newDiskSpillStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 2 {
+		t.Fatalf("Len() after reopening = %d, want 2", reopened.Len())
+	}
+	batch, ok := popSpilled(t, reopened)
+	if !ok || fmt.Sprintf("%s", batch) != `[{"LogEntry":"a"} {"LogEntry":"b"}]` {
+		t.Errorf("popSpilled() = (%s, %v), want the oldest batch", batch, ok)
+	}
+}
+
+// popSpilled removes and returns the oldest batch of store, false if there is none
+func popSpilled(t *testing.T, store spillStore) ([][]byte, bool) {
+	batch, id, ok, err := store.Peek()
+	if err != nil {
+		t.Fatalf("Peek() error = %v", err)
+	}
+	if ok {
+		if err := store.Remove(id); err != nil {
+			t.Fatalf("Remove(%s) error = %v", id, err)
+		}
+	}
+	return batch, ok
+}
+
+func Test_diskSpillStore_PeekKeepsBatchUntilRemoved(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "buffer")
+	store, err := newDiskSpillStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Push([][]byte{[]byte("a")})
+	store.Push([][]byte{[]byte("b")})
+	_, first, _, _ := store.Peek()
+	batch, id, ok, err := store.Peek()
+	if err != nil || !ok || id != first || string(batch[0]) != "a" {
+		t.Fatalf("Peek() again = (%s, %s, %v, %v), want the same oldest batch %s", batch, id, ok, err, first)
+	}
+
+	// a crash before Remove leaves the batch for the next start
+	reopened, err := newDiskSpillStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 2 || reopened.bytes != 2 {
+		t.Fatalf("%d batches of %d bytes after reopening, want 2 of 2 bytes", reopened.Len(), reopened.bytes)
+	}
+	if err := reopened.Remove(id); err != nil || reopened.Len() != 1 || reopened.bytes != 1 {
+		t.Errorf("Remove() = %v leaving %d batches of %d bytes, want 1 of 1 byte", err, reopened.Len(), reopened.bytes)
+	}
+	// removing a batch that is already gone, e.g. dropped by spillover_retention, is a no-op
+	if err := reopened.Remove(id); err != nil || reopened.Len() != 1 {
+		t.Errorf("Remove() of a removed batch = %v leaving %d batches, want nil and 1", err, reopened.Len())
+	}
+	if batch, _, _, _ := reopened.Peek(); string(batch[0]) != "b" {
+		t.Errorf("Peek() after Remove() = %s, want b", batch)
+	}
+}
+
+func Test_Sender_FailedSpilledBatchKeepsItsPlace(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	s, recorder := newTestSender(1, 0)
+	store, err := newDiskSpillStore(filepath.Join(t.TempDir(), "buffer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.spill = store
+	s.deadletter = NewDeadletter(filepath.Join(t.TempDir(), "deadletter.jsonl"))
+	var failing int32 = 1
+	s.post = func(ctx context.Context, records [][]byte) error {
+		if atomic.LoadInt32(&failing) == 1 || string(records[0]) == `{"LogEntry":"a"}` {
+			return fmt.Errorf("outage: %w", ErrODSRetriesExhausted)
+		}
+		return recorder.post(ctx, records)
+	}
+	s.Enqueue([]byte(`{"LogEntry":"a"}`))
+	s.Enqueue([]byte(`{"LogEntry":"b"}`))
+	before, _ := store.batchFiles()
+
+	// the oldest spilled batch keeps failing, it stays the oldest with its original file and age
+	atomic.StoreInt32(&failing, 0)
+	if s.retrySpilled(context.Background()) {
+		t.Fatalf("retrySpilled() = true, want the failing batch reported")
+	}
+	after, _ := store.batchFiles()
+	if fmt.Sprint(after) != fmt.Sprint(before) || len(recorder.batchSizes()) != 0 {
+		t.Fatalf("spilled files %v after a failed retry, want %v left in place and nothing posted", after, before)
+	}
+
+	// so spillover_retention expires it, and the batch behind it is posted
+	store.retention = time.Hour
+	spilledAt, _ := strconv.ParseInt(strings.SplitN(before[0], "-", 2)[0], 10, 64)
+	aged := fmt.Sprintf("%020d-%s", spilledAt-2*int64(time.Hour), strings.SplitN(before[0], "-", 2)[1])
+	if err := os.Rename(filepath.Join(store.dir, before[0]), filepath.Join(store.dir, aged)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.retrySpilled(context.Background()) || fmt.Sprint(recorder.batchSizes()) != "[1]" || store.Len() != 0 {
+		t.Errorf("batch sizes = %v with %d batches spilled, want the expired batch dropped and the other posted", recorder.batchSizes(), store.Len())
+	}
+}
+
+// waitForSpillRetry waits for the spill retry loop of s to end
+func waitForSpillRetry(t *testing.T, s *Sender) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mutex.Lock()
+		retrying := s.spillRetrying
+		s.mutex.Unlock()
+		if !retrying {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spill retry loop still running after 2s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_Sender_SpillsAndRetriesFailedBatches(t *testing.T) {
+	s, recorder := newTestSender(1, 0)
+	s.spill = newMemorySpillStore(10)
+	s.deadletter = NewDeadletter(filepath.Join(t.TempDir(), "deadletter.jsonl"))
+	s.post = func(ctx context.Context, records [][]byte) error {
+		return fmt.Errorf("outage: %w", ErrODSRetriesExhausted)
+	}
+
+	s.Enqueue([]byte(`{"LogEntry":"a"}`))
+	s.Enqueue([]byte(`{"LogEntry":"b"}`))
+	if s.spill.Len() != 2 {
+		t.Fatalf("%d spilled batches, want 2", s.spill.Len())
+	}
+
+	// the endpoint recovered, the next successful post wakes the spill retry loop, which posts the spilled batches
+	// without holding up that flush
+	release := make(chan struct{})
+	s.post = func(ctx context.Context, records [][]byte) error {
+		if !bytes.Contains(records[0], []byte(`"c"`)) {
+			<-release
+		}
+		return recorder.post(ctx, records)
+	}
+	s.Enqueue([]byte(`{"LogEntry":"c"}`))
+	if got := len(recorder.batchSizes()); got != 1 {
+		t.Errorf("%d batches posted by the flush, want only its own", got)
+	}
+	close(release)
+	waitForSpillRetry(t, s)
+	if got := len(recorder.batchSizes()); got != 3 || s.spill.Len() != 0 {
+		t.Errorf("%d batches posted and %d still spilled, want 3 and 0", got, s.spill.Len())
+	}
+
+	// non-retriable failures aren't spilled
+	s.post = func(ctx context.Context, records [][]byte) error {
+		return fmt.Errorf("bad request: %w", ErrODSNonRetriable)
+	}
+	s.Enqueue([]byte(`{"LogEntry":"d"}`))
+	if s.spill.Len() != 0 || len(readDeadletterEntries(t, s.deadletter.path)) != 1 {
+		t.Errorf("non-retriable failure was spilled instead of deadlettered")
+	}
+}
+
+func Test_diskSpillStore_Bounds(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	dir := filepath.Join(t.TempDir(), "buffer")
+	store := newSpillStore(map[string]string{"spillover_path": dir, "spillover_max_bytes": "8"}).(*diskSpillStore)
+	ContainerLogsOverflowDroppedRecordCount = 0
+	store.Push([][]byte{[]byte("1"), []byte("2")})
+	store.Push([][]byte{[]byte("3")})
+	// going over spillover_max_bytes drops the oldest batch
+	store.Push([][]byte{[]byte("4567")})
+	store.Push([][]byte{[]byte("8")})
+	if store.Len() != 3 || ContainerLogsOverflowDroppedRecordCount != 2 {
+		t.Errorf("%d batches kept and %v records dropped, want 3 and 2", store.Len(), ContainerLogsOverflowDroppedRecordCount)
+	}
+	if err := store.Push([][]byte{[]byte("larger than max")}); err == nil {
+		t.Errorf("Push() of a batch exceeding spillover_max_bytes succeeded, want error")
+	}
+
+	// the size of the batches spilled before a restart counts too
+	reopened, err := newDiskSpillStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.bytes != 6 {
+		t.Errorf("bytes after reopening = %d, want 6", reopened.bytes)
+	}
+
+	// batches older than spillover_retention are dropped unposted
+	reopened.retention = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	if batch, _, ok, err := reopened.Peek(); ok || err != nil {
+		t.Errorf("Peek() = (%s, %v, %v), want the expired batches dropped", batch, ok, err)
+	}
+	if reopened.Len() != 0 || ContainerLogsOverflowDroppedRecordCount != 5 {
+		t.Errorf("%d batches kept and %v records dropped after expiry, want 0 and 5", reopened.Len(), ContainerLogsOverflowDroppedRecordCount)
+	}
+}
+
+func Test_Sender_SpillRetryBackoff(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	s, recorder := newTestSender(1, 0)
+	s.spill = newMemorySpillStore(10)
+	s.spillRetryInitialDelay, s.spillRetryMaxDelay = 20*time.Millisecond, 80*time.Millisecond
+	var mutex sync.Mutex
+	var attempts []time.Time
+	s.post = func(ctx context.Context, records [][]byte) error {
+		mutex.Lock()
+		attempts = append(attempts, time.Now())
+		failed := len(attempts) <= 4
+		mutex.Unlock()
+		if failed {
+			return fmt.Errorf("outage: %w", ErrODSRetriesExhausted)
+		}
+		return recorder.post(ctx, records)
+	}
+
+	// nothing else is logged, the loop alone delivers the spilled batch once the endpoint recovers
+	s.Enqueue([]byte(`{"LogEntry":"a"}`))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.batchSizes()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fmt.Sprint(recorder.batchSizes()); got != "[1]" || s.spill.Len() != 0 {
+		t.Fatalf("batch sizes = %s with %d batches spilled, want [1] delivered by the retry loop", got, s.spill.Len())
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	// first post, then retries 20ms, 40ms, 80ms apart and capped at 80ms
+	for i, want := range []time.Duration{20, 40, 80, 80} {
+		if gap := attempts[i+1].Sub(attempts[i]); gap < want*time.Millisecond {
+			t.Errorf("retry %d came %s after the previous attempt, want at least %dms", i+1, gap, want)
+		}
+	}
+}
+
+func Test_Sender_ShutdownStopsSpillRetry(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	s, _ := newTestSender(1, 0)
+	s.spill = newMemorySpillStore(10)
+	s.spillRetryInitialDelay, s.spillRetryMaxDelay = 10*time.Millisecond, 10*time.Millisecond
+	var posts int32
+	s.post = func(ctx context.Context, records [][]byte) error {
+		atomic.AddInt32(&posts, 1)
+		return fmt.Errorf("outage: %w", ErrODSRetriesExhausted)
+	}
+	s.Enqueue([]byte(`{"LogEntry":"a"}`))
+	s.Shutdown(context.Background())
+	stopped := atomic.LoadInt32(&posts)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&posts); got > stopped+1 || s.spill.Len() != 1 {
+		t.Errorf("%d posts after Shutdown with %d batches spilled, want the retry loop stopped and the batch kept", got-stopped, s.spill.Len())
+	}
+}
@@ -28,8 +28,6 @@ var (
 	AgentLogProcessingMaxLatencyMsContainer string
 	// CommonProperties indicates the dimensions that are sent with every event/metric
 	CommonProperties map[string]string
-	// TelemetryClient is the client used to send the telemetry
-	TelemetryClient appinsights.TelemetryClient
 	// ContainerLogTelemetryTicker sends telemetry periodically
 	ContainerLogTelemetryTicker *time.Ticker
 	//Tracks the number of windows telegraf metrics count with Tags size 64KB or more between telemetry ticker periods (uses ContainerLogTelemetryTicker)
@@ -54,6 +52,32 @@ var (
 	ContainerLogsADXClientCreateErrors float64
 	//Tracks the number of container log records with empty Timestamp (uses ContainerLogTelemetryTicker)
 	ContainerLogRecordCountWithEmptyTimeStamp float64
+	//Tracks the number of container log records deadlettered and batches split for exceeding max_payload_bytes (uses ContainerLogTelemetryTicker)
+	ContainerLogsOversizePayloadCount float64
+	//Tracks the number of container log records dropped by the record_filter rules (uses ContainerLogTelemetryTicker)
+	ContainerLogsFilteredRecordCount float64
+	//Tracks the number of container log records dropped from the full in-memory overflow buffer (uses ContainerLogTelemetryTicker)
+	ContainerLogsOverflowDroppedRecordCount float64
+	//Tracks the number of deadlettered records dropped to keep the deadletter file under deadletter_max_bytes (uses ContainerLogTelemetryTicker)
+	ContainerLogsDeadletterDroppedRecordCount float64
+	//Tracks the number of batches delivered to OMSEndpoint (uses ContainerLogTelemetryTicker)
+	ContainerLogsPostedBatchCount float64
+	//Tracks the number of records of the batches delivered to OMSEndpoint (uses ContainerLogTelemetryTicker)
+	ContainerLogsPostedBatchRecordCount float64
+	//Tracks the total and the largest payload size, before compression, of the batches delivered to OMSEndpoint (uses ContainerLogTelemetryTicker)
+	ContainerLogsPostedBatchBytes    float64
+	ContainerLogsPostedBatchMaxBytes float64
+	//Tracks the size of the gzipped payloads delivered to OMSEndpoint before and after compression (uses ContainerLogTelemetryTicker)
+	ContainerLogsGzipInputBytes  float64
+	ContainerLogsGzipOutputBytes float64
+	//Tracks the number of posts to OMSEndpoint the proxy didn't open a CONNECT tunnel for (uses ContainerLogTelemetryTicker)
+	ContainerLogsProxyTunnelFailureCount float64
+	//Tracks the number of posts to OMSEndpoint failing with other transport errors (uses ContainerLogTelemetryTicker)
+	ContainerLogsEndpointTransportErrorCount float64
+	//Tracks the number of failed TLS handshakes of posts to OMSEndpoint (uses ContainerLogTelemetryTicker)
+	ContainerLogsTLSHandshakeFailureCount float64
+	//Tracks the number of successful TLS handshakes of posts to OMSEndpoint by version, cipher suite and resumption (uses ContainerLogTelemetryTicker)
+	ContainerLogsTLSHandshakeCounts map[tlsHandshakeOutcome]float64
 	//Tracks the number of OSM namespaces and sent only from prometheus sidecar (uses ContainerLogTelemetryTicker)
 	OSMNamespaceCount int
 	//Tracks whether monitor kubernetes pods is set to true and sent only from prometheus sidecar (uses ContainerLogTelemetryTicker)
@@ -88,6 +112,23 @@ const (
 	metricNameErrorCountContainerLogsSendErrorsToADXFromFluent  = "ContainerLogs2ADXSendErrorCount"
 	metricNameErrorCountContainerLogsADXClientCreateError       = "ContainerLogsADXClientCreateErrorCount"
 	metricNameContainerLogRecordCountWithEmptyTimeStamp         = "ContainerLogRecordCountWithEmptyTimeStamp"
+	metricNameContainerLogSenderQueueDepth                      = "ContainerLogSenderQueueDepth"
+	metricNameContainerLogSenderOldestRecordAgeMs               = "ContainerLogSenderOldestRecordAgeMs"
+	metricNameContainerLogsOversizePayloadCount                 = "ContainerLogsOversizePayloadCount"
+	metricNameContainerLogsFilteredRecordCount                  = "ContainerLogsFilteredRecordCount"
+	metricNameContainerLogsOverflowDroppedRecordCount           = "ContainerLogsOverflowDroppedRecordCount"
+	metricNameContainerLogsDeadletterDroppedRecordCount         = "ContainerLogsDeadletterDroppedRecordCount"
+	metricNameContainerLogsProxyTunnelFailureCount              = "ContainerLogsProxyTunnelFailureCount"
+	metricNameContainerLogsEndpointTransportErrorCount          = "ContainerLogsEndpointTransportErrorCount"
+	metricNameContainerLogSenderSecondsSinceLastSuccessfulPost  = "ContainerLogSenderSecondsSinceLastSuccessfulPost"
+	metricNameContainerLogSenderAdaptiveBatchSize               = "ContainerLogSenderAdaptiveBatchSize"
+	metricNameContainerLogsTLSHandshakeCount                    = "ContainerLogsTLSHandshakeCount"
+	metricNameContainerLogsTLSHandshakeFailureCount             = "ContainerLogsTLSHandshakeFailureCount"
+	metricNameContainerLogsMemoryBudgetUsedBytes                = "ContainerLogsMemoryBudgetUsedBytes"
+	metricNameContainerLogsBatchAvgRecordCount                  = "ContainerLogsBatchAvgRecordCount"
+	metricNameContainerLogsBatchAvgBytes                        = "ContainerLogsBatchAvgBytes"
+	metricNameContainerLogsBatchMaxBytes                        = "ContainerLogsBatchMaxBytes"
+	metricNameContainerLogsGzipCompressionRatio                 = "ContainerLogsGzipCompressionRatio"
 
 	defaultTelemetryPushIntervalSeconds = 300
 
@@ -95,6 +136,11 @@ const (
 	eventNameDaemonSetHeartbeat               = "ContainerLogDaemonSetHeartbeatEvent"
 	eventNameCustomPrometheusSidecarHeartbeat = "CustomPrometheusSidecarHeartbeatEvent"
 	eventNameWindowsFluentBitHeartbeat        = "WindowsFluentBitHeartbeatEvent"
+	eventNameInsecureSkipVerifyEnabled        = "ContainerLogInsecureSkipVerifyEnabled"
+	eventNameConnectivityHeartbeat            = "ContainerLogConnectivityHeartbeatEvent"
+	eventNameClockSkewDetected                = "ContainerLogClockSkewDetected"
+	eventNameLogFileWriteFailed               = "ContainerLogLogFileWriteFailed"
+	eventNameSelfCheck                        = "ContainerLogSelfCheck"
 )
 
 // SendContainerLogPluginMetrics is a go-routine that flushes the data periodically (every 5 mins to App Insights)
@@ -133,6 +179,20 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 		promMonitorPodsLabelSelectorLength := PromMonitorPodsLabelSelectorLength
 		promMonitorPodsFieldSelectorLength := PromMonitorPodsFieldSelectorLength
 		containerLogRecordCountWithEmptyTimeStamp := ContainerLogRecordCountWithEmptyTimeStamp
+		containerLogsOversizePayloadCount := ContainerLogsOversizePayloadCount
+		containerLogsFilteredRecordCount := ContainerLogsFilteredRecordCount
+		containerLogsOverflowDroppedRecordCount := ContainerLogsOverflowDroppedRecordCount
+		containerLogsDeadletterDroppedRecordCount := ContainerLogsDeadletterDroppedRecordCount
+		containerLogsProxyTunnelFailureCount := ContainerLogsProxyTunnelFailureCount
+		containerLogsEndpointTransportErrorCount := ContainerLogsEndpointTransportErrorCount
+		containerLogsTLSHandshakeFailureCount := ContainerLogsTLSHandshakeFailureCount
+		containerLogsTLSHandshakeCounts := ContainerLogsTLSHandshakeCounts
+		containerLogsPostedBatchCount := ContainerLogsPostedBatchCount
+		containerLogsPostedBatchRecordCount := ContainerLogsPostedBatchRecordCount
+		containerLogsPostedBatchBytes := ContainerLogsPostedBatchBytes
+		containerLogsPostedBatchMaxBytes := ContainerLogsPostedBatchMaxBytes
+		containerLogsGzipInputBytes := ContainerLogsGzipInputBytes
+		containerLogsGzipOutputBytes := ContainerLogsGzipOutputBytes
 
 		TelegrafMetricsSentCount = 0.0
 		TelegrafMetricsSendErrorCount = 0.0
@@ -152,6 +212,20 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 		InsightsMetricsMDSDClientCreateErrors = 0.0
 		KubeMonEventsMDSDClientCreateErrors = 0.0
 		ContainerLogRecordCountWithEmptyTimeStamp = 0.0
+		ContainerLogsOversizePayloadCount = 0.0
+		ContainerLogsFilteredRecordCount = 0.0
+		ContainerLogsOverflowDroppedRecordCount = 0.0
+		ContainerLogsDeadletterDroppedRecordCount = 0.0
+		ContainerLogsProxyTunnelFailureCount = 0.0
+		ContainerLogsEndpointTransportErrorCount = 0.0
+		ContainerLogsTLSHandshakeFailureCount = 0.0
+		ContainerLogsTLSHandshakeCounts = nil
+		ContainerLogsPostedBatchCount = 0.0
+		ContainerLogsPostedBatchRecordCount = 0.0
+		ContainerLogsPostedBatchBytes = 0.0
+		ContainerLogsPostedBatchMaxBytes = 0.0
+		ContainerLogsGzipInputBytes = 0.0
+		ContainerLogsGzipOutputBytes = 0.0
 		ContainerLogTelemetryMutex.Unlock()
 
 		if strings.Compare(strings.ToLower(os.Getenv("CONTROLLER_TYPE")), "daemonset") == 0 {
@@ -195,48 +269,88 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 					telemetryDimensions["FbitMemBufLimitSizeMBs"] = fbitTailMemBufLimitMBs
 				}
 				SendEvent(eventNameDaemonSetHeartbeat, telemetryDimensions)
-				flushRateMetric := appinsights.NewMetricTelemetry(metricNameAvgFlushRate, flushRate)
-				TelemetryClient.Track(flushRateMetric)
-				logRateMetric := appinsights.NewMetricTelemetry(metricNameAvgLogGenerationRate, logRate)
-				logSizeMetric := appinsights.NewMetricTelemetry(metricNameLogSize, logSizeRate)
-				TelemetryClient.Track(logRateMetric)
+				SendMetric(metricNameAvgFlushRate, flushRate, nil)
+				SendMetric(metricNameAvgLogGenerationRate, logRate, nil)
 				Log("Log Size Rate: %f\n", logSizeRate)
-				TelemetryClient.Track(logSizeMetric)
-				logLatencyMetric := appinsights.NewMetricTelemetry(metricNameAgentLogProcessingMaxLatencyMs, logLatencyMs)
-				logLatencyMetric.Properties["Container"] = logLatencyMsContainer
-				TelemetryClient.Track(logLatencyMetric)
+				SendMetric(metricNameLogSize, logSizeRate, nil)
+				SendMetric(metricNameAgentLogProcessingMaxLatencyMs, logLatencyMs, map[string]string{"Container": logLatencyMsContainer})
 			}
 		}
-		TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameNumberofTelegrafMetricsSentSuccessfully, telegrafMetricsSentCount))
+		SendMetric(metricNameNumberofTelegrafMetricsSentSuccessfully, telegrafMetricsSentCount, nil)
 		if telegrafMetricsSendErrorCount > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameNumberofSendErrorsTelegrafMetrics, telegrafMetricsSendErrorCount))
+			SendMetric(metricNameNumberofSendErrorsTelegrafMetrics, telegrafMetricsSendErrorCount, nil)
 		}
 		if telegrafMetricsSend429ErrorCount > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameNumberofSend429ErrorsTelegrafMetrics, telegrafMetricsSend429ErrorCount))
+			SendMetric(metricNameNumberofSend429ErrorsTelegrafMetrics, telegrafMetricsSend429ErrorCount, nil)
 		}
 		if containerLogsSendErrorsToMDSDFromFluent > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsSendErrorsToMDSDFromFluent, containerLogsSendErrorsToMDSDFromFluent))
+			SendMetric(metricNameErrorCountContainerLogsSendErrorsToMDSDFromFluent, containerLogsSendErrorsToMDSDFromFluent, nil)
 		}
 		if containerLogsMDSDClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsMDSDClientCreateError, containerLogsMDSDClientCreateErrors))
+			SendMetric(metricNameErrorCountContainerLogsMDSDClientCreateError, containerLogsMDSDClientCreateErrors, nil)
 		}
 		if containerLogsSendErrorsToADXFromFluent > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsSendErrorsToADXFromFluent, containerLogsSendErrorsToADXFromFluent))
+			SendMetric(metricNameErrorCountContainerLogsSendErrorsToADXFromFluent, containerLogsSendErrorsToADXFromFluent, nil)
 		}
 		if containerLogsADXClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountContainerLogsADXClientCreateError, containerLogsADXClientCreateErrors))
+			SendMetric(metricNameErrorCountContainerLogsADXClientCreateError, containerLogsADXClientCreateErrors, nil)
 		}
 		if insightsMetricsMDSDClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountInsightsMetricsMDSDClientCreateError, insightsMetricsMDSDClientCreateErrors))
+			SendMetric(metricNameErrorCountInsightsMetricsMDSDClientCreateError, insightsMetricsMDSDClientCreateErrors, nil)
 		}
 		if kubeMonEventsMDSDClientCreateErrors > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameErrorCountKubeMonEventsMDSDClientCreateError, kubeMonEventsMDSDClientCreateErrors))
+			SendMetric(metricNameErrorCountKubeMonEventsMDSDClientCreateError, kubeMonEventsMDSDClientCreateErrors, nil)
 		}
 		if winTelegrafMetricsCountWithTagsSize64KBorMore > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameNumberofWinTelegrafMetricsWithTagsSize64KBorMore, winTelegrafMetricsCountWithTagsSize64KBorMore))
+			SendMetric(metricNameNumberofWinTelegrafMetricsWithTagsSize64KBorMore, winTelegrafMetricsCountWithTagsSize64KBorMore, nil)
 		}
 		if ContainerLogRecordCountWithEmptyTimeStamp > 0.0 {
-			TelemetryClient.Track(appinsights.NewMetricTelemetry(metricNameContainerLogRecordCountWithEmptyTimeStamp, containerLogRecordCountWithEmptyTimeStamp))
+			SendMetric(metricNameContainerLogRecordCountWithEmptyTimeStamp, containerLogRecordCountWithEmptyTimeStamp, nil)
+		}
+		if containerLogsOversizePayloadCount > 0.0 {
+			SendMetric(metricNameContainerLogsOversizePayloadCount, containerLogsOversizePayloadCount, nil)
+		}
+		if containerLogsFilteredRecordCount > 0.0 {
+			SendMetric(metricNameContainerLogsFilteredRecordCount, containerLogsFilteredRecordCount, nil)
+		}
+		if containerLogsOverflowDroppedRecordCount > 0.0 {
+			SendMetric(metricNameContainerLogsOverflowDroppedRecordCount, containerLogsOverflowDroppedRecordCount, nil)
+		}
+		if containerLogsDeadletterDroppedRecordCount > 0.0 {
+			SendMetric(metricNameContainerLogsDeadletterDroppedRecordCount, containerLogsDeadletterDroppedRecordCount, nil)
+		}
+		if containerLogsProxyTunnelFailureCount > 0.0 {
+			SendMetric(metricNameContainerLogsProxyTunnelFailureCount, containerLogsProxyTunnelFailureCount, nil)
+		}
+		if containerLogsEndpointTransportErrorCount > 0.0 {
+			SendMetric(metricNameContainerLogsEndpointTransportErrorCount, containerLogsEndpointTransportErrorCount, nil)
+		}
+		if containerLogsTLSHandshakeFailureCount > 0.0 {
+			SendMetric(metricNameContainerLogsTLSHandshakeFailureCount, containerLogsTLSHandshakeFailureCount, nil)
+		}
+		for outcome, count := range containerLogsTLSHandshakeCounts {
+			SendMetric(metricNameContainerLogsTLSHandshakeCount, count, outcome.dimensions())
+		}
+		if containerLogsPostedBatchCount > 0.0 {
+			SendMetric(metricNameContainerLogsBatchAvgRecordCount, containerLogsPostedBatchRecordCount/containerLogsPostedBatchCount, nil)
+			SendMetric(metricNameContainerLogsBatchAvgBytes, containerLogsPostedBatchBytes/containerLogsPostedBatchCount, nil)
+			SendMetric(metricNameContainerLogsBatchMaxBytes, containerLogsPostedBatchMaxBytes, nil)
+		}
+		if containerLogsGzipOutputBytes > 0.0 {
+			SendMetric(metricNameContainerLogsGzipCompressionRatio, containerLogsGzipInputBytes/containerLogsGzipOutputBytes, nil)
+		}
+		if ProcessMemoryBudget != nil {
+			SendMetric(metricNameContainerLogsMemoryBudgetUsedBytes, float64(ProcessMemoryBudget.Used()), nil)
+		}
+		if ContainerLogSender != nil {
+			SendMetric(metricNameContainerLogSenderQueueDepth, float64(ContainerLogSender.QueueDepth()), nil)
+			SendMetric(metricNameContainerLogSenderOldestRecordAgeMs, float64(ContainerLogSender.OldestRecordAge()/time.Millisecond), nil)
+			if lastSuccess := ContainerLogSender.LastSuccessfulPost(); !lastSuccess.IsZero() {
+				SendMetric(metricNameContainerLogSenderSecondsSinceLastSuccessfulPost, time.Since(lastSuccess).Seconds(), nil)
+			}
+			if size := ContainerLogSender.AdaptiveBatchSize(); size > 0 {
+				SendMetric(metricNameContainerLogSenderAdaptiveBatchSize, float64(size), nil)
+			}
 		}
 
 		start = time.Now()
@@ -246,20 +360,22 @@ func SendContainerLogPluginMetrics(telemetryPushIntervalProperty string) {
 // SendEvent sends an event to App Insights
 func SendEvent(eventName string, dimensions map[string]string) {
 	Log("Sending Event : %s\n", eventName)
-	event := appinsights.NewEventTelemetry(eventName)
-
-	// add any extra Properties
-	for k, v := range dimensions {
-		event.Properties[k] = v
+	if client := getTelemetryClient(); client != nil {
+		client.TrackEvent(eventName, dimensions)
 	}
+}
 
-	TelemetryClient.Track(event)
+// SendMetric sends a metric to App Insights
+func SendMetric(metricName string, value float64, dimensions map[string]string) {
+	if client := getTelemetryClient(); client != nil {
+		client.TrackMetric(metricName, value, dimensions)
+	}
 }
 
 // SendException  send an event to the configured app insights instance
 func SendException(err interface{}) {
-	if TelemetryClient != nil {
-		TelemetryClient.TrackException(err)
+	if client := getTelemetryClient(); client != nil {
+		client.TrackException(err)
 	}
 }
 
@@ -303,12 +419,12 @@ func InitializeTelemetryClient(agentVersion string) (int, error) {
 		telemetryClientConfig.Client = httpClient
 		isProxyConfigured = true
 	}
-	TelemetryClient = appinsights.NewTelemetryClientFromConfig(telemetryClientConfig)
+	appInsightsClient := appinsights.NewTelemetryClientFromConfig(telemetryClientConfig)
 
 	telemetryOffSwitch := os.Getenv("DISABLE_TELEMETRY")
 	if strings.Compare(strings.ToLower(telemetryOffSwitch), "true") == 0 {
 		Log("Appinsights telemetry is disabled \n")
-		TelemetryClient.SetIsEnabled(false)
+		appInsightsClient.SetIsEnabled(false)
 	}
 
 	CommonProperties = make(map[string]string)
@@ -357,7 +473,8 @@ func InitializeTelemetryClient(agentVersion string) (int, error) {
 		}
 	}
 
-	TelemetryClient.Context().CommonProperties = CommonProperties
+	appInsightsClient.Context().CommonProperties = CommonProperties
+	SetTelemetryClient(NewAppInsightsTelemetryClient(appInsightsClient))
 
 	// Getting the namespace count, monitor kubernetes pods values and namespace count once at start because it wont change unless the configmap is applied and the container is restarted
 
@@ -418,8 +535,8 @@ func PushToAppInsightsTraces(records []map[interface{}]interface{}, severityLeve
 	}
 
 	traceEntry := strings.Join(logLines, "\n")
-	traceTelemetryItem := appinsights.NewTraceTelemetry(traceEntry, severityLevel)
-	traceTelemetryItem.Properties["tag"] = tag
-	TelemetryClient.Track(traceTelemetryItem)
+	if client := getTelemetryClient(); client != nil {
+		client.TrackTrace(traceEntry, severityLevel, map[string]string{"tag": tag})
+	}
 	return output.FLB_OK
 }
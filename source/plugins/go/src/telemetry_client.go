@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights"
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// TelemetryClient is a backend for the plugin's own telemetry (SendEvent, SendMetric, SendException and the traces
+// of PushToAppInsightsTraces). Application Insights is the default, SetTelemetryClient installs another one
+type TelemetryClient interface {
+	TrackEvent(name string, properties map[string]string)
+	TrackMetric(name string, value float64, properties map[string]string)
+	TrackException(err interface{})
+	TrackTrace(message string, severity contracts.SeverityLevel, properties map[string]string)
+}
+
+var (
+	telemetryClientMutex = &sync.Mutex{}
+	// telemetryClient receives the telemetry, nil (dropping it) until InitializeTelemetryClient or SetTelemetryClient
+	telemetryClient TelemetryClient
+)
+
+// SetTelemetryClient routes the telemetry to client from now on, nil drops it
+func SetTelemetryClient(client TelemetryClient) {
+	telemetryClientMutex.Lock()
+	defer telemetryClientMutex.Unlock()
+	telemetryClient = client
+}
+
+// getTelemetryClient returns the current telemetry client, nil if none is set
+func getTelemetryClient() TelemetryClient {
+	telemetryClientMutex.Lock()
+	defer telemetryClientMutex.Unlock()
+	return telemetryClient
+}
+
+// appInsightsTelemetryClient sends the telemetry to an App Insights instance
+type appInsightsTelemetryClient struct {
+	client appinsights.TelemetryClient
+}
+
+// NewAppInsightsTelemetryClient wraps an App Insights client into a TelemetryClient
+func NewAppInsightsTelemetryClient(client appinsights.TelemetryClient) TelemetryClient {
+	return &appInsightsTelemetryClient{client: client}
+}
+
+func (c *appInsightsTelemetryClient) TrackEvent(name string, properties map[string]string) {
+	event := appinsights.NewEventTelemetry(name)
+	for k, v := range properties {
+		event.Properties[k] = v
+	}
+	c.client.Track(event)
+}
+
+func (c *appInsightsTelemetryClient) TrackMetric(name string, value float64, properties map[string]string) {
+	metric := appinsights.NewMetricTelemetry(name, value)
+	for k, v := range properties {
+		metric.Properties[k] = v
+	}
+	c.client.Track(metric)
+}
+
+func (c *appInsightsTelemetryClient) TrackException(err interface{}) {
+	c.client.TrackException(err)
+}
+
+func (c *appInsightsTelemetryClient) TrackTrace(message string, severity contracts.SeverityLevel, properties map[string]string) {
+	trace := appinsights.NewTraceTelemetry(message, severity)
+	for k, v := range properties {
+		trace.Properties[k] = v
+	}
+	c.client.Track(trace)
+}
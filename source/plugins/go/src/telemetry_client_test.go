@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/microsoft/ApplicationInsights-Go/appinsights/contracts"
+)
+
+// recordingTelemetryClient is a TelemetryClient keeping everything it is sent
+type recordingTelemetryClient struct {
+	mutex      sync.Mutex
+	events     []string
+	metrics    map[string]float64
+	exceptions []string
+	traces     []string
+}
+
+func (c *recordingTelemetryClient) TrackEvent(name string, properties map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.events = append(c.events, name)
+}
+
+func (c *recordingTelemetryClient) TrackMetric(name string, value float64, properties map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.metrics == nil {
+		c.metrics = map[string]float64{}
+	}
+	c.metrics[name] = value
+}
+
+func (c *recordingTelemetryClient) TrackException(err interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.exceptions = append(c.exceptions, fmt.Sprint(err))
+}
+
+func (c *recordingTelemetryClient) TrackTrace(message string, severity contracts.SeverityLevel, properties map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.traces = append(c.traces, message)
+}
+
+// injectTelemetryClient routes the telemetry to a recording client until the test ends
+func injectTelemetryClient(t *testing.T) *recordingTelemetryClient {
+	client := &recordingTelemetryClient{}
+	SetTelemetryClient(client)
+	t.Cleanup(func() { SetTelemetryClient(nil) })
+	return client
+}
+
+func Test_SendException_InjectedClient(t *testing.T) {
+	client := injectTelemetryClient(t)
+	SendException("boom")
+	SendEvent(eventNameConnectivityHeartbeat, map[string]string{"Reachable": "true"})
+	SendMetric(metricNameContainerLogSenderQueueDepth, 3, nil)
+
+	if len(client.exceptions) != 1 || client.exceptions[0] != "boom" {
+		t.Errorf("exceptions = %v, want [boom]", client.exceptions)
+	}
+	if len(client.events) != 1 || client.events[0] != eventNameConnectivityHeartbeat {
+		t.Errorf("events = %v, want [%s]", client.events, eventNameConnectivityHeartbeat)
+	}
+	if client.metrics[metricNameContainerLogSenderQueueDepth] != 3 {
+		t.Errorf("metrics = %v, want %s = 3", client.metrics, metricNameContainerLogSenderQueueDepth)
+	}
+
+	// nothing is sent nor does it fail without a client
+	SetTelemetryClient(nil)
+	SendException("dropped")
+	if len(client.exceptions) != 1 {
+		t.Errorf("exceptions = %v after the client was removed, want only boom", client.exceptions)
+	}
+}
+
+func Test_SendException_DeadletterWriteFailure(t *testing.T) {
+	_, restore := captureLog()
+	defer restore()
+	client := injectTelemetryClient(t)
+
+	deadletter := NewDeadletter(filepath.Join(t.TempDir(), "missing", "deadletter.jsonl"))
+	if err := deadletter.Write(ContainerLogV2DataType, []byte(`{}`), "test"); err == nil {
+		t.Fatalf("Write() to a missing directory succeeded, want error")
+	}
+	if len(client.exceptions) != 1 || !strings.Contains(client.exceptions[0], "Unable to write to deadletter file") {
+		t.Errorf("exceptions = %v, want the deadletter write failure", client.exceptions)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+)
+
+// tlsHandshakeOutcome is the dimensions the successful TLS handshakes with OMSEndpoint are counted by
+type tlsHandshakeOutcome struct {
+	Version     string
+	CipherSuite string
+	Resumed     bool
+}
+
+// dimensions returns the telemetry dimensions of the outcome
+func (o tlsHandshakeOutcome) dimensions() map[string]string {
+	return map[string]string{
+		"TLSVersion":  o.Version,
+		"CipherSuite": o.CipherSuite,
+		"Resumed":     strconv.FormatBool(o.Resumed),
+	}
+}
+
+// recordTLSHandshake counts the outcome of a TLS handshake of a post, by negotiated version, cipher suite and
+// session resumption for the successful ones
+func recordTLSHandshake(state tls.ConnectionState, err error) {
+	ContainerLogTelemetryMutex.Lock()
+	defer ContainerLogTelemetryMutex.Unlock()
+	if err != nil {
+		ContainerLogsTLSHandshakeFailureCount++
+		return
+	}
+	if ContainerLogsTLSHandshakeCounts == nil {
+		ContainerLogsTLSHandshakeCounts = map[tlsHandshakeOutcome]float64{}
+	}
+	outcome := tlsHandshakeOutcome{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Resumed:     state.DidResume,
+	}
+	ContainerLogsTLSHandshakeCounts[outcome]++
+}
+
+// tlsVersionName returns the name of a TLS version, e.g. TLS 1.2
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func resetTLSHandshakeMetrics() {
+	ContainerLogTelemetryMutex.Lock()
+	ContainerLogsTLSHandshakeFailureCount = 0
+	ContainerLogsTLSHandshakeCounts = nil
+	ContainerLogTelemetryMutex.Unlock()
+}
+
+func Test_PostStreamToODS_TLSHandshakeMetrics(t *testing.T) {
+	resetTLSHandshakeMetrics()
+	defer resetTLSHandshakeMetrics()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	HTTPClient = *server.Client()
+	HTTPClient.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS12
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	if _, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody); err != nil {
+		t.Fatalf("PostStreamToODS() error = %v", err)
+	}
+
+	ContainerLogTelemetryMutex.Lock()
+	defer ContainerLogTelemetryMutex.Unlock()
+	var tls12 float64
+	for outcome, count := range ContainerLogsTLSHandshakeCounts {
+		if outcome.Version == "TLS 1.2" && outcome.CipherSuite != "" && !outcome.Resumed {
+			tls12 += count
+		}
+	}
+	if tls12 != 1 {
+		t.Errorf("TLS 1.2 handshake count = %v in %v, want 1", tls12, ContainerLogsTLSHandshakeCounts)
+	}
+	if ContainerLogsTLSHandshakeFailureCount != 0 {
+		t.Errorf("TLS handshake failure count = %v, want 0", ContainerLogsTLSHandshakeFailureCount)
+	}
+}
+
+func Test_recordTLSHandshake(t *testing.T) {
+	resetTLSHandshakeMetrics()
+	defer resetTLSHandshakeMetrics()
+	state := tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, DidResume: true}
+	recordTLSHandshake(state, nil)
+	recordTLSHandshake(state, nil)
+	recordTLSHandshake(tls.ConnectionState{}, errors.New("remote error: tls: bad certificate"))
+
+	want := tlsHandshakeOutcome{Version: "TLS 1.3", CipherSuite: "TLS_AES_128_GCM_SHA256", Resumed: true}
+	if got := ContainerLogsTLSHandshakeCounts[want]; got != 2 || len(ContainerLogsTLSHandshakeCounts) != 1 {
+		t.Errorf("TLS handshake counts = %v, want 2 for %+v", ContainerLogsTLSHandshakeCounts, want)
+	}
+	if ContainerLogsTLSHandshakeFailureCount != 1 {
+		t.Errorf("TLS handshake failure count = %v, want 1", ContainerLogsTLSHandshakeFailureCount)
+	}
+	if got := want.dimensions(); got["TLSVersion"] != "TLS 1.3" || got["Resumed"] != "true" {
+		t.Errorf("dimensions() = %v", got)
+	}
+	if got := tlsVersionName(0x0305); got != "0x0305" {
+		t.Errorf("tlsVersionName(0x0305) = %s, want 0x0305", got)
+	}
+}
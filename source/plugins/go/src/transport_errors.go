@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrTransportNonRetriable is returned when a post failed with a transport error that would fail the same way on
+// every retry, e.g. the endpoint cert not verifying or the endpoint host not existing. Unlike ErrODSNonRetriable the
+// batch is still spilled, as fixing the configuration makes it deliverable
+var ErrTransportNonRetriable = errors.New("non-retriable transport error posting to ODS")
+
+// nonRetriableTransportError is a transport error classifyTransportError fails fast. It matches
+// ErrTransportNonRetriable and unwraps to the transport error, so its cause can still be inspected
+type nonRetriableTransportError struct {
+	class string
+	err   error
+}
+
+func (e *nonRetriableTransportError) Error() string {
+	return ErrTransportNonRetriable.Error() + ": " + e.class + ": " + e.err.Error()
+}
+
+func (e *nonRetriableTransportError) Is(target error) bool {
+	return target == ErrTransportNonRetriable
+}
+
+func (e *nonRetriableTransportError) Unwrap() error {
+	return e.err
+}
+
+// transport error classes, logged with every transport error of a post
+const (
+	transportErrorTLSVerification   = "tls_verification"
+	transportErrorTLSAlert          = "tls_alert"
+	transportErrorDNSNotFound       = "dns_not_found"
+	transportErrorDNSTemporary      = "dns_temporary"
+	transportErrorConnectionRefused = "connection_refused"
+	transportErrorConnectionReset   = "connection_reset"
+	transportErrorTimeout           = "timeout"
+	transportErrorProxyTunnel       = "proxy_tunnel"
+	transportErrorOther             = "other"
+)
+
+// classifyTransportError returns the class of the transport error of a post and whether retrying it can succeed.
+// Cert verification failures, TLS alerts of the endpoint (e.g. rejecting the client cert) and hosts the DNS doesn't
+// know fail fast, while refused and reset connections, timeouts, DNS server failures and errors that can't be
+// classified are retried
+func classifyTransportError(err error) (string, bool) {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certInvalidErr) || errors.As(err, &hostnameErr) {
+		return transportErrorTLSVerification, false
+	}
+	if errors.Is(err, ErrProxyTunnel) {
+		return transportErrorProxyTunnel, true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return transportErrorDNSNotFound, false
+		}
+		if dnsErr.IsTimeout {
+			return transportErrorTimeout, true
+		}
+		return transportErrorDNSTemporary, true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return transportErrorConnectionRefused, true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return transportErrorConnectionReset, true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return transportErrorTimeout, true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return transportErrorTimeout, true
+	}
+
+	// the errors of some platforms and of the TLS alerts aren't typed
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "remote error: tls:"):
+		return transportErrorTLSAlert, false
+	case strings.Contains(message, "connection refused"):
+		return transportErrorConnectionRefused, true
+	case strings.Contains(message, "connection reset"), strings.Contains(message, "forcibly closed"):
+		return transportErrorConnectionReset, true
+	}
+	return transportErrorOther, true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is a net.Error timing out, like a dial or read deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_classifyTransportError(t *testing.T) {
+	post := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://workspace.ods.opinsights.azure.com/OperationalData.svc/PostJsonDataItems", Err: err}
+	}
+	dial := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name          string
+		err           error
+		wantClass     string
+		wantRetriable bool
+	}{
+		{"unknown authority", post(x509.UnknownAuthorityError{}), transportErrorTLSVerification, false},
+		{"expired cert", post(x509.CertificateInvalidError{Reason: x509.Expired}), transportErrorTLSVerification, false},
+		{"hostname mismatch", post(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "ods"}), transportErrorTLSVerification, false},
+		{"client cert rejected", post(errors.New("remote error: tls: bad certificate")), transportErrorTLSAlert, false},
+		{"NXDOMAIN", post(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "ods", IsNotFound: true}}), transportErrorDNSNotFound, false},
+		{"SERVFAIL", post(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "server misbehaving", Name: "ods", IsTemporary: true}}), transportErrorDNSTemporary, true},
+		{"DNS timeout", post(&net.DNSError{Err: "i/o timeout", Name: "ods", IsTimeout: true}), transportErrorTimeout, true},
+		{"connection refused", post(dial(syscall.ECONNREFUSED)), transportErrorConnectionRefused, true},
+		{"connection reset", post(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), transportErrorConnectionReset, true},
+		{"connection closed", post(io.EOF), transportErrorConnectionReset, true},
+		{"reset message", post(errors.New("wsarecv: An existing connection was forcibly closed by the remote host.")), transportErrorConnectionReset, true},
+		{"dial timeout", post(&net.OpError{Op: "dial", Err: timeoutError{}}), transportErrorTimeout, true},
+		{"deadline", post(context.DeadlineExceeded), transportErrorTimeout, true},
+		{"proxy tunnel", fmt.Errorf("%w: proxy returned Forbidden", ErrProxyTunnel), transportErrorProxyTunnel, true},
+		{"unknown", post(errors.New("http: server gave HTTP response to HTTPS client")), transportErrorOther, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, retriable := classifyTransportError(tt.err)
+			if class != tt.wantClass || retriable != tt.wantRetriable {
+				t.Errorf("classifyTransportError(%v) = (%s, %t), want (%s, %t)", tt.err, class, retriable, tt.wantClass, tt.wantRetriable)
+			}
+		})
+	}
+}
+
+func Test_PostStreamToODS_UntrustedCertFailsFast(t *testing.T) {
+	logged, restore := captureLog()
+	defer restore()
+	var attempts int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer server.Close()
+	// the server cert isn't trusted by a plain client
+	HTTPClient = http.Client{Transport: &http.Transport{}}
+
+	newBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("{}"))), nil
+	}
+	_, err := PostStreamToODS(context.Background(), server.URL, http.Header{}, newBody)
+	if !errors.Is(err, ErrTransportNonRetriable) {
+		t.Fatalf("PostStreamToODS() error = %v, want ErrTransportNonRetriable", err)
+	}
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	if !errors.As(err, &unknownAuthorityErr) {
+		t.Errorf("PostStreamToODS() error = %v, want it to unwrap to the x509 error", err)
+	}
+	if errors.Is(err, ErrODSNonRetriable) || errors.Is(err, ErrODSRetriesExhausted) {
+		t.Errorf("PostStreamToODS() error = %v, want neither ErrODSNonRetriable nor ErrODSRetriesExhausted", err)
+	}
+	if !loggedContaining(logged(), "(nonretriable)") || !loggedContaining(logged(), transportErrorTLSVerification) {
+		t.Errorf("the classification wasn't logged, got %v", logged())
+	}
+	if atomic.LoadInt32(&attempts) != 0 {
+		t.Errorf("server handled %d requests, want none", attempts)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenBlackholed returns the address of a loopback listener that never completes a handshake: its accept queue
+// (backlog 0) is filled by a first connection that is never accepted, so the SYNs of the next ones are dropped
+func listenBlackholed(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket() error = %v", err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf("bind() error = %v", err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	sockaddr, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("getsockname() error = %v", err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sockaddr.(*syscall.SockaddrInet4).Port)
+	filler, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("unable to fill the accept queue of %s: %v", addr, err)
+	}
+	t.Cleanup(func() { filler.Close() })
+	return addr
+}
+
+func Test_CreateHTTPClient_ConnectTimeout(t *testing.T) {
+	IsAADMSIAuthMode = true
+	defer func() { IsAADMSIAuthMode = false }()
+	PluginConfiguration = map[string]string{
+		"connect_timeout": "1",
+		"overall_timeout": "60",
+	}
+	defer func() { PluginConfiguration = nil }()
+	CreateHTTPClient()
+	addr := listenBlackholed(t)
+
+	start := time.Now()
+	client := GetClient()
+	resp, err := client.Get("http://" + addr + "/")
+	elapsed := time.Since(start)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("GET of a blackholed address succeeded")
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("GET of a blackholed address error = %v, want a dial timeout", err)
+	}
+	if elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("GET of a blackholed address failed after %s, want the connect_timeout of 1s", elapsed)
+	}
+}